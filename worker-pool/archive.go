@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// defaultArchiveQueue is how many spooled images NewArchiveSink lets wait
+// for the archive writer before Write blocks.
+const defaultArchiveQueue = 16
+
+// ArchiveSink collects every image into a single .zip or .tar.gz file
+// instead of loose files. Entries are named like FileSink names files. Each
+// image is spooled to a temporary file until it has been read in full, so a
+// failed download leaves no entry behind and memory use does not grow with
+// the size of the images.
+//
+// Spooling happens concurrently in every worker, while a single goroutine
+// appends the completed spool files to the archive, so downloads overlap
+// with archive I/O. Write returns once its image has been appended, with the
+// error of appending it, so every image gets its own outcome. Close must be
+// called once the run is over to complete the archive.
+type ArchiveSink struct {
+	Name   *template.Template // Entry name template; <ID>.jpg when nil
+	Claims *NameClaims        // Resolves images sharing an entry name; nil adds duplicate entries
+
+	mu      sync.RWMutex // Held for writing by Close and serial appends
+	closed  bool
+	entries chan archiveEntry // Spooled images for the writer; nil when serial
+	done    chan struct{}     // Closed once the writer has returned
+
+	file *os.File
+	zw   *zip.Writer
+	gw   *gzip.Writer
+	tw   *tar.Writer
+}
+
+// archiveEntry is an image spooled to a temporary file, waiting to be
+// appended to the archive.
+type archiveEntry struct {
+	name     string
+	spool    *os.File
+	size     int64
+	modified time.Time
+	appended chan error // Receives the outcome of appending the entry
+}
+
+// NewArchiveSink creates the archive at path. The format is chosen by its
+// extension: .zip, or .tar.gz / .tgz.
+func NewArchiveSink(path string, name *template.Template) (*ArchiveSink, error) {
+	return newArchiveSink(path, name, defaultArchiveQueue)
+}
+
+// newArchiveSink is NewArchiveSink with up to queue spooled images waiting
+// for the writer goroutine. With a queue of 0 there is no writer: each Write
+// appends its own image while holding the lock, serializing all writes.
+func newArchiveSink(path string, name *template.Template, queue int) (*ArchiveSink, error) {
+	s := &ArchiveSink{Name: name}
+	lower := strings.ToLower(path)
+	zipped := strings.HasSuffix(lower, ".zip")
+	if !zipped && !strings.HasSuffix(lower, ".tar.gz") && !strings.HasSuffix(lower, ".tgz") {
+		return nil, fmt.Errorf("unsupported archive %q, want a .zip, .tar.gz or .tgz file", path)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive: %w", err)
+	}
+	s.file = file
+	if zipped {
+		s.zw = zip.NewWriter(file)
+	} else {
+		s.gw = gzip.NewWriter(file)
+		s.tw = tar.NewWriter(s.gw)
+	}
+
+	if queue > 0 {
+		s.entries = make(chan archiveEntry, queue)
+		s.done = make(chan struct{})
+		go s.writeEntries()
+	}
+	return s, nil
+}
+
+// entryName returns the name meta is stored under in the archive.
+func (s *ArchiveSink) entryName(meta ImageMeta) (string, error) {
+	name := meta.ID + ".jpg"
+	if s.Name != nil {
+		var err error
+		if name, err = renderFileName(s.Name, meta); err != nil {
+			return "", err
+		}
+	}
+	return s.Claims.Claim(meta.ID, name)
+}
+
+// Write implements Sink.
+func (s *ArchiveSink) Write(ctx context.Context, meta ImageMeta, r io.Reader) error {
+	name, err := s.entryName(meta)
+	if err != nil {
+		return err
+	}
+	spool, err := os.CreateTemp("", "archive-entry-*")
+	if err != nil {
+		return fmt.Errorf("failed to spool %s: %w", name, err)
+	}
+	entry := archiveEntry{name: name, spool: spool, modified: time.Now()}
+	queued := false
+	defer func() {
+		if !queued {
+			entry.discard()
+		}
+	}()
+
+	if entry.size, err = io.Copy(spool, r); err != nil {
+		return err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to spool %s: %w", name, err)
+	}
+
+	if s.entries == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.closed {
+			return errors.New("archive is closed")
+		}
+		return s.appendEntry(entry)
+	}
+
+	entry.appended = make(chan error, 1)
+	if err := s.enqueue(ctx, entry); err != nil {
+		return err
+	}
+	queued = true
+	// Once queued the entry is appended even if ctx is done meanwhile, so
+	// its outcome is waited for rather than abandoned.
+	return <-entry.appended
+}
+
+// enqueue hands entry to the writer goroutine.
+func (s *ArchiveSink) enqueue(ctx context.Context, entry archiveEntry) error {
+	// The read lock keeps Close from closing entries while it is sent on.
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errors.New("archive is closed")
+	}
+	select {
+	case s.entries <- entry:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeEntries appends every queued entry to the archive until entries is
+// closed, reporting each outcome to the Write that queued it.
+func (s *ArchiveSink) writeEntries() {
+	defer close(s.done)
+	for entry := range s.entries {
+		err := s.appendEntry(entry)
+		entry.discard()
+		entry.appended <- err
+	}
+}
+
+// appendEntry copies the spooled image of entry into the archive. Only one
+// appendEntry may run at a time.
+func (s *ArchiveSink) appendEntry(entry archiveEntry) error {
+	if s.zw != nil {
+		w, err := s.zw.CreateHeader(&zip.FileHeader{
+			Name:     entry.name,
+			Method:   zip.Store, // Images are already compressed.
+			Modified: entry.modified,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add %s to archive: %w", entry.name, err)
+		}
+		if _, err := io.Copy(w, entry.spool); err != nil {
+			return fmt.Errorf("failed to add %s to archive: %w", entry.name, err)
+		}
+		return nil
+	}
+
+	err := s.tw.WriteHeader(&tar.Header{
+		Name:    entry.name,
+		Mode:    0o644,
+		Size:    entry.size,
+		ModTime: entry.modified,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add %s to archive: %w", entry.name, err)
+	}
+	if _, err := io.Copy(s.tw, entry.spool); err != nil {
+		return fmt.Errorf("failed to add %s to archive: %w", entry.name, err)
+	}
+	return nil
+}
+
+// discard closes and removes the spool file of e.
+func (e archiveEntry) discard() {
+	e.spool.Close()
+	os.Remove(e.spool.Name())
+}
+
+// Close waits for every queued image to be appended, then writes the
+// archive's trailer, flushes it and closes the file. Later writes fail.
+func (s *ArchiveSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	if s.entries != nil {
+		close(s.entries)
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	if s.done != nil {
+		<-s.done
+	}
+	if s.zw != nil {
+		errs = append(errs, s.zw.Close())
+	} else {
+		errs = append(errs, s.tw.Close(), s.gw.Close())
+	}
+	errs = append(errs, s.file.Close())
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to finish archive: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// readArchive returns the contents of every entry of the archive at path,
+// by entry name.
+func readArchive(tb testing.TB, path string) map[string][]byte {
+	tb.Helper()
+	entries := make(map[string][]byte)
+	if strings.HasSuffix(path, ".zip") {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				tb.Fatal(err)
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				tb.Fatal(err)
+			}
+			entries[f.Name] = data
+		}
+		return entries
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer file.Close()
+	gr, err := gzip.NewReader(file)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		entries[hdr.Name] = data
+	}
+}
+
+// archivePayload is the distinct content stored for image id.
+func archivePayload(id int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("image %d;", id)), 100+id)
+}
+
+// writeArchive stores n images concurrently in a new archive at path with the
+// given writer queue, and returns its contents.
+func writeArchive(t *testing.T, path string, queue, n int) map[string][]byte {
+	t.Helper()
+	sink, err := newArchiveSink(path, nil, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			meta := ImageMeta{ID: fmt.Sprint(i)}
+			if err := sink.Write(context.Background(), meta, bytes.NewReader(archivePayload(i))); err != nil {
+				t.Errorf("Write(%s): %v", meta.ID, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return readArchive(t, path)
+}
+
+func TestArchiveSinkWriterMatchesSerial(t *testing.T) {
+	const images = 50
+	for _, ext := range []string{".zip", ".tar.gz"} {
+		t.Run(ext, func(t *testing.T) {
+			dir := t.TempDir()
+			serial := writeArchive(t, filepath.Join(dir, "serial"+ext), 0, images)
+			concurrent := writeArchive(t, filepath.Join(dir, "writer"+ext), defaultArchiveQueue, images)
+
+			if len(serial) != images {
+				t.Fatalf("serial archive has %d entries, want %d", len(serial), images)
+			}
+			if !maps.EqualFunc(serial, concurrent, bytes.Equal) {
+				t.Error("archive written by the writer goroutine differs from the serial one")
+			}
+			for i := range images {
+				if !bytes.Equal(concurrent[fmt.Sprintf("%d.jpg", i)], archivePayload(i)) {
+					t.Errorf("entry %d.jpg has the wrong content", i)
+				}
+			}
+		})
+	}
+}
+
+func TestArchiveSinkWriteAfterClose(t *testing.T) {
+	for _, queue := range []int{0, defaultArchiveQueue} {
+		sink, err := newArchiveSink(filepath.Join(t.TempDir(), "images.zip"), nil, queue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Write(context.Background(), ImageMeta{ID: "1"}, strings.NewReader("x")); err == nil {
+			t.Errorf("queue %d: Write after Close succeeded", queue)
+		}
+	}
+}
+
+func TestArchiveSinkWriteReportsAppendFailure(t *testing.T) {
+	sink, err := newArchiveSink(filepath.Join(t.TempDir(), "images.zip"), nil, defaultArchiveQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.file.Close() // Appending anything larger than the writer's buffer fails.
+
+	err = sink.Write(context.Background(), ImageMeta{ID: "1"}, bytes.NewReader(make([]byte, 64<<10)))
+	if err == nil || !strings.Contains(err.Error(), "failed to add 1.jpg") {
+		t.Errorf("Write() = %v, want the append failure of its own entry", err)
+	}
+	sink.Close()
+}
+
+// BenchmarkArchiveSink compares appending concurrent writes under the lock
+// (queue 0) with handing them to the writer goroutine.
+func BenchmarkArchiveSink(b *testing.B) {
+	payload := bytes.Repeat([]byte{0xFF}, 256<<10)
+	for _, bench := range []struct {
+		name  string
+		queue int
+	}{{"serial", 0}, {"writer", defaultArchiveQueue}} {
+		b.Run(bench.name, func(b *testing.B) {
+			sink, err := newArchiveSink(filepath.Join(b.TempDir(), "images.tar.gz"), nil, bench.queue)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer sink.Close()
+
+			b.SetBytes(int64(len(payload)))
+			b.SetParallelism(4)
+			var ids atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					meta := ImageMeta{ID: fmt.Sprint(ids.Add(1))}
+					if err := sink.Write(context.Background(), meta, bytes.NewReader(payload)); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestRunIntoArchive(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if err != nil || id == 3 {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(fakeJPEG)
+		w.Write(archivePayload(id))
+	}))
+	defer srv.Close()
+
+	for _, ext := range []string{".zip", ".tar.gz", ".tgz"} {
+		t.Run(ext, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "images"+ext)
+			name, err := parseNameTemplate("{{.Author}}-{{.ID}}.jpg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink, err := NewArchiveSink(path, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jobs := fakeJobs(srv, 8)
+			for i := range jobs {
+				jobs[i].Author = "author"
+			}
+			_, err = Run(Config{
+				WorkerOptions: WorkerOptions{
+					ValidateTimeout: time.Minute,
+					DownloadTimeout: time.Minute,
+					Download:        true,
+					Sink:            sink,
+					Client:          srv.Client(),
+					Logger:          discardLogger(),
+				},
+				Workers: 4,
+				Source:  jobs,
+			})
+			if !errors.Is(err, ErrImageFailed) {
+				t.Fatalf("Run() = %v, want image 3 to fail", err)
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			entries := readArchive(t, path)
+			if len(entries) != len(jobs)-1 {
+				t.Errorf("archive has %d entries, want %d", len(entries), len(jobs)-1)
+			}
+			for i := range len(jobs) {
+				data, ok := entries[fmt.Sprintf("author-%d.jpg", i)]
+				switch {
+				case i == 3 && ok:
+					t.Error("failed image 3 has an entry")
+				case i != 3 && !bytes.Equal(data, append(slices.Clone(fakeJPEG), archivePayload(i)...)):
+					t.Errorf("entry for image %d has %d bytes of the wrong content", i, len(data))
+				}
+			}
+		})
+	}
+
+	if _, err := NewArchiveSink(filepath.Join(t.TempDir(), "images.rar"), nil); err == nil {
+		t.Error("unsupported archive format accepted")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// Autoscaling defaults used when AutoscaleOptions leaves a field unset.
+const (
+	defaultScaleCooldown = 5 * time.Second
+	defaultScaleInterval = 100 * time.Millisecond
+)
+
+// AutoscaleOptions configures NewAutoscalingWorkerPool.
+type AutoscaleOptions struct {
+	// MinWorkers are started right away and kept even while idle; 1 when
+	// not positive.
+	MinWorkers int
+
+	// Backlog is how many queued jobs make the pool add a worker; 1 when
+	// not positive. At most one worker is added per Interval.
+	Backlog int
+
+	// Cooldown is how long a worker beyond MinWorkers may wait for a job
+	// before it exits; defaultScaleCooldown when not positive.
+	Cooldown time.Duration
+
+	// Interval is how often the backlog is checked; defaultScaleInterval
+	// when not positive.
+	Interval time.Duration
+}
+
+// NewAutoscalingWorkerPool is like NewWorkerPool, but instead of a fixed
+// number of workers it starts scale.MinWorkers and adds more, up to
+// maxWorkers, while jobs queue up faster than they are taken. Workers that
+// stay idle for scale.Cooldown exit again, down to scale.MinWorkers. Worker
+// IDs range from 1 to maxWorkers and are reused by later workers.
+func NewAutoscalingWorkerPool(ctx context.Context, maxWorkers int, scale AutoscaleOptions, opts WorkerOptions) *WorkerPool {
+	scale.MinWorkers = min(positiveOr(scale.MinWorkers, 1), maxWorkers)
+	scale.Backlog = positiveOr(scale.Backlog, 1)
+	scale.Cooldown = positiveOr(scale.Cooldown, defaultScaleCooldown)
+	scale.Interval = positiveOr(scale.Interval, defaultScaleInterval)
+	return startWorkerPool(ctx, maxWorkers, opts, poolLayout{autoscale: &scale})
+}
+
+// Workers returns how many workers are currently running.
+func (p *WorkerPool) Workers() int {
+	return int(p.active.Load())
+}
+
+// scaler starts and retires the workers of an autoscaling pool. Workers are
+// only started by startScaler and run, while idle workers retire themselves.
+type scaler struct {
+	p      *WorkerPool
+	scale  AutoscaleOptions
+	max    int
+	ids    chan int     // Worker IDs not in use
+	start  func(id int) // Runs worker id in a new goroutine
+	logger *slog.Logger
+}
+
+// add starts a worker with a free ID. The ID may still be on its way back
+// from a retiring worker, which add then waits for.
+func (s *scaler) add() {
+	s.p.active.Add(1)
+	id := <-s.ids
+	s.p.wg.Add(1)
+	s.start(id)
+}
+
+// retire reports whether worker id may exit because the pool has more than
+// MinWorkers, and if so gives up its ID.
+func (s *scaler) retire(id int) bool {
+	if !decrementAbove(&s.p.active, int64(s.scale.MinWorkers)) {
+		return false
+	}
+	s.logger.Debug("Removing idle worker", "worker_id", id, "workers", s.p.active.Load())
+	s.ids <- id
+	return true
+}
+
+// decrementAbove decrements n unless that would take it to floor or below,
+// and reports whether it did.
+func decrementAbove(n *atomic.Int64, floor int64) bool {
+	for {
+		v := n.Load()
+		if v <= floor {
+			return false
+		}
+		if n.CompareAndSwap(v, v-1) {
+			return true
+		}
+	}
+}
+
+// startScaler starts scale.MinWorkers workers for p and the goroutine that
+// adds more, up to maxWorkers.
+func startScaler(
+	ctx context.Context,
+	jobCtx context.Context,
+	p *WorkerPool,
+	maxWorkers int,
+	scale AutoscaleOptions,
+	beats *heartbeats,
+	opts WorkerOptions,
+) {
+	p.closing = make(chan struct{})
+	s := &scaler{
+		p:      p,
+		scale:  scale,
+		max:    maxWorkers,
+		ids:    make(chan int, maxWorkers),
+		logger: opts.Logger,
+	}
+	for id := 1; id <= maxWorkers; id++ {
+		s.ids <- id
+	}
+	s.start = func(id int) {
+		retire := func() bool { return s.retire(id) }
+		go func() {
+			defer p.wg.Done()
+			if !scalingProcessor(ctx, jobCtx, id, p.jobs, p.results, beats, opts, scale.Cooldown, retire) {
+				p.active.Add(-1)
+			}
+		}()
+	}
+
+	for range scale.MinWorkers {
+		s.add()
+	}
+	p.wg.Add(1)
+	go s.run(ctx)
+}
+
+// run adds a worker every scale.Interval while the backlog is at least
+// scale.Backlog and the pool is below its maximum. It returns once the pool
+// is closed or ctx is done, as no more workers are needed then.
+func (s *scaler) run(ctx context.Context) {
+	defer s.p.wg.Done()
+	ticker := time.NewTicker(s.scale.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.p.closing:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if backlog := len(s.p.jobs); backlog >= s.scale.Backlog && s.p.Workers() < s.max {
+				s.add()
+				s.logger.Debug("Adding worker", "backlog", backlog, "workers", s.p.Workers())
+			}
+		}
+	}
+}
+
+// scalingProcessor is imageProcessor for an autoscaling pool: after waiting
+// cooldown for a job it asks retire whether it may exit. It reports whether
+// it retired, rather than returning because jobs was closed.
+func scalingProcessor(
+	ctx context.Context,
+	jobCtx context.Context,
+	id int,
+	jobs <-chan ImageMeta,
+	results chan<- Result,
+	beats *heartbeats,
+	opts WorkerOptions,
+	cooldown time.Duration,
+	retire func() bool,
+) (retired bool) {
+	staggerStart(ctx, opts)
+	idle := time.NewTimer(cooldown)
+	defer idle.Stop()
+	for {
+		select {
+		case job, ok := <-jobs:
+			if !ok {
+				return false
+			}
+			handleJob(ctx, jobCtx, id, job, results, beats, opts)
+		case <-idle.C:
+			if retire() {
+				return true
+			}
+		}
+		idle.Reset(cooldown)
+	}
+}
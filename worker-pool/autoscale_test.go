@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAutoscaleBurst(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	const maxWorkers, burst = 8, 60
+	pool := NewAutoscalingWorkerPool(context.Background(), maxWorkers, AutoscaleOptions{
+		MinWorkers: 1,
+		Backlog:    2,
+		Cooldown:   50 * time.Millisecond,
+		Interval:   5 * time.Millisecond,
+	}, WorkerOptions{
+		ValidateTimeout: time.Minute,
+		JobBuffer:       burst,
+		Client:          srv.Client(),
+		Logger:          discardLogger(),
+	})
+	defer pool.Drain()
+	defer pool.Close()
+	if got := pool.Workers(); got != 1 {
+		t.Fatalf("pool started with %d workers, want 1", got)
+	}
+
+	for i := range burst {
+		pool.Submit(ImageMeta{ID: strconv.Itoa(i), DownloadURL: srv.URL})
+	}
+	peak := 0
+	for range burst {
+		<-pool.Results()
+		peak = max(peak, pool.Workers())
+	}
+	if peak <= 1 || peak > maxWorkers {
+		t.Errorf("burst ran on at most %d workers, want more than 1 and at most %d", peak, maxWorkers)
+	}
+
+	// Once the burst is done the extra workers idle out, down to the minimum.
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.Workers() > 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool still has %d workers after the burst, want 1", pool.Workers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The remaining worker still takes jobs.
+	pool.Submit(ImageMeta{ID: "after", DownloadURL: srv.URL})
+	if r := <-pool.Results(); r.ID != "after" || r.Error != nil {
+		t.Errorf("job after scaling down: %+v", r)
+	}
+}
+
+func TestDecrementAbove(t *testing.T) {
+	var n atomic.Int64
+	n.Store(3)
+	if !decrementAbove(&n, 1) || !decrementAbove(&n, 1) {
+		t.Fatal("could not decrement 3 to 1")
+	}
+	if decrementAbove(&n, 1) || n.Load() != 1 {
+		t.Errorf("decremented to %d, want to stop at the floor 1", n.Load())
+	}
+}
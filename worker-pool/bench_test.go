@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Flags tuning BenchmarkPool, passed after -args, for example
+// go test -bench Pool -args -bench-latency 50ms.
+var (
+	benchJobs    = flag.Int("bench-jobs", 200, "synthetic images per BenchmarkPool iteration")
+	benchLatency = flag.Duration("bench-latency", 20*time.Millisecond, "latency the fake server adds to every response")
+)
+
+// BenchmarkPool downloads -bench-jobs synthetic images from a fake server
+// per iteration, once per worker count, and reports the throughput.
+func BenchmarkPool(b *testing.B) {
+	srv := newFakeImageServer(b, *benchLatency)
+	jobs := fakeJobs(srv, *benchJobs)
+
+	for _, workers := range []int{1, 2, 4, 8, 16, 32} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			start := time.Now()
+			for b.Loop() {
+				_, err := Run(Config{
+					WorkerOptions: WorkerOptions{
+						ValidateTimeout: time.Minute,
+						DownloadTimeout: time.Minute,
+						Download:        true,
+						Sink:            discardSink{},
+						Client:          srv.Client(),
+						Logger:          discardLogger(),
+					},
+					Workers: workers,
+					Source:  jobs,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			images := float64(b.N * len(jobs))
+			b.ReportMetric(images/time.Since(start).Seconds(), "images/sec")
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned, without making a request, while a
+// CircuitBreaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// defaultBreakerCooldown is how long a CircuitBreaker stays open unless
+// configured otherwise.
+const defaultBreakerCooldown = 30 * time.Second
+
+// CircuitBreaker stops requests to a host that keeps failing. After
+// Threshold consecutive transient failures (network errors, 429 and 5xx, as
+// classified for retries) it opens, and every request fails fast with
+// ErrCircuitOpen for Cooldown. Then a single trial request is let through:
+// if it succeeds the breaker closes again, otherwise it stays open for
+// another Cooldown. Any response that is not a transient failure, such as a
+// 404, shows the host is up and counts as a success. A nil CircuitBreaker
+// never opens.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	clock     Clock
+	logger    *slog.Logger
+
+	mu       sync.Mutex
+	failures int       // Consecutive failures while closed
+	openedAt time.Time // Zero while closed
+	trial    bool      // A trial request is in flight
+}
+
+// NewCircuitBreaker returns a CircuitBreaker that opens after threshold
+// consecutive failures for cooldown (defaultBreakerCooldown when not
+// positive), or nil (never open) when threshold is not positive. State
+// changes are logged to logger, and cooldowns are timed by clock, real time
+// when nil.
+func NewCircuitBreaker(threshold int, cooldown time.Duration, clock Clock, logger *slog.Logger) *CircuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	if clock == nil {
+		clock = realClock{}
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  positiveOr(cooldown, defaultBreakerCooldown),
+		clock:     clock,
+		logger:    logger,
+	}
+}
+
+// Allow reports whether a request may be made now, returning ErrCircuitOpen
+// if not. A request that was allowed must be followed by a call to Record.
+func (b *CircuitBreaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openedAt.IsZero() {
+		return nil
+	}
+	if remaining := b.cooldown - b.clock.Now().Sub(b.openedAt); remaining > 0 {
+		return fmt.Errorf("%w, retrying the host in %s", ErrCircuitOpen, remaining.Round(time.Millisecond))
+	}
+	if b.trial {
+		return fmt.Errorf("%w, waiting for a trial request", ErrCircuitOpen)
+	}
+	b.trial = true
+	return nil
+}
+
+// Record reports the outcome of a request that Allow let through. A request
+// that only failed because ctx ended says nothing about the host; if it was
+// the trial, the next request becomes the trial instead.
+func (b *CircuitBreaker) Record(ctx context.Context, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasTrial := b.trial
+	b.trial = false
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// Neither a success nor a failure.
+	case err == nil || !isRetryable(err):
+		if !b.openedAt.IsZero() {
+			b.logger.Info("Circuit breaker closed, host is responding again")
+		}
+		b.failures = 0
+		b.openedAt = time.Time{}
+	case wasTrial:
+		b.logger.Warn("Circuit breaker trial request failed, staying open", "cooldown", b.cooldown, "error", err)
+		b.openedAt = b.clock.Now()
+	case b.openedAt.IsZero():
+		b.failures++
+		if b.failures >= b.threshold {
+			b.logger.Warn("Circuit breaker opened after consecutive failures",
+				"failures", b.failures,
+				"cooldown", b.cooldown,
+				"error", err,
+			)
+			b.openedAt = b.clock.Now()
+		}
+	}
+}
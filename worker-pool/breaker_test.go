@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTripsAndRecovers(t *testing.T) {
+	clock := newFakeClock()
+	b := NewCircuitBreaker(3, time.Minute, clock, discardLogger())
+	ctx := context.Background()
+	transient := retryable(errors.New("connection reset"))
+
+	request := func(err error) error {
+		t.Helper()
+		if err := b.Allow(); err != nil {
+			return err
+		}
+		b.Record(ctx, err)
+		return nil
+	}
+
+	// Failures below the threshold, or interrupted by a success, keep it closed.
+	for _, err := range []error{transient, transient, nil, transient, transient} {
+		if got := request(err); got != nil {
+			t.Fatalf("breaker open before %d consecutive failures: %v", 3, got)
+		}
+	}
+	if err := request(transient); err != nil {
+		t.Fatalf("third consecutive failure was not let through: %v", err)
+	}
+
+	// Open: requests fail fast until the cooldown is over.
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow after tripping = %v, want ErrCircuitOpen", err)
+	}
+	clock.Advance(59 * time.Second)
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow before the cooldown is over = %v, want ErrCircuitOpen", err)
+	}
+
+	// A failed trial keeps it open for another cooldown.
+	clock.Advance(time.Second)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("trial request not let through after the cooldown: %v", err)
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("second request during the trial = %v, want ErrCircuitOpen", err)
+	}
+	b.Record(ctx, transient)
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow after a failed trial = %v, want ErrCircuitOpen", err)
+	}
+
+	// A trial interrupted by its own context hands the trial to the next request.
+	clock.Advance(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("trial request not let through: %v", err)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	b.Record(cancelled, context.Canceled)
+
+	// A successful trial closes it again.
+	if err := request(nil); err != nil {
+		t.Fatalf("trial after an interrupted one not let through: %v", err)
+	}
+	for range 2 {
+		if err := request(transient); err != nil {
+			t.Fatalf("breaker did not reset its failure count on closing: %v", err)
+		}
+	}
+}
+
+func TestCircuitBreakerCountsNonTransientAsSuccess(t *testing.T) {
+	b := NewCircuitBreaker(2, time.Minute, newFakeClock(), discardLogger())
+	ctx := context.Background()
+	for _, err := range []error{
+		retryable(errors.New("503")),
+		errors.New("404 Not Found"),
+		retryable(errors.New("503")),
+	} {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("breaker opened: %v", err)
+		}
+		b.Record(ctx, err)
+	}
+	if err := b.Allow(); err != nil {
+		t.Errorf("a 404 between failures did not reset the count: %v", err)
+	}
+}
+
+func TestNilCircuitBreaker(t *testing.T) {
+	if b := NewCircuitBreaker(0, time.Minute, nil, nil); b != nil {
+		t.Fatalf("NewCircuitBreaker(0, ...) = %v, want nil", b)
+	}
+	var b *CircuitBreaker
+	b.Record(context.Background(), retryable(errors.New("boom")))
+	if err := b.Allow(); err != nil {
+		t.Errorf("nil breaker Allow = %v", err)
+	}
+}
+
+func TestRunFastFailsWhileBreakerOpen(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	const jobs = 10
+	results, err := Run(Config{
+		WorkerOptions: WorkerOptions{
+			ValidateTimeout: time.Minute,
+			Client:          srv.Client(),
+			Logger:          discardLogger(),
+			Breaker:         NewCircuitBreaker(3, time.Hour, newFakeClock(), discardLogger()),
+		},
+		Workers: 1,
+		Source:  fakeJobs(srv, jobs),
+	})
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Run() = %v, want the fast failures reported", err)
+	}
+	if len(results) != jobs {
+		t.Fatalf("got %d results, want %d", len(results), jobs)
+	}
+	open := 0
+	for _, r := range results {
+		if r.Status != StatusFailed {
+			t.Errorf("image %s: status %v, want failed", r.ID, r.Status)
+		}
+		if errors.Is(r.Error, ErrCircuitOpen) {
+			open++
+		}
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("server got %d requests, want 3 before the breaker opened", got)
+	}
+	if open != jobs-3 {
+		t.Errorf("%d images failed fast, want %d", open, jobs-3)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// cacheValidators are the response headers a server identified a version of
+// an image by, sent back on the next run to ask whether it changed.
+type cacheValidators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// CacheIndex remembers the ETag and Last-Modified header of every image
+// downloaded, keyed by image ID, in a JSON sidecar file. With it, an image
+// that is already stored is revalidated with a conditional request instead
+// of being trusted blindly, and is only downloaded again if it changed. It
+// is safe for concurrent use. A nil CacheIndex remembers nothing.
+type CacheIndex struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]cacheValidators
+}
+
+// LoadCacheIndex reads the index at path. A missing file yields an empty
+// index, which is created by the first Save.
+func LoadCacheIndex(path string) (*CacheIndex, error) {
+	idx := &CacheIndex{path: path, entries: make(map[string]cacheValidators)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache index %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &idx.entries); err != nil {
+		return nil, fmt.Errorf("invalid cache index %s: %w", path, err)
+	}
+	return idx, nil
+}
+
+// lookup returns the validators stored for id.
+func (c *CacheIndex) lookup(id string) (cacheValidators, bool) {
+	if c == nil {
+		return cacheValidators{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.entries[id]
+	return v, ok
+}
+
+// record stores the validators of a fresh download of id, or forgets id when
+// the server sent none.
+func (c *CacheIndex) record(id string, v cacheValidators) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v == (cacheValidators{}) {
+		delete(c.entries, id)
+		return
+	}
+	c.entries[id] = v
+}
+
+// Save writes the index back to its file, atomically via a temporary file
+// so an interrupted save keeps the previous index.
+func (c *CacheIndex) Save() error {
+	c.mu.Lock()
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode cache index: %w", err)
+	}
+
+	tmpPath := c.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write cache index %s: %w", c.path, err)
+	}
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write cache index %s: %w", c.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheIndexNotModified(t *testing.T) {
+	var mu sync.Mutex
+	versions := map[string]string{"1": "v1", "2": "v1"} // Current ETag by image ID
+	conditional := make(map[string]string)              // If-None-Match by image ID
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/")
+		mu.Lock()
+		etag := `"` + versions[id] + `"`
+		conditional[id] = r.Header.Get("If-None-Match")
+		mu.Unlock()
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write(append(bytes.Clone(fakeJPEG), etag...))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	indexPath := filepath.Join(dir, "cache.json")
+	jobs := SliceSource{{ID: "1", DownloadURL: srv.URL + "/1"}, {ID: "2", DownloadURL: srv.URL + "/2"}}
+	run := func() map[string]Result {
+		t.Helper()
+		index, err := LoadCacheIndex(indexPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := Run(Config{
+			WorkerOptions: WorkerOptions{
+				DownloadTimeout: time.Minute,
+				Download:        true,
+				SkipValidate:    true,
+				OutputDir:       dir,
+				CacheIndex:      index,
+				Client:          srv.Client(),
+				Logger:          discardLogger(),
+			},
+			Workers: 2,
+			Source:  jobs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := index.Save(); err != nil {
+			t.Fatal(err)
+		}
+		byID := make(map[string]Result)
+		for _, r := range results {
+			byID[r.ID] = r
+		}
+		return byID
+	}
+
+	first := run()
+	for id, r := range first {
+		if r.Status != StatusSuccess || conditional[id] != "" {
+			t.Errorf("first run: image %s is %v with If-None-Match %q, want a plain download", id, r.Status, conditional[id])
+		}
+	}
+
+	versions["2"] = "v2" // Image 2 changes between runs.
+	second := run()
+	if r := second["1"]; r.Status != StatusCached || !r.NotModified || r.StatusCode != http.StatusNotModified {
+		t.Errorf("unchanged image: %v, not modified %t, HTTP %d; want a cached 304", r.Status, r.NotModified, r.StatusCode)
+	}
+	if conditional["1"] != `"v1"` {
+		t.Errorf("unchanged image sent If-None-Match %q, want the stored ETag", conditional["1"])
+	}
+	if r := second["2"]; r.Status != StatusSuccess || r.NotModified {
+		t.Errorf("changed image: %v, not modified %t; want it downloaded again", r.Status, r.NotModified)
+	}
+
+	for id, etag := range map[string]string{"1": `"v1"`, "2": `"v2"`} {
+		data, err := os.ReadFile(filepath.Join(dir, id+".jpg"))
+		if err != nil || !bytes.HasSuffix(data, []byte(etag)) {
+			t.Errorf("image %s on disk is not version %s: %v", id, etag, err)
+		}
+	}
+	index, err := LoadCacheIndex(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := index.lookup("2"); v.ETag != `"v2"` {
+		t.Errorf("index holds ETag %q for the changed image, want \"v2\"", v.ETag)
+	}
+}
+
+func TestLoadCacheIndexMissingFile(t *testing.T) {
+	index, err := LoadCacheIndex(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := index.lookup("1"); ok {
+		t.Error("empty index knows image 1")
+	}
+	var none *CacheIndex
+	none.record("1", cacheValidators{ETag: "x"})
+	if _, ok := none.lookup("1"); ok {
+		t.Error("nil index remembered image 1")
+	}
+}
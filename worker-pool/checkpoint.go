@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// checkpointInterval is the least time between two saves of a Checkpoint
+// while a run is in progress.
+const checkpointInterval = time.Second
+
+// Checkpoint records the IDs of the images a run completed in a JSON file,
+// so that an interrupted run can be resumed by skipping them. The file is
+// rewritten as the run progresses, at most once per checkpointInterval, and
+// atomically via a temporary file, so a crash loses at most the last few
+// completions and never the file. It is safe for concurrent use. A nil
+// Checkpoint records nothing.
+type Checkpoint struct {
+	path string
+
+	mu       sync.Mutex
+	done     map[string]struct{}
+	dirty    bool      // Completions not saved yet
+	lastSave time.Time // When the file was last written
+}
+
+// LoadCheckpoint reads the checkpoint at path. A missing file yields an empty
+// checkpoint, which is created by the first save.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	c := &Checkpoint{path: path, done: make(map[string]struct{})}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint %s: %w", path, err)
+	}
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %w", path, err)
+	}
+	for _, id := range ids {
+		c.done[id] = struct{}{}
+	}
+	return c, nil
+}
+
+// Len returns how many images are recorded as completed.
+func (c *Checkpoint) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.done)
+}
+
+// Done reports whether id is recorded as completed.
+func (c *Checkpoint) Done(id string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.done[id]
+	return ok
+}
+
+// Mark records id as completed, saving the file if checkpointInterval has
+// passed since the last save.
+func (c *Checkpoint) Mark(id string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.done[id]; ok {
+		return nil
+	}
+	c.done[id] = struct{}{}
+	c.dirty = true
+	if time.Since(c.lastSave) < checkpointInterval {
+		return nil
+	}
+	return c.saveLocked()
+}
+
+// Save writes any completions not saved yet to the file.
+func (c *Checkpoint) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	return c.saveLocked()
+}
+
+// saveLocked writes the checkpoint, sorted so the file is stable across
+// saves. c.mu must be held.
+func (c *Checkpoint) saveLocked() error {
+	ids := make([]string, 0, len(c.done))
+	for id := range c.done {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	data, err := json.MarshalIndent(ids, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+
+	tmpPath := c.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write checkpoint %s: %w", c.path, err)
+	}
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write checkpoint %s: %w", c.path, err)
+	}
+	c.dirty = false
+	c.lastSave = time.Now()
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	srv := newFakeImageServer(t, 0)
+	jobs := fakeJobs(srv, 5)
+	dir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	run := func(stopAfter int) []string {
+		t.Helper()
+		cp, err := LoadCheckpoint(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, _ := Run(Config{
+			WorkerOptions: WorkerOptions{
+				ValidateTimeout: time.Minute,
+				DownloadTimeout: time.Minute,
+				Download:        true,
+				OutputDir:       dir,
+				Client:          srv.Client(),
+				Logger:          discardLogger(),
+			},
+			Workers:    1,
+			Source:     jobs,
+			StopAfter:  stopAfter,
+			Checkpoint: cp,
+		})
+		var ids []string
+		for _, r := range results {
+			if r.Status == StatusSuccess {
+				ids = append(ids, r.ID)
+			}
+		}
+		return ids
+	}
+
+	first := run(2)
+	if len(first) != 2 {
+		t.Fatalf("partial run downloaded %v, want 2 images", first)
+	}
+	second := run(0)
+	if len(second) != 3 {
+		t.Fatalf("resumed run downloaded %v, want the 3 remaining images", second)
+	}
+	for _, id := range first {
+		if slices.Contains(second, id) {
+			t.Errorf("resumed run downloaded %s again", id)
+		}
+	}
+	for _, job := range jobs {
+		if _, err := os.Stat(filepath.Join(dir, job.ID+".jpg")); err != nil {
+			t.Errorf("image %s missing after resuming: %v", job.ID, err)
+		}
+	}
+	cp, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Len() != len(jobs) {
+		t.Errorf("checkpoint records %d images, want %d", cp.Len(), len(jobs))
+	}
+}
+
+func TestValidateRejectsCheckpointWithArchive(t *testing.T) {
+	sink, err := NewArchiveSink(filepath.Join(t.TempDir(), "images.zip"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	cp, err := LoadCheckpoint(filepath.Join(t.TempDir(), "checkpoint.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Download = true
+	cfg.Sink = sink
+	cfg.Checkpoint = cp
+	err = cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "checkpoint cannot be combined") {
+		t.Errorf("Validate() = %v, want the checkpoint and archive rejected", err)
+	}
+}
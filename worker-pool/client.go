@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultUserAgent identifies the downloader unless overridden by a header.
+const defaultUserAgent = "go-concurrency-downloader/1.0"
+
+// Idle connection defaults, tuned for the single CDN host that serves every
+// download: net/http keeps only 2 idle connections per host, so any worker
+// beyond the second would otherwise keep opening new connections.
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 64
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// defaultMaxRedirects is how many redirects a request follows when
+// ClientOptions.MaxRedirects is not set. Picsum download URLs redirect once,
+// to the CDN.
+const defaultMaxRedirects = 5
+
+// ErrTooManyRedirects is wrapped by the error of a request that redirected
+// more often than ClientOptions.MaxRedirects allows.
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// ClientOptions configures the client built by NewHTTPClient.
+type ClientOptions struct {
+	// Headers are set on every outbound request, overriding any default
+	// such as User-Agent. Redirects to another host only keep User-Agent;
+	// see headerTransport.
+	Headers http.Header
+
+	// InsecureSkipVerify disables TLS certificate verification, for
+	// self-hosted mirrors with self-signed certificates. Never enable it
+	// against hosts you do not control.
+	InsecureSkipVerify bool
+
+	// MaxRedirects caps how many redirects a request follows;
+	// defaultMaxRedirects when not positive.
+	MaxRedirects int
+
+	// MaxIdleConns, MaxIdleConnsPerHost and IdleConnTimeout configure the
+	// transport's pool of idle connections; defaultMaxIdleConns,
+	// defaultMaxIdleConnsPerHost and defaultIdleConnTimeout are used when not
+	// positive.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	// DialTimeout, TLSHandshakeTimeout and ResponseHeaderTimeout bound the
+	// phases of a request before its body starts, independently of the
+	// context deadline covering the whole exchange, so a slow handshake
+	// fails fast and is retried instead of using up the job's timeout. When
+	// not positive, net/http's defaults apply: 30s to dial, 10s for the TLS
+	// handshake and no limit on response headers.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+// NewHTTPClient builds the client used for all listing, validation and
+// download requests. It sets no overall Timeout: each request is bounded by
+// its context instead, such as the validate or download timeout of its job,
+// which a fixed client timeout would silently cap.
+func NewHTTPClient(opts ClientOptions) *http.Client {
+	headers := http.Header{"User-Agent": {defaultUserAgent}}
+	for k, v := range opts.Headers {
+		headers[http.CanonicalHeaderKey(k)] = v
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = positiveOr(opts.MaxIdleConns, defaultMaxIdleConns)
+	transport.MaxIdleConnsPerHost = positiveOr(opts.MaxIdleConnsPerHost, defaultMaxIdleConnsPerHost)
+	transport.IdleConnTimeout = positiveOr(opts.IdleConnTimeout, defaultIdleConnTimeout)
+	if opts.DialTimeout > 0 {
+		// Same keep-alive as http.DefaultTransport's dialer.
+		transport.DialContext = (&net.Dialer{Timeout: opts.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	transport.TLSHandshakeTimeout = positiveOr(opts.TLSHandshakeTimeout, transport.TLSHandshakeTimeout)
+	transport.ResponseHeaderTimeout = positiveOr(opts.ResponseHeaderTimeout, transport.ResponseHeaderTimeout)
+	if opts.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	maxRedirects := positiveOr(opts.MaxRedirects, defaultMaxRedirects)
+
+	return &http.Client{
+		// via holds every request made so far, so this allows exactly
+		// maxRedirects hops.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("%w: stopped after %d redirects at %s", ErrTooManyRedirects, maxRedirects, req.URL.Redacted())
+			}
+			return nil
+		},
+		Transport: &headerTransport{
+			base:    transport,
+			headers: headers,
+		},
+	}
+}
+
+// positiveOr returns v when it is positive and def otherwise.
+func positiveOr[T int | time.Duration](v, def T) T {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+// headerTransport sets a fixed set of headers on every request before
+// handing it to base. A redirect to a different host than the request was
+// first made to only gets the User-Agent: the other headers may carry
+// credentials, which must not follow a redirect to wherever Location points.
+type headerTransport struct {
+	base    http.RoundTripper
+	headers http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sameHost := originalRequest(req).URL.Host == req.URL.Host
+	// A RoundTripper must not modify the caller's request.
+	req = req.Clone(req.Context())
+	for k, v := range t.headers {
+		if sameHost || k == "User-Agent" {
+			req.Header[k] = v
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// originalRequest returns the request that req was redirected from,
+// following every hop back to the first, or req itself when it is not a
+// redirect.
+func originalRequest(req *http.Request) *http.Request {
+	for req.Response != nil && req.Response.Request != nil {
+		req = req.Response.Request
+	}
+	return req
+}
+
+// headerFlag collects repeated -header key=value flags.
+type headerFlag http.Header
+
+func (f headerFlag) String() string {
+	var pairs []string
+	for k, vs := range f {
+		for _, v := range vs {
+			pairs = append(pairs, k+"="+v)
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f headerFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return fmt.Errorf("header %q must have the form key=value", value)
+	}
+	http.Header(f).Add(key, strings.TrimSpace(val))
+	return nil
+}
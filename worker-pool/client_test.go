@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingTransport answers every request with an empty 200 response and
+// keeps the requests it got.
+type recordingTransport struct {
+	requests []*http.Request
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, req)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+// recordRequests makes client send its requests to a recordingTransport,
+// keeping the headers it adds.
+func recordRequests(tb testing.TB, client *http.Client) *recordingTransport {
+	tb.Helper()
+	ht, ok := client.Transport.(*headerTransport)
+	if !ok {
+		tb.Fatalf("client transport is %T, want *headerTransport", client.Transport)
+	}
+	rec := &recordingTransport{}
+	ht.base = rec
+	return rec
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	client := NewHTTPClient(ClientOptions{})
+	if client.Timeout != 0 {
+		t.Errorf("Timeout = %v, want none so request contexts alone bound requests", client.Timeout)
+	}
+	rec := recordRequests(t, client)
+
+	resp, err := client.Get("http://images.invalid/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(rec.requests) != 1 {
+		t.Fatalf("transport got %d requests, want 1", len(rec.requests))
+	}
+	if ua := rec.requests[0].Header.Get("User-Agent"); ua != defaultUserAgent {
+		t.Errorf("User-Agent = %q, want %q", ua, defaultUserAgent)
+	}
+}
+
+func TestHeaderTransport(t *testing.T) {
+	client := NewHTTPClient(ClientOptions{Headers: http.Header{
+		"user-agent":    {"mirror-sync/2"},
+		"Authorization": {"Bearer secret"},
+		"X-Tag":         {"a", "b"},
+	}})
+	rec := recordRequests(t, client)
+
+	req, err := http.NewRequest("GET", "http://images.invalid/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	sent := rec.requests[0].Header
+	if ua := sent.Get("User-Agent"); ua != "mirror-sync/2" {
+		t.Errorf("User-Agent = %q, want the configured override", ua)
+	}
+	if auth := sent.Get("Authorization"); auth != "Bearer secret" {
+		t.Errorf("Authorization = %q, want it set", auth)
+	}
+	if tags := sent.Values("X-Tag"); !slices.Equal(tags, []string{"a", "b"}) {
+		t.Errorf("X-Tag = %q, want both values", tags)
+	}
+	if len(req.Header) != 0 {
+		t.Errorf("caller's request was modified: %v", req.Header)
+	}
+}
+
+func TestHeadersNotForwardedAcrossHosts(t *testing.T) {
+	var mu sync.Mutex
+	got := make(map[string]http.Header)
+	record := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			got[name+" "+r.URL.Path] = r.Header.Clone()
+			mu.Unlock()
+		}
+	}
+	other := httptest.NewServer(record("other"))
+	defer other.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/start", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/same", http.StatusFound)
+	})
+	mux.HandleFunc("/same", func(w http.ResponseWriter, r *http.Request) {
+		record("api")(w, r)
+		http.Redirect(w, r, other.URL+"/cdn", http.StatusFound)
+	})
+	api := httptest.NewServer(mux)
+	defer api.Close()
+
+	client := NewHTTPClient(ClientOptions{Headers: http.Header{
+		"User-Agent":    {"mirror-sync/2"},
+		"Authorization": {"Bearer secret"},
+		"X-Api-Key":     {"key"},
+	}})
+	resp, err := client.Get(api.URL + "/start")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	same, cdn := got["api /same"], got["other /cdn"]
+	if same == nil || cdn == nil {
+		t.Fatalf("redirects not followed, got requests %v", got)
+	}
+	if same.Get("Authorization") != "Bearer secret" || same.Get("X-Api-Key") != "key" {
+		t.Errorf("redirect to the same host lost the configured headers: %v", same)
+	}
+	for _, key := range []string{"Authorization", "X-Api-Key"} {
+		if v := cdn.Get(key); v != "" {
+			t.Errorf("%s = %q sent to the host redirected to, want it withheld", key, v)
+		}
+	}
+	if ua := cdn.Get("User-Agent"); ua != "mirror-sync/2" {
+		t.Errorf("User-Agent on the other host = %q, want the configured one", ua)
+	}
+}
+
+func TestInsecureSkipVerify(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // The rejected handshake is expected.
+	srv.StartTLS()
+	defer srv.Close()
+
+	resp, err := NewHTTPClient(ClientOptions{InsecureSkipVerify: true}).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("insecure client: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp, err := NewHTTPClient(ClientOptions{}).Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Error("default client accepted a self-signed certificate")
+	}
+}
+
+func TestRedirectLimit(t *testing.T) {
+	// /hop/N redirects to /hop/N-1, and /hop/0 is the image.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if hops > 0 {
+			http.Redirect(w, r, "/hop/"+strconv.Itoa(hops-1), http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+
+	opts := WorkerOptions{
+		ValidateTimeout: time.Minute,
+		Client:          NewHTTPClient(ClientOptions{MaxRedirects: 3}),
+		Logger:          discardLogger(),
+	}
+	result := processJob(context.Background(), 1, ImageMeta{ID: "1", DownloadURL: srv.URL + "/hop/3"}, opts)
+	if result.Error != nil {
+		t.Fatalf("3 redirects with a limit of 3: %v", result.Error)
+	}
+	if want := srv.URL + "/hop/0"; result.FinalURL != want {
+		t.Errorf("FinalURL = %q, want %q", result.FinalURL, want)
+	}
+
+	result = processJob(context.Background(), 1, ImageMeta{ID: "2", DownloadURL: srv.URL + "/hop/10"}, opts)
+	if !errors.Is(result.Error, ErrTooManyRedirects) {
+		t.Errorf("10 redirects with a limit of 3: error %v, want ErrTooManyRedirects", result.Error)
+	}
+}
+
+// clientTransport returns the *http.Transport underneath client.
+func clientTransport(tb testing.TB, client *http.Client) *http.Transport {
+	tb.Helper()
+	ht, ok := client.Transport.(*headerTransport)
+	if !ok {
+		tb.Fatalf("client transport is %T, want *headerTransport", client.Transport)
+	}
+	transport, ok := ht.base.(*http.Transport)
+	if !ok {
+		tb.Fatalf("base transport is %T, want *http.Transport", ht.base)
+	}
+	return transport
+}
+
+func TestNewHTTPClientIdleConns(t *testing.T) {
+	transport := clientTransport(t, NewHTTPClient(ClientOptions{}))
+	if transport.MaxIdleConns != defaultMaxIdleConns ||
+		transport.MaxIdleConnsPerHost != defaultMaxIdleConnsPerHost ||
+		transport.IdleConnTimeout != defaultIdleConnTimeout {
+		t.Errorf("default idle pool is %d conns, %d per host, %v timeout; want %d, %d, %v",
+			transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout,
+			defaultMaxIdleConns, defaultMaxIdleConnsPerHost, defaultIdleConnTimeout)
+	}
+
+	transport = clientTransport(t, NewHTTPClient(ClientOptions{
+		MaxIdleConns:        7,
+		MaxIdleConnsPerHost: 3,
+		IdleConnTimeout:     42 * time.Second,
+	}))
+	if transport.MaxIdleConns != 7 || transport.MaxIdleConnsPerHost != 3 || transport.IdleConnTimeout != 42*time.Second {
+		t.Errorf("configured idle pool is %d conns, %d per host, %v timeout; want 7, 3, 42s",
+			transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+	if http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost == 3 {
+		t.Error("NewHTTPClient modified http.DefaultTransport")
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	const delay = 2 * time.Second
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	opts := WorkerOptions{
+		ValidateTimeout: time.Minute,
+		Client:          NewHTTPClient(ClientOptions{ResponseHeaderTimeout: 50 * time.Millisecond}),
+		Logger:          discardLogger(),
+	}
+	start := time.Now()
+	result := processJob(context.Background(), 1, ImageMeta{ID: "1", DownloadURL: srv.URL}, opts)
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("job waited %v for the delayed headers", elapsed)
+	}
+	if result.Error == nil || !strings.Contains(result.Error.Error(), "timeout awaiting response headers") {
+		t.Errorf("error %v, want the response header timeout", result.Error)
+	}
+	if !isRetryable(result.Error) {
+		t.Errorf("header timeout %v is not retryable", result.Error)
+	}
+}
+
+func TestDefaultClientLeavesTimeoutsToContexts(t *testing.T) {
+	srv := newSlowBodyServer(t, 300*time.Millisecond)
+	for _, tt := range []struct {
+		timeout time.Duration
+		ok      bool
+	}{
+		{100 * time.Millisecond, false},
+		{5 * time.Second, true},
+	} {
+		result := processJob(context.Background(), 1, ImageMeta{ID: "1", DownloadURL: srv.URL}, WorkerOptions{
+			DownloadTimeout: tt.timeout,
+			Download:        true,
+			SkipValidate:    true,
+			Sink:            discardSink{},
+			Client:          NewHTTPClient(ClientOptions{}),
+			Logger:          discardLogger(),
+		})
+		if ok := result.Error == nil; ok != tt.ok {
+			t.Errorf("download timeout %s: error %v, want success %t", tt.timeout, result.Error, tt.ok)
+		}
+		if !tt.ok && !errors.Is(result.Error, context.DeadlineExceeded) {
+			t.Errorf("download timeout %s: error %v, want the download timeout to end it", tt.timeout, result.Error)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is the source of time for retry spacing, job timeouts and stall
+// detection. Tests and embedders can substitute a fake to drive them
+// deterministically without sleeping.
+type Clock interface {
+	Now() time.Time
+	// After returns a channel that receives the time once d has elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// withClockTimeout is context.WithTimeout with the timeout measured by clock,
+// or real time when nil. With any clock but the real one, the returned
+// context reports context.DeadlineExceeded as its cause rather than its Err,
+// and has no Deadline.
+func withClockTimeout(ctx context.Context, clock Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := clock.(realClock); ok || clock == nil {
+		return context.WithTimeout(ctx, d)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	expired := clock.After(d)
+	go func() {
+		select {
+		case <-expired:
+			cancel(context.DeadlineExceeded)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() { cancel(nil) }
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// CollisionMode selects what happens when two images in a run resolve to
+// the same file name.
+type CollisionMode int
+
+const (
+	// CollisionOverwrite lets the later image replace the earlier one.
+	CollisionOverwrite CollisionMode = iota
+	// CollisionError fails the later image with ErrNameCollision.
+	CollisionError
+	// CollisionRename saves the later image as <name>-1<ext>, <name>-2<ext>
+	// and so on, whichever is free first.
+	CollisionRename
+)
+
+// collisionModes maps each -on-collision value to its mode.
+var collisionModes = map[string]CollisionMode{
+	"overwrite": CollisionOverwrite,
+	"error":     CollisionError,
+	"rename":    CollisionRename,
+}
+
+// parseCollisionMode returns the mode named name.
+func parseCollisionMode(name string) (CollisionMode, error) {
+	mode, ok := collisionModes[name]
+	if !ok {
+		names := make([]string, 0, len(collisionModes))
+		for n := range collisionModes {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		return 0, fmt.Errorf("unknown collision mode %q, want one of %s", name, strings.Join(names, ", "))
+	}
+	return mode, nil
+}
+
+// ErrNameCollision reports that an image's file name is already used by
+// another image of the run.
+var ErrNameCollision = errors.New("file name collision")
+
+// NameClaims tracks which image each file name of a run belongs to and
+// resolves collisions according to Mode. An image keeps the name it first
+// claimed, so every lookup for it agrees. It is safe for concurrent use. A
+// nil NameClaims lets images overwrite each other.
+//
+// Names are handed out in the order images claim them, so with
+// CollisionRename which image gets the suffix can change between runs.
+type NameClaims struct {
+	Mode CollisionMode
+
+	mu     sync.Mutex
+	owners map[string]string // File name to image ID
+	names  map[string]string // Image ID to file name
+}
+
+// NewNameClaims returns an empty NameClaims for mode, or nil when mode is
+// CollisionOverwrite and there is nothing to track.
+func NewNameClaims(mode CollisionMode) *NameClaims {
+	if mode == CollisionOverwrite {
+		return nil
+	}
+	return &NameClaims{
+		Mode:   mode,
+		owners: make(map[string]string),
+		names:  make(map[string]string),
+	}
+}
+
+// Claim returns the file name image id is stored under, given that it would
+// naturally be name.
+func (c *NameClaims) Claim(id, name string) (string, error) {
+	if c == nil {
+		return name, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if claimed, ok := c.names[id]; ok {
+		return claimed, nil
+	}
+	if owner, taken := c.owners[name]; taken && c.Mode == CollisionError {
+		return "", fmt.Errorf("%w: image %s would be saved as %s, which image %s already uses", ErrNameCollision, id, name, owner)
+	} else if taken {
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for i := 1; ; i++ {
+			candidate := fmt.Sprintf("%s-%d%s", base, i, ext)
+			if _, taken := c.owners[candidate]; !taken {
+				name = candidate
+				break
+			}
+		}
+	}
+	c.owners[name] = id
+	c.names[id] = name
+	return name, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNameClaims(t *testing.T) {
+	if NewNameClaims(CollisionOverwrite) != nil {
+		t.Error("overwrite claims are not nil")
+	}
+	var none *NameClaims
+	if name, err := none.Claim("1", "a.jpg"); name != "a.jpg" || err != nil {
+		t.Errorf("nil claims: Claim() = %q, %v", name, err)
+	}
+
+	claims := NewNameClaims(CollisionRename)
+	for _, tt := range []struct{ id, name, want string }{
+		{"1", "a.jpg", "a.jpg"},
+		{"2", "a-1.jpg", "a-1.jpg"}, // Naturally takes the first suffix
+		{"3", "a.jpg", "a-2.jpg"},
+		{"4", "a.jpg", "a-3.jpg"},
+		{"3", "a.jpg", "a-2.jpg"}, // An image keeps its name
+		{"5", "noext", "noext"},
+		{"6", "noext", "noext-1"},
+	} {
+		if got, err := claims.Claim(tt.id, tt.name); got != tt.want || err != nil {
+			t.Errorf("rename: Claim(%s, %s) = %q, %v, want %q", tt.id, tt.name, got, err, tt.want)
+		}
+	}
+
+	claims = NewNameClaims(CollisionError)
+	if _, err := claims.Claim("1", "a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := claims.Claim("1", "a.jpg"); name != "a.jpg" || err != nil {
+		t.Errorf("error: image claiming its own name again got %q, %v", name, err)
+	}
+	if _, err := claims.Claim("2", "a.jpg"); !errors.Is(err, ErrNameCollision) {
+		t.Errorf("error: second claim = %v, want ErrNameCollision", err)
+	}
+}
+
+func TestCollisionModes(t *testing.T) {
+	srv := newFakeImageServer(t, 0)
+	jobs := fakeJobs(srv, 3)
+	for i := range jobs {
+		jobs[i].Author = "same"
+	}
+	name, err := parseNameTemplate("{{.Author}}.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		mode      string
+		wantFiles []string
+		wantFails int
+	}{
+		{"overwrite", []string{"same.jpg"}, 0},
+		{"error", []string{"same.jpg"}, 2},
+		{"rename", []string{"same-1.jpg", "same-2.jpg", "same.jpg"}, 0},
+	} {
+		mode, err := parseCollisionMode(tt.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		results, _ := Run(Config{
+			WorkerOptions: WorkerOptions{
+				ValidateTimeout: time.Minute,
+				DownloadTimeout: time.Minute,
+				Download:        true,
+				OutputDir:       dir,
+				NameTemplate:    name,
+				OnCollision:     mode,
+				Client:          srv.Client(),
+				Logger:          discardLogger(),
+			},
+			Workers: 1,
+			Source:  jobs,
+		})
+
+		var fails int
+		for _, r := range results {
+			if r.Error != nil {
+				fails++
+				if !errors.Is(r.Error, ErrNameCollision) {
+					t.Errorf("%s: image %s: %v, want ErrNameCollision", tt.mode, r.ID, r.Error)
+				}
+			}
+		}
+		if fails != tt.wantFails {
+			t.Errorf("%s: %d images failed, want %d", tt.mode, fails, tt.wantFails)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		for _, e := range entries {
+			files = append(files, e.Name())
+		}
+		if !slices.Equal(files, tt.wantFiles) {
+			t.Errorf("%s: saved %v, want %v", tt.mode, files, tt.wantFiles)
+		}
+	}
+
+	if _, err := parseCollisionMode("merge"); err == nil {
+		t.Error("unknown collision mode accepted")
+	}
+}
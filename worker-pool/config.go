@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Defaults used by DefaultConfig, and therefore by the command-line flags.
+const (
+	defaultLimit           = 10
+	defaultRetries         = 3
+	defaultValidateTimeout = 4 * time.Second
+	defaultDownloadTimeout = 30 * time.Second
+	defaultShutdownGrace   = 10 * time.Second
+	defaultPageConcurrency = 4
+	defaultOutputDir       = "images"
+)
+
+// DefaultConfig returns the configuration the command line runs with when no
+// flags are given: validating defaultLimit images from the Picsum API with
+// NumCPU*2 workers. Library users can start from it and override what they
+// need; the zero Config is not valid, as its timeouts expire immediately.
+func DefaultConfig() Config {
+	return Config{
+		WorkerOptions: WorkerOptions{
+			ValidateTimeout: defaultValidateTimeout,
+			DownloadTimeout: defaultDownloadTimeout,
+			OutputDir:       defaultOutputDir,
+			MaxBytes:        defaultMaxBytes,
+			Retries:         defaultRetries,
+			RetryBaseDelay:  baseRetryDelay,
+			RetryMaxDelay:   maxRetryDelay,
+			ShutdownGrace:   defaultShutdownGrace,
+		},
+		Workers:         resolveWorkers(0),
+		Limit:           defaultLimit,
+		PageConcurrency: defaultPageConcurrency,
+	}
+}
+
+// Validate reports every setting of c that is out of range or contradicts
+// another, joined into one error. RunContext does not call it, so callers
+// that rely on the documented fallbacks for unset fields, such as the
+// worker count, can still pass a partial Config.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Workers > 0, "workers must be positive, got %d", c.Workers)
+	check(c.ValidateTimeout > 0, "validate timeout must be positive, got %s", c.ValidateTimeout)
+	check(c.DownloadTimeout > 0, "download timeout must be positive, got %s", c.DownloadTimeout)
+	check(c.Retries >= 0, "retries must not be negative, got %d", c.Retries)
+	check(c.ShutdownGrace >= 0, "shutdown grace must not be negative, got %s", c.ShutdownGrace)
+	if c.SizedTimeout != nil {
+		check(c.SizedTimeout.Throughput > 0, "assumed throughput must be positive, got %g", c.SizedTimeout.Throughput)
+		check(c.SizedTimeout.Max <= 0 || c.SizedTimeout.Max >= c.SizedTimeout.Min,
+			"maximum download timeout must not be below the minimum, got %s < %s", c.SizedTimeout.Max, c.SizedTimeout.Min)
+	}
+	check(c.Stagger >= 0, "stagger must not be negative, got %s", c.Stagger)
+	check(c.RunTimeout >= 0, "run timeout must not be negative, got %s", c.RunTimeout)
+	check(c.MinWidth >= 0 && c.MinHeight >= 0, "minimum dimensions must not be negative, got %dx%d", c.MinWidth, c.MinHeight)
+	check(c.MaxFailures >= 0, "max failures must not be negative, got %d", c.MaxFailures)
+	check(c.StopAfter >= 0, "stop after must not be negative, got %d", c.StopAfter)
+	if c.Source == nil {
+		// Limit only matters when listing from the Picsum API.
+		if err := validateLimit(c.Limit); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := validateBlur(c.Blur); err != nil {
+		errs = append(errs, err)
+	}
+
+	check(!c.Shuffle || c.Order == nil, "shuffle and order are mutually exclusive")
+	if c.Autoscale != nil {
+		check(!c.Sharded, "autoscaling and sharding are mutually exclusive")
+		check(c.Autoscale.MinWorkers <= c.Workers, "minimum workers must not exceed workers, got %d > %d", c.Autoscale.MinWorkers, c.Workers)
+	}
+	check(c.Download || !c.SkipValidate, "skipping validation requires download")
+	check(c.Download || !c.VerifyDimensions, "verifying dimensions requires download")
+	check(c.Download || !c.EXIF, "EXIF extraction requires download")
+	check(c.Download || c.SizedTimeout == nil, "size-derived download timeouts require download")
+	if c.Convert != "" {
+		check(c.Download, "conversion requires download")
+		if _, err := parseConvertFormat(c.Convert); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	check(!c.VerifyFiles || !c.Download && !c.DryRun, "verifying stored files cannot be combined with download or dry run")
+	if _, archived := c.Sink.(*ArchiveSink); archived {
+		// A resumed run would skip the images an earlier archive holds.
+		check(c.Checkpoint == nil, "checkpoint cannot be combined with an archive sink")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
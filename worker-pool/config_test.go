@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("DefaultConfig().Validate() = %v", err)
+	}
+}
+
+func TestValidateRejectsEachInvalidField(t *testing.T) {
+	for _, tt := range []struct {
+		want   string
+		modify func(*Config)
+	}{
+		{"workers must be positive", func(c *Config) { c.Workers = 0 }},
+		{"validate timeout must be positive", func(c *Config) { c.ValidateTimeout = 0 }},
+		{"download timeout must be positive", func(c *Config) { c.DownloadTimeout = -time.Second }},
+		{"retries must not be negative", func(c *Config) { c.Retries = -1 }},
+		{"shutdown grace must not be negative", func(c *Config) { c.ShutdownGrace = -time.Second }},
+		{"assumed throughput must be positive", func(c *Config) {
+			c.Download = true
+			c.SizedTimeout = &SizedTimeout{}
+		}},
+		{"maximum download timeout must not be below the minimum", func(c *Config) {
+			c.Download = true
+			c.SizedTimeout = &SizedTimeout{Throughput: 1, Min: time.Minute, Max: time.Second}
+		}},
+		{"stagger must not be negative", func(c *Config) { c.Stagger = -time.Second }},
+		{"run timeout must not be negative", func(c *Config) { c.RunTimeout = -time.Second }},
+		{"minimum dimensions must not be negative", func(c *Config) { c.MinHeight = -1 }},
+		{"max failures must not be negative", func(c *Config) { c.MaxFailures = -1 }},
+		{"stop after must not be negative", func(c *Config) { c.StopAfter = -1 }},
+		{"limit must be between 1", func(c *Config) { c.Limit = 0 }},
+		{"limit must be between 1", func(c *Config) { c.Limit = maxLimit + 1 }},
+		{"blur must be between 1", func(c *Config) { c.Blur = maxBlur + 1 }},
+		{"shuffle and order are mutually exclusive", func(c *Config) {
+			c.Shuffle = true
+			c.Order = imageOrders["id"]
+		}},
+		{"autoscaling and sharding are mutually exclusive", func(c *Config) {
+			c.Autoscale = &AutoscaleOptions{MinWorkers: 1}
+			c.Sharded = true
+		}},
+		{"minimum workers must not exceed workers", func(c *Config) {
+			c.Autoscale = &AutoscaleOptions{MinWorkers: c.Workers + 1}
+		}},
+		{"skipping validation requires download", func(c *Config) { c.SkipValidate = true }},
+		{"verifying dimensions requires download", func(c *Config) { c.VerifyDimensions = true }},
+		{"EXIF extraction requires download", func(c *Config) { c.EXIF = true }},
+		{"size-derived download timeouts require download", func(c *Config) {
+			c.SizedTimeout = &SizedTimeout{Throughput: 1}
+		}},
+		{"conversion requires download", func(c *Config) { c.Convert = "png" }},
+		{"verifying stored files cannot be combined", func(c *Config) {
+			c.VerifyFiles = true
+			c.DryRun = true
+		}},
+	} {
+		cfg := DefaultConfig()
+		tt.modify(&cfg)
+		err := cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Validate() = %v, want %q", err, tt.want)
+			continue
+		}
+		if n := strings.Count(err.Error(), "\n") + 1; n != 1 {
+			t.Errorf("Validate() reported %d problems for one invalid field: %v", n, err)
+		}
+	}
+}
+
+func TestValidateJoinsEveryProblem(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Workers = 0
+	cfg.Retries = -1
+	cfg.Blur = -1
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	for _, want := range []string{"workers", "retries", "blur"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, want it to report %s", err, want)
+		}
+	}
+
+	// The limit only applies to the Picsum listing.
+	cfg = DefaultConfig()
+	cfg.Limit = 0
+	cfg.Source = SliceSource{}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("limit checked for a custom source: %v", err)
+	}
+}
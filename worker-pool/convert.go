@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// imageFormat is an image format downloads can be converted to.
+type imageFormat struct {
+	mime   string
+	ext    string
+	encode func(w io.Writer, img image.Image) error
+}
+
+// convertFormats maps each -convert value to its format. WebP is written
+// lossless, so converting never loses more detail than the JPEG already did.
+var convertFormats = map[string]imageFormat{
+	"png":  {mime: "image/png", ext: ".png", encode: png.Encode},
+	"webp": {mime: "image/webp", ext: ".webp", encode: encodeWebP},
+}
+
+// encodeWebP encodes img as a lossless WebP.
+func encodeWebP(w io.Writer, img image.Image) error {
+	return nativewebp.Encode(w, img, nil)
+}
+
+// parseConvertFormat returns the format named name.
+func parseConvertFormat(name string) (imageFormat, error) {
+	format, ok := convertFormats[name]
+	if !ok {
+		names := make([]string, 0, len(convertFormats))
+		for n := range convertFormats {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		return imageFormat{}, fmt.Errorf("unsupported conversion format %q, want one of %s", name, strings.Join(names, ", "))
+	}
+	return format, nil
+}
+
+// convertResult re-encodes the file stored for r in the format named by
+// opts.Convert, replacing it with one whose extension matches, and updates
+// the Path, FileBytes, SHA256 and ImageType of r. Images without a stored
+// file or already in the format are left untouched. An image that cannot be
+// decoded or converted keeps its original file, with a warning logged; the
+// result still succeeds, as the download did.
+//
+// As the original file is removed, a later run without the same conversion
+// does not find the image stored and downloads it again.
+func convertResult(r *Result, opts WorkerOptions) {
+	format, err := parseConvertFormat(opts.Convert)
+	if err == nil && (r.Path == "" || r.ImageType == format.mime) {
+		return
+	}
+	if err == nil {
+		err = convertFile(r, format, opts.Fsync)
+	}
+	if err != nil {
+		opts.Logger.Warn("Image conversion failed, keeping the original file",
+			"image_id", r.ID,
+			"path", r.Path,
+			"error", err,
+		)
+	}
+}
+
+// convertFile converts the file of r to format and points r at the new file.
+// r is only modified once the new file is in place.
+func convertFile(r *Result, format imageFormat, sync bool) error {
+	file, err := os.Open(r.Path)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(bufio.NewReader(file))
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	// Decoding needs the whole image in memory, but the encoded output is
+	// streamed to disk rather than held as well.
+	pr, pw := io.Pipe()
+	go func() {
+		if err := format.encode(pw, img); err != nil {
+			pw.CloseWithError(fmt.Errorf("failed to encode image as %s: %w", format.mime, err))
+			return
+		}
+		pw.Close()
+	}()
+	hash := sha256.New()
+	encoded := &downloadReader{r: io.TeeReader(pr, hash), limit: -1, expected: -1}
+	path := strings.TrimSuffix(r.Path, filepath.Ext(r.Path)) + format.ext
+	err = saveFile(path, encoded, 0, false, sync)
+	pr.Close() // Unblocks the encoder if saving failed part way.
+	if err != nil {
+		return err
+	}
+	if path != r.Path {
+		if err := os.Remove(r.Path); err != nil {
+			return fmt.Errorf("converted to %s but failed to remove the original: %w", path, err)
+		}
+	}
+
+	r.Path = path
+	r.FileBytes = encoded.n
+	r.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	r.ImageType = format.mime
+	return nil
+}
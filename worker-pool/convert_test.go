@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// jpegFixture encodes a small gradient of width by height as a JPEG.
+func jpegFixture(tb testing.TB, width, height int) []byte {
+	tb.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := range width {
+		for y := range height {
+			img.Set(x, y, color.RGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestConvertResultJPEG(t *testing.T) {
+	tests := []struct {
+		format, ext, mime string
+		decode            func(io.Reader) (image.Image, error)
+	}{
+		{"png", ".png", "image/png", png.Decode},
+		{"webp", ".webp", "image/webp", nativewebp.Decode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			dir := t.TempDir()
+			original := filepath.Join(dir, "1.jpg")
+			if err := os.WriteFile(original, jpegFixture(t, 40, 30), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			r := Result{ID: "1", Path: original, ImageType: "image/jpeg"}
+			convertResult(&r, WorkerOptions{Convert: tt.format, Logger: discardLogger()})
+
+			if want := filepath.Join(dir, "1"+tt.ext); r.Path != want {
+				t.Fatalf("Path = %q, want %q", r.Path, want)
+			}
+			if r.ImageType != tt.mime {
+				t.Errorf("ImageType = %q, want %s", r.ImageType, tt.mime)
+			}
+			if _, err := os.Stat(original); !os.IsNotExist(err) {
+				t.Errorf("original file still exists: %v", err)
+			}
+			data, err := os.ReadFile(r.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := http.DetectContentType(data); got != tt.mime {
+				t.Errorf("converted file detected as %q, want %s", got, tt.mime)
+			}
+			img, err := tt.decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("converted file is not a valid %s: %v", tt.format, err)
+			}
+			if got := img.Bounds().Size(); got != image.Pt(40, 30) {
+				t.Errorf("converted image is %v, want 40x30", got)
+			}
+			if r.FileBytes != int64(len(data)) {
+				t.Errorf("FileBytes = %d, want %d", r.FileBytes, len(data))
+			}
+			if sum := sha256.Sum256(data); r.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("SHA256 = %s does not match the converted file", r.SHA256)
+			}
+		})
+	}
+}
+
+func TestConvertResultKeepsUndecodableFile(t *testing.T) {
+	original := filepath.Join(t.TempDir(), "1.jpg")
+	if err := os.WriteFile(original, []byte("not an image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := Result{ID: "1", Path: original, ImageType: "image/jpeg"}
+	convertResult(&r, WorkerOptions{Convert: "png", Logger: discardLogger()})
+
+	if r.Path != original || r.ImageType != "image/jpeg" {
+		t.Errorf("result changed to %q (%s), want it untouched", r.Path, r.ImageType)
+	}
+	if _, err := os.Stat(original); err != nil {
+		t.Errorf("original file removed: %v", err)
+	}
+}
+
+func TestParseConvertFormat(t *testing.T) {
+	for _, name := range []string{"png", "webp"} {
+		if _, err := parseConvertFormat(name); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	for _, name := range []string{"gif", "jpeg", ""} {
+		if _, err := parseConvertFormat(name); err == nil {
+			t.Errorf("%q: want an error", name)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import "time"
+
+// estimatedBytesPerPixel is the rough size of a compressed photo per pixel,
+// used to estimate the byte size of an image from its dimensions. Picsum
+// serves JPEGs, which land between 0.1 and 0.5 bytes per pixel.
+const estimatedBytesPerPixel = 0.25
+
+// defaultMinSizedTimeout is the lower bound of a SizedTimeout unless
+// configured otherwise, leaving room for connection setup and retries on
+// even the smallest image.
+const defaultMinSizedTimeout = 2 * time.Second
+
+// SizedTimeout derives the download timeout of each image from its size
+// instead of using one timeout for all: the size estimated from Width and
+// Height, divided by Throughput, clamped to [Min, Max]. Like
+// WorkerOptions.DownloadTimeout, the result covers the download including
+// its retries.
+type SizedTimeout struct {
+	Throughput float64       // Assumed download speed in bytes per second
+	Min        time.Duration // Lower bound; defaultMinSizedTimeout when not positive
+	Max        time.Duration // Upper bound; unbounded when not positive
+}
+
+// timeout returns the download timeout for job, or fallback when job has no
+// dimensions to estimate its size from.
+func (s SizedTimeout) timeout(job ImageMeta, fallback time.Duration) time.Duration {
+	if job.Width <= 0 || job.Height <= 0 || s.Throughput <= 0 {
+		return fallback
+	}
+	estimate := float64(pixels(job)) * estimatedBytesPerPixel
+	timeout := max(time.Duration(estimate/s.Throughput*float64(time.Second)), positiveOr(s.Min, defaultMinSizedTimeout))
+	if s.Max > 0 {
+		timeout = min(timeout, s.Max)
+	}
+	return timeout
+}
+
+// downloadTimeout returns the timeout for downloading job: derived from its
+// size with SizedTimeout when set, DownloadTimeout otherwise.
+func (opts WorkerOptions) downloadTimeout(job ImageMeta) time.Duration {
+	if opts.SizedTimeout == nil {
+		return opts.DownloadTimeout
+	}
+	return opts.SizedTimeout.timeout(job, opts.DownloadTimeout)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSizedTimeoutGrowsWithSize(t *testing.T) {
+	// At 250kB/s, a 4000x4000 image estimated at 4MB takes 16s.
+	s := SizedTimeout{Throughput: 250_000, Max: time.Minute}
+	tests := []struct {
+		width, height int
+		want          time.Duration
+	}{
+		{0, 0, 10 * time.Second},       // No dimensions: the fallback
+		{100, 100, 2 * time.Second},    // Clamped to defaultMinSizedTimeout
+		{4000, 4000, 16 * time.Second}, // Estimated from the size
+		{6000, 5000, 30 * time.Second}, // Twice as many pixels, twice as long
+		{20000, 20000, time.Minute},    // Clamped to Max
+	}
+	var last time.Duration
+	for _, tt := range tests {
+		got := s.timeout(ImageMeta{Width: tt.width, Height: tt.height}, 10*time.Second)
+		if got != tt.want {
+			t.Errorf("timeout for %dx%d = %s, want %s", tt.width, tt.height, got, tt.want)
+		}
+		if tt.width == 0 {
+			continue
+		}
+		if got < last {
+			t.Errorf("timeout for %dx%d = %s, shorter than for a smaller image", tt.width, tt.height, got)
+		}
+		last = got
+	}
+}
+
+func TestDownloadTimeout(t *testing.T) {
+	big := ImageMeta{Width: 4000, Height: 4000}
+	opts := WorkerOptions{DownloadTimeout: 10 * time.Second}
+	if got := opts.downloadTimeout(big); got != 10*time.Second {
+		t.Errorf("without SizedTimeout, downloadTimeout = %s, want DownloadTimeout", got)
+	}
+	opts.SizedTimeout = &SizedTimeout{Throughput: 250_000, Min: time.Second}
+	if got := opts.downloadTimeout(big); got != 16*time.Second {
+		t.Errorf("with SizedTimeout, downloadTimeout = %s, want 16s", got)
+	}
+	if got := opts.downloadTimeout(ImageMeta{Width: 10, Height: 10}); got != time.Second {
+		t.Errorf("with SizedTimeout, downloadTimeout of a tiny image = %s, want Min", got)
+	}
+}
+
+func TestSizedTimeoutIsHonoured(t *testing.T) {
+	// The body takes longer than the static timeout but well within the
+	// sized one, which the default client must not cut short.
+	srv := newSlowBodyServer(t, 300*time.Millisecond)
+	opts := WorkerOptions{
+		DownloadTimeout: 100 * time.Millisecond,
+		SizedTimeout:    &SizedTimeout{Throughput: 1_000_000, Min: 5 * time.Second},
+		Download:        true,
+		SkipValidate:    true,
+		Sink:            discardSink{},
+		Client:          NewHTTPClient(ClientOptions{}),
+		Logger:          discardLogger(),
+	}
+	sized := processJob(context.Background(), 1, ImageMeta{ID: "1", Width: 4000, Height: 3000, DownloadURL: srv.URL}, opts)
+	if sized.Error != nil {
+		t.Errorf("download with a sized timeout of %s failed: %v", opts.downloadTimeout(ImageMeta{Width: 4000, Height: 3000}), sized.Error)
+	}
+	static := processJob(context.Background(), 1, ImageMeta{ID: "2", DownloadURL: srv.URL}, opts)
+	if !errors.Is(static.Error, context.DeadlineExceeded) {
+		t.Errorf("download without dimensions: error %v, want the static timeout to end it", static.Error)
+	}
+}
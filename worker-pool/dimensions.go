@@ -0,0 +1,43 @@
+package main
+
+import (
+	"image"
+	_ "image/gif" // Register decoders for image.DecodeConfig.
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+// configProbe decodes the header of an image written to it, in its own
+// goroutine, to learn the real dimensions while the image streams into a
+// Sink. It accepts and discards everything after the header, so it can sit
+// in an io.MultiWriter without holding up the copy.
+type configProbe struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	cfg  image.Config
+	err  error
+}
+
+func newConfigProbe() *configProbe {
+	pr, pw := io.Pipe()
+	p := &configProbe{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		p.cfg, _, p.err = image.DecodeConfig(pr)
+		io.Copy(io.Discard, pr)
+	}()
+	return p
+}
+
+func (p *configProbe) Write(b []byte) (int, error) {
+	return p.pw.Write(b)
+}
+
+// result ends the stream and returns the decoded header. It must be called
+// exactly once, also when the download fails, so the goroutine exits.
+func (p *configProbe) result() (image.Config, error) {
+	p.pw.Close()
+	<-p.done
+	return p.cfg, p.err
+}
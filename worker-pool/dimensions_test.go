@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestVerifyDimensions(t *testing.T) {
+	fixture := jpegFixture(t, 40, 30) // Real size 40x30
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(fixture)
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		name          string
+		width, height int
+		mismatch      bool
+	}{
+		{"matching metadata", 40, 30, false},
+		{"placeholder size", 800, 600, true},
+		{"swapped size", 30, 40, true},
+		{"unknown size", 0, 0, false},
+	} {
+		sink := NewMemorySink()
+		meta := ImageMeta{ID: "1", Width: tt.width, Height: tt.height, DownloadURL: srv.URL}
+		result := processJob(context.Background(), 1, meta, WorkerOptions{
+			DownloadTimeout:  time.Minute,
+			Download:         true,
+			SkipValidate:     true,
+			VerifyDimensions: true,
+			Sink:             sink,
+			Client:           srv.Client(),
+			Logger:           discardLogger(),
+		})
+		if result.Error != nil {
+			t.Fatalf("%s: %v", tt.name, result.Error)
+		}
+		if result.ActualWidth != 40 || result.ActualHeight != 30 {
+			t.Errorf("%s: decoded %dx%d, want 40x30", tt.name, result.ActualWidth, result.ActualHeight)
+		}
+		if result.DimensionMismatch != tt.mismatch {
+			t.Errorf("%s: DimensionMismatch = %t, want %t", tt.name, result.DimensionMismatch, tt.mismatch)
+		}
+		// Probing must not take anything from the stored image.
+		if data, _ := sink.Get("1"); !bytes.Equal(data, fixture) {
+			t.Errorf("%s: stored %d bytes, want the %d byte fixture", tt.name, len(data), len(fixture))
+		}
+	}
+}
+
+func TestConfigProbeUndecodable(t *testing.T) {
+	p := newConfigProbe()
+	p.Write([]byte("not an image"))
+	if _, err := p.result(); err == nil {
+		t.Error("probe decoded a header from garbage")
+	}
+
+	// A probe whose download failed before any data still returns.
+	p = newConfigProbe()
+	if _, err := p.result(); err == nil {
+		t.Error("probe of an empty stream reported no error")
+	}
+}
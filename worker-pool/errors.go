@@ -0,0 +1,39 @@
+package main
+
+import "fmt"
+
+// ValidationError reports that the validation request for an image failed.
+// Status is the HTTP status of the response, or 0 when none was received, in
+// which case Err describes what went wrong.
+type ValidationError struct {
+	ID     string
+	Status int
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("image %s returned status %d", e.ID, e.Status)
+	}
+	return fmt.Sprintf("image %s download check failed: %v", e.ID, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// DownloadError reports that downloading or storing an image failed. Status
+// is the HTTP status of the response, or 0 when none was received. Err is nil
+// only when the status itself was the failure.
+type DownloadError struct {
+	ID     string
+	Status int
+	Err    error
+}
+
+func (e *DownloadError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("image %s returned HTTP %d", e.ID, e.Status)
+	}
+	return fmt.Sprintf("image %s download failed: %v", e.ID, e.Err)
+}
+
+func (e *DownloadError) Unwrap() error { return e.Err }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestValidationErrorStatus(t *testing.T) {
+	srv := newStatusServer(t)
+
+	_, err := Run(validateConfig(srv, 1, SliceSource{{ID: "1", DownloadURL: srv.URL + "/missing"}}))
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		t.Fatalf("Run() = %v, want a *ValidationError", err)
+	}
+	if ve.ID != "1" || ve.Status != http.StatusNotFound {
+		t.Errorf("ValidationError for image %s with status %d, want image 1 with %d", ve.ID, ve.Status, http.StatusNotFound)
+	}
+	var de *DownloadError
+	if errors.As(err, &de) {
+		t.Errorf("validation failure is also a *DownloadError: %v", de)
+	}
+}
+
+func TestDownloadErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	}))
+	defer srv.Close()
+
+	_, err := Run(Config{
+		WorkerOptions: WorkerOptions{
+			DownloadTimeout: time.Minute,
+			Download:        true,
+			SkipValidate:    true,
+			Sink:            NewMemorySink(),
+			Client:          srv.Client(),
+			Logger:          discardLogger(),
+		},
+		Workers: 1,
+		Source:  SliceSource{{ID: "2", DownloadURL: srv.URL}},
+	})
+	var de *DownloadError
+	if !errors.As(err, &de) {
+		t.Fatalf("Run() = %v, want a *DownloadError", err)
+	}
+	if de.ID != "2" || de.Status != http.StatusGone {
+		t.Errorf("DownloadError for image %s with status %d, want image 2 with %d", de.ID, de.Status, http.StatusGone)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EXIF holds the camera, timestamp and position recorded in a JPEG's EXIF
+// metadata. Fields the image does not record are left empty.
+type EXIF struct {
+	Make  string       `json:"make,omitempty"`  // Camera manufacturer
+	Model string       `json:"model,omitempty"` // Camera model
+	Time  time.Time    `json:"time,omitzero"`   // When the photo was taken, in the camera's local time
+	GPS   *GPSPosition `json:"gps,omitempty"`   // Where the photo was taken; nil when not recorded
+}
+
+// GPSPosition is a position in decimal degrees; south and west are negative.
+type GPSPosition struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// maxEXIFHead is how much of the start of a download is kept for EXIF
+// decoding. The EXIF segment is limited to 64 KiB and comes right after
+// the start of the image, possibly behind a short JFIF header.
+const maxEXIFHead = 128 << 10
+
+// headBuffer keeps the first max bytes written to it and discards the rest.
+// It never fails, so it can sit next to a hash in an io.MultiWriter.
+type headBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (h *headBuffer) Write(p []byte) (int, error) {
+	if room := h.max - h.buf.Len(); room > 0 {
+		h.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// EXIF tags decoded by decodeEXIF.
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagDateTime         = 0x0132
+	tagEXIFIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagGPSLatitudeRef   = 0x0001
+	tagGPSLatitude      = 0x0002
+	tagGPSLongitudeRef  = 0x0003
+	tagGPSLongitude     = 0x0004
+)
+
+// TIFF field types used by the decoded tags.
+const (
+	typeASCII    = 2
+	typeLong     = 4
+	typeRational = 5
+)
+
+var errBadEXIF = errors.New("malformed EXIF data")
+
+// decodeEXIF extracts EXIF metadata from the start of a JPEG file. It
+// returns nil and no error when the image carries no EXIF segment, and an
+// error when the segment is present but cannot be read.
+func decodeEXIF(head []byte) (*EXIF, error) {
+	tiff, err := findEXIFSegment(head)
+	if tiff == nil || err != nil {
+		return nil, err
+	}
+
+	t, err := newTIFFReader(tiff)
+	if err != nil {
+		return nil, err
+	}
+	ifd0, err := t.ifd(t.order.Uint32(tiff[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	exif := &EXIF{
+		Make:  t.ascii(ifd0[tagMake]),
+		Model: t.ascii(ifd0[tagModel]),
+	}
+
+	stamp := t.ascii(ifd0[tagDateTime])
+	if off, ok := t.long(ifd0[tagEXIFIFD]); ok {
+		sub, err := t.ifd(off)
+		if err != nil {
+			return nil, err
+		}
+		if s := t.ascii(sub[tagDateTimeOriginal]); s != "" {
+			stamp = s
+		}
+	}
+	if stamp != "" {
+		// A camera without a set clock records blanks or zeros, which
+		// simply means the time is unknown.
+		if ts, err := time.Parse("2006:01:02 15:04:05", stamp); err == nil {
+			exif.Time = ts
+		}
+	}
+
+	if off, ok := t.long(ifd0[tagGPSIFD]); ok {
+		gps, err := t.ifd(off)
+		if err != nil {
+			return nil, err
+		}
+		lat, latOK := t.degrees(gps[tagGPSLatitude])
+		lon, lonOK := t.degrees(gps[tagGPSLongitude])
+		if latOK && lonOK {
+			if t.ascii(gps[tagGPSLatitudeRef]) == "S" {
+				lat = -lat
+			}
+			if t.ascii(gps[tagGPSLongitudeRef]) == "W" {
+				lon = -lon
+			}
+			exif.GPS = &GPSPosition{Latitude: lat, Longitude: lon}
+		}
+	}
+	return exif, nil
+}
+
+// findEXIFSegment walks the JPEG markers in head and returns the TIFF data
+// of the APP1 EXIF segment, or nil if the image has none.
+func findEXIFSegment(head []byte) ([]byte, error) {
+	if len(head) < 2 || head[0] != 0xff || head[1] != 0xd8 {
+		return nil, nil
+	}
+	for i := 2; ; {
+		if i+4 > len(head) {
+			return nil, fmt.Errorf("%w: JPEG header ends early", errBadEXIF)
+		}
+		if head[i] != 0xff {
+			return nil, fmt.Errorf("%w: no JPEG marker at offset %d", errBadEXIF, i)
+		}
+		marker := head[i+1]
+		switch {
+		case marker == 0xff:
+			// Fill byte before a marker.
+			i++
+			continue
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7:
+			// Standalone markers carry no length.
+			i += 2
+			continue
+		case marker == 0xda || marker == 0xd9:
+			// EXIF must come before the image data.
+			return nil, nil
+		}
+
+		size := int(binary.BigEndian.Uint16(head[i+2:]))
+		if size < 2 {
+			return nil, fmt.Errorf("%w: invalid segment length %d", errBadEXIF, size)
+		}
+		end := i + 2 + size
+		payload := head[i+4 : min(end, len(head))]
+		if marker == 0xe1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			if end > len(head) {
+				return nil, fmt.Errorf("%w: EXIF segment is truncated", errBadEXIF)
+			}
+			return payload[6:], nil
+		}
+		i = end
+	}
+}
+
+// tiffReader decodes IFD entries from the TIFF structure of an EXIF
+// segment. Offsets inside it are relative to the start of data.
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// tiffEntry is a raw IFD entry; value holds the value itself when it fits
+// in four bytes and the offset of the value otherwise.
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func newTIFFReader(data []byte) (*tiffReader, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("%w: TIFF header ends early", errBadEXIF)
+	}
+	t := &tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("%w: unknown byte order %q", errBadEXIF, data[:2])
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return nil, fmt.Errorf("%w: not a TIFF header", errBadEXIF)
+	}
+	return t, nil
+}
+
+// ifd reads the directory at off, keyed by tag.
+func (t *tiffReader) ifd(off uint32) (map[uint16]tiffEntry, error) {
+	if uint64(off)+2 > uint64(len(t.data)) {
+		return nil, fmt.Errorf("%w: IFD offset %d out of range", errBadEXIF, off)
+	}
+	n := int(t.order.Uint16(t.data[off:]))
+	start := int(off) + 2
+	if start+n*12 > len(t.data) {
+		return nil, fmt.Errorf("%w: IFD at offset %d is truncated", errBadEXIF, off)
+	}
+	entries := make(map[uint16]tiffEntry, n)
+	for i := range n {
+		e := t.data[start+i*12:]
+		entries[t.order.Uint16(e)] = tiffEntry{
+			typ:   t.order.Uint16(e[2:]),
+			count: t.order.Uint32(e[4:]),
+			value: e[8:12],
+		}
+	}
+	return entries, nil
+}
+
+// bytesOf returns the n bytes of e's value, or nil if they lie outside the
+// segment.
+func (t *tiffReader) bytesOf(e tiffEntry, n uint64) []byte {
+	if n <= 4 {
+		return e.value[:n]
+	}
+	off := uint64(t.order.Uint32(e.value))
+	if off+n > uint64(len(t.data)) {
+		return nil
+	}
+	return t.data[off : off+n]
+}
+
+// ascii returns a string value without its NUL terminator and padding, or
+// "" if e is missing or not a string.
+func (t *tiffReader) ascii(e tiffEntry) string {
+	if e.typ != typeASCII {
+		return ""
+	}
+	b := t.bytesOf(e, uint64(e.count))
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// long returns a single LONG value, such as the offset of a sub-IFD.
+func (t *tiffReader) long(e tiffEntry) (uint32, bool) {
+	if e.typ != typeLong || e.count != 1 {
+		return 0, false
+	}
+	return t.order.Uint32(e.value), true
+}
+
+// degrees converts a GPS coordinate stored as degrees, minutes and seconds
+// rationals into decimal degrees.
+func (t *tiffReader) degrees(e tiffEntry) (float64, bool) {
+	if e.typ != typeRational || e.count != 3 {
+		return 0, false
+	}
+	b := t.bytesOf(e, 24)
+	if b == nil {
+		return 0, false
+	}
+	var dms [3]float64
+	for i := range dms {
+		num, den := t.order.Uint32(b[i*8:]), t.order.Uint32(b[i*8+4:])
+		if den == 0 {
+			return 0, false
+		}
+		dms[i] = float64(num) / float64(den)
+	}
+	return dms[0] + dms[1]/60 + dms[2]/3600, true
+}
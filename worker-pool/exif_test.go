@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// tiffOrder is the byte order of a TIFF structure built by a test.
+type tiffOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// tiffField is an IFD entry for buildTIFF. Values longer than four bytes
+// are stored after the IFD.
+type tiffField struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// asciiField returns an ASCII field holding s.
+func asciiField(tag uint16, s string) tiffField {
+	return tiffField{tag: tag, typ: typeASCII, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+// longField returns a single LONG field.
+func longField(order tiffOrder, tag uint16, v uint32) tiffField {
+	return tiffField{tag: tag, typ: typeLong, count: 1, value: order.AppendUint32(nil, v)}
+}
+
+// dmsField returns a GPS coordinate of three rationals, each given as a
+// numerator and a denominator.
+func dmsField(order tiffOrder, tag uint16, parts ...uint32) tiffField {
+	var b []byte
+	for _, p := range parts {
+		b = order.AppendUint32(b, p)
+	}
+	return tiffField{tag: tag, typ: typeRational, count: uint32(len(parts) / 2), value: b}
+}
+
+// ifdSize is the encoded size of an IFD with n entries, without its values.
+func ifdSize(n int) int { return 2 + 12*n + 4 }
+
+// appendIFD encodes fields as an IFD placed at off, with the values that
+// do not fit an entry right behind it.
+func appendIFD(b []byte, order tiffOrder, off int, fields []tiffField) []byte {
+	b = order.AppendUint16(b, uint16(len(fields)))
+	var extra []byte
+	next := off + ifdSize(len(fields))
+	for _, f := range fields {
+		b = order.AppendUint16(b, f.tag)
+		b = order.AppendUint16(b, f.typ)
+		b = order.AppendUint32(b, f.count)
+		if len(f.value) <= 4 {
+			b = append(b, f.value...)
+			b = append(b, make([]byte, 4-len(f.value))...)
+			continue
+		}
+		b = order.AppendUint32(b, uint32(next+len(extra)))
+		extra = append(extra, f.value...)
+	}
+	b = order.AppendUint32(b, 0) // No next IFD
+	return append(b, extra...)
+}
+
+// ifdLen is the encoded size of an IFD with its values.
+func ifdLen(fields []tiffField) int {
+	n := ifdSize(len(fields))
+	for _, f := range fields {
+		if len(f.value) > 4 {
+			n += len(f.value)
+		}
+	}
+	return n
+}
+
+// buildTIFF lays out IFD0 with pointers to an EXIF and a GPS sub-IFD.
+func buildTIFF(order tiffOrder, ifd0, exifIFD, gpsIFD []tiffField) []byte {
+	tiff := []byte("MM")
+	if order == binary.LittleEndian {
+		tiff = []byte("II")
+	}
+	tiff = order.AppendUint16(tiff, 42)
+	tiff = order.AppendUint32(tiff, 8)
+
+	// The two pointers added to IFD0 fit their entries, so the layout is
+	// known up front.
+	exifOff := 8 + ifdLen(ifd0) + 2*12
+	gpsOff := exifOff + ifdLen(exifIFD)
+	ifd0 = append(ifd0, longField(order, tagEXIFIFD, uint32(exifOff)), longField(order, tagGPSIFD, uint32(gpsOff)))
+
+	tiff = appendIFD(tiff, order, 8, ifd0)
+	tiff = appendIFD(tiff, order, exifOff, exifIFD)
+	return appendIFD(tiff, order, gpsOff, gpsIFD)
+}
+
+// withEXIF inserts a JFIF header and an APP1 segment holding tiff right
+// after the start of jpegData.
+func withEXIF(jpegData, tiff []byte) []byte {
+	out := []byte{0xff, 0xd8}
+	jfif := []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+	out = append(out, 0xff, 0xe0)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(jfif)+2))
+	out = append(out, jfif...)
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	out = append(out, 0xff, 0xe1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+	out = append(out, payload...)
+	return append(out, jpegData[2:]...)
+}
+
+// exifFixture is a JPEG recording a Canon EOS 5D photo taken in London.
+func exifFixture(tb testing.TB, order tiffOrder) []byte {
+	tif := buildTIFF(order,
+		[]tiffField{
+			asciiField(tagMake, "Canon"),
+			asciiField(tagModel, "EOS 5D"),
+			asciiField(tagDateTime, "2020:01:01 00:00:00"), // Edited; the original time wins
+		},
+		[]tiffField{asciiField(tagDateTimeOriginal, "2019:06:15 12:30:45")},
+		[]tiffField{
+			asciiField(tagGPSLatitudeRef, "N"),
+			dmsField(order, tagGPSLatitude, 51, 1, 30, 1, 0, 1),
+			asciiField(tagGPSLongitudeRef, "W"),
+			dmsField(order, tagGPSLongitude, 0, 1, 7, 1, 396, 10),
+		},
+	)
+	return withEXIF(jpegFixture(tb, 16, 16), tif)
+}
+
+func TestDecodeEXIF(t *testing.T) {
+	for _, order := range []tiffOrder{binary.BigEndian, binary.LittleEndian} {
+		exif, err := decodeEXIF(exifFixture(t, order))
+		if err != nil {
+			t.Fatalf("%v: %v", order, err)
+		}
+		if exif == nil {
+			t.Fatalf("%v: no EXIF found", order)
+		}
+		if exif.Make != "Canon" || exif.Model != "EOS 5D" {
+			t.Errorf("%v: camera %q %q, want Canon EOS 5D", order, exif.Make, exif.Model)
+		}
+		if want := time.Date(2019, 6, 15, 12, 30, 45, 0, time.UTC); !exif.Time.Equal(want) {
+			t.Errorf("%v: time %v, want %v", order, exif.Time, want)
+		}
+		if exif.GPS == nil {
+			t.Fatalf("%v: no GPS position", order)
+		}
+		if math.Abs(exif.GPS.Latitude-51.5) > 1e-9 || math.Abs(exif.GPS.Longitude+0.1276666) > 1e-6 {
+			t.Errorf("%v: position %+v, want 51.5, -0.1277", order, *exif.GPS)
+		}
+	}
+}
+
+func TestDecodeEXIFWithoutEXIF(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"plain JPEG": jpegFixture(t, 8, 8),
+		"not a JPEG": []byte("\x89PNG\r\n\x1a\n"),
+		"empty":      nil,
+	} {
+		if exif, err := decodeEXIF(data); exif != nil || err != nil {
+			t.Errorf("%s: decodeEXIF() = %+v, %v, want nothing", name, exif, err)
+		}
+	}
+}
+
+func TestDecodeEXIFMalformed(t *testing.T) {
+	order := binary.BigEndian
+	fixture := exifFixture(t, order)
+	tiffStart := bytes.Index(fixture, []byte("Exif\x00\x00")) + 6
+	tiff := fixture[tiffStart:]
+
+	badIFD := bytes.Clone(tiff[:8])
+	order.PutUint32(badIFD[4:], 1<<20)
+	truncatedIFD := bytes.Clone(tiff[:8])
+	truncatedIFD = order.AppendUint16(truncatedIFD, 50) // 50 entries, none present
+
+	for name, data := range map[string][]byte{
+		"short TIFF header":  withEXIF(jpegFixture(t, 8, 8), []byte("MM")),
+		"unknown byte order": withEXIF(jpegFixture(t, 8, 8), []byte("XX\x00\x2a\x00\x00\x00\x08")),
+		"not TIFF":           withEXIF(jpegFixture(t, 8, 8), []byte("MM\x00\x2b\x00\x00\x00\x08")),
+		"IFD out of range":   withEXIF(jpegFixture(t, 8, 8), badIFD),
+		"truncated IFD":      withEXIF(jpegFixture(t, 8, 8), truncatedIFD),
+		"truncated segment":  fixture[:tiffStart+20],
+		"ends in header":     fixture[:5],
+	} {
+		if _, err := decodeEXIF(data); !errors.Is(err, errBadEXIF) {
+			t.Errorf("%s: decodeEXIF() = %v, want errBadEXIF", name, err)
+		}
+	}
+}
+
+func TestDownloadExtractsEXIF(t *testing.T) {
+	fixture := exifFixture(t, binary.BigEndian)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(fixture)
+	}))
+	defer srv.Close()
+
+	for _, enabled := range []bool{false, true} {
+		result := processJob(context.Background(), 1, ImageMeta{ID: "1", DownloadURL: srv.URL}, WorkerOptions{
+			DownloadTimeout: time.Minute,
+			Download:        true,
+			SkipValidate:    true,
+			EXIF:            enabled,
+			Sink:            discardSink{},
+			Client:          srv.Client(),
+			Logger:          discardLogger(),
+		})
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		if got := result.EXIF != nil && result.EXIF.Model == "EOS 5D"; got != enabled {
+			t.Errorf("exif=%t: Result.EXIF = %+v", enabled, result.EXIF)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+)
+
+// imageFilter reports whether an image should be processed.
+type imageFilter func(ImageMeta) bool
+
+// keepImage reports whether img passes every filter.
+func keepImage(img ImageMeta, filters []imageFilter) bool {
+	for _, keep := range filters {
+		if !keep(img) {
+			return false
+		}
+	}
+	return true
+}
+
+// minSizeFilter keeps images that are at least minWidth wide and minHeight
+// tall. Skipped images are logged at debug level. It returns nil when neither
+// bound is set.
+func minSizeFilter(logger *slog.Logger, minWidth, minHeight int) imageFilter {
+	if minWidth <= 0 && minHeight <= 0 {
+		return nil
+	}
+	return func(img ImageMeta) bool {
+		if img.Width < minWidth || img.Height < minHeight {
+			logger.Debug("Skipping image below minimum dimensions",
+				"image_id", img.ID,
+				"width", img.Width,
+				"height", img.Height,
+			)
+			return false
+		}
+		return true
+	}
+}
+
+// dedupFilter keeps only the first image seen with each ID, logging every
+// duplicate it drops. The returned filter is not safe for concurrent use.
+func dedupFilter(logger *slog.Logger) imageFilter {
+	seen := make(map[string]struct{})
+	return func(img ImageMeta) bool {
+		if _, ok := seen[img.ID]; ok {
+			logger.Warn("Skipping duplicate image", "image_id", img.ID)
+			return false
+		}
+		seen[img.ID] = struct{}{}
+		return true
+	}
+}
+
+// authorFilter keeps images whose author matches pattern. Calling the
+// returned report func logs how many images matched and how many were
+// skipped so far. Both are nil when pattern is nil. The filter is not safe
+// for concurrent use.
+func authorFilter(logger *slog.Logger, pattern *regexp.Regexp) (keep imageFilter, report func()) {
+	if pattern == nil {
+		return nil, nil
+	}
+	var matched, skipped int
+	keep = func(img ImageMeta) bool {
+		if !pattern.MatchString(img.Author) {
+			skipped++
+			return false
+		}
+		matched++
+		return true
+	}
+	report = func() {
+		logger.Info("Author filter applied",
+			"pattern", pattern.String(),
+			"matched", matched,
+			"skipped", skipped,
+		)
+	}
+	return keep, report
+}
+
+// checkpointFilter skips images cp records as completed, logging each at
+// debug level. The returned report func logs how many were skipped. Both are
+// nil when cp is nil.
+func checkpointFilter(logger *slog.Logger, cp *Checkpoint) (keep imageFilter, report func()) {
+	if cp == nil {
+		return nil, nil
+	}
+	before := cp.Len()
+	var skipped int
+	keep = func(img ImageMeta) bool {
+		if cp.Done(img.ID) {
+			logger.Debug("Skipping image completed by an earlier run", "image_id", img.ID)
+			skipped++
+			return false
+		}
+		return true
+	}
+	report = func() {
+		logger.Info("Checkpoint applied", "skipped", skipped, "completed_before", before)
+	}
+	return keep, report
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// filterIDs returns the IDs of the images that pass keep.
+func filterIDs(images []ImageMeta, keep imageFilter) []string {
+	var ids []string
+	for _, img := range images {
+		if keep(img) {
+			ids = append(ids, img.ID)
+		}
+	}
+	return ids
+}
+
+func TestMinSizeFilter(t *testing.T) {
+	if minSizeFilter(discardLogger(), 0, 0) != nil {
+		t.Error("filter without bounds is not nil")
+	}
+	images := []ImageMeta{
+		{ID: "small", Width: 100, Height: 100},
+		{ID: "wide", Width: 2000, Height: 500},
+		{ID: "tall", Width: 500, Height: 2000},
+		{ID: "exact", Width: 1000, Height: 800},
+		{ID: "large", Width: 4000, Height: 3000},
+	}
+	for _, tt := range []struct {
+		minWidth, minHeight int
+		want                []string
+	}{
+		{1000, 800, []string{"exact", "large"}},
+		{1000, 0, []string{"wide", "exact", "large"}},
+		{0, 1000, []string{"tall", "large"}},
+	} {
+		got := filterIDs(images, minSizeFilter(discardLogger(), tt.minWidth, tt.minHeight))
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("minimum %dx%d kept %v, want %v", tt.minWidth, tt.minHeight, got, tt.want)
+		}
+	}
+}
+
+func TestDedupFilter(t *testing.T) {
+	images := []ImageMeta{{ID: "1"}, {ID: "2"}, {ID: "1"}, {ID: "3"}, {ID: "2"}, {ID: "1"}}
+	got := filterIDs(images, dedupFilter(discardLogger()))
+	if want := []string{"1", "2", "3"}; !slices.Equal(got, want) {
+		t.Errorf("dedupFilter kept %v, want %v", got, want)
+	}
+}
+
+func TestAuthorFilter(t *testing.T) {
+	if keep, report := authorFilter(discardLogger(), nil); keep != nil || report != nil {
+		t.Error("filter without a pattern is not nil")
+	}
+	images := []ImageMeta{
+		{ID: "1", Author: "Alejandro Escamilla"},
+		{ID: "2", Author: "Paul Jarvis"},
+		{ID: "3", Author: "alejandro"},
+		{ID: "4", Author: "Aleks Dorohovich"},
+		{ID: "5", Author: ""},
+	}
+	logger, logs := bufferLogger()
+	keep, report := authorFilter(logger, regexp.MustCompile(`^(?i)alejandro\b`))
+	got := filterIDs(images, keep)
+	if want := []string{"1", "3"}; !slices.Equal(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+
+	report()
+	if out := logs.String(); !strings.Contains(out, "matched=2") || !strings.Contains(out, "skipped=3") {
+		t.Errorf("report logged %q, want 2 matched and 3 skipped", out)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeJPEG is a minimal payload that passes image type detection.
+var fakeJPEG = append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, bytes.Repeat([]byte{0}, 16<<10)...)
+
+// newFakeImageServer starts a local server that answers every request with
+// fakeJPEG after waiting latency, to simulate a slow network.
+func newFakeImageServer(tb testing.TB, latency time.Duration) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(fakeJPEG)
+	}))
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+// newSlowBodyServer starts a local server that answers every request with
+// fakeJPEG, sending its headers and first bytes at once and the rest only
+// after delay, so that only reading the body is slow.
+func newSlowBodyServer(tb testing.TB, delay time.Duration) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Length", strconv.Itoa(len(fakeJPEG)))
+		w.Write(fakeJPEG[:1024])
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Write(fakeJPEG[1024:])
+	}))
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+// discardSink accepts downloads without storing them.
+type discardSink struct{}
+
+func (discardSink) Write(ctx context.Context, meta ImageMeta, r io.Reader) error {
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+// fakeJobs returns n images served by srv.
+func fakeJobs(srv *httptest.Server, n int) SliceSource {
+	jobs := make(SliceSource, n)
+	for i := range jobs {
+		id := strconv.Itoa(i)
+		jobs[i] = ImageMeta{ID: id, Width: 1, Height: 1, DownloadURL: srv.URL + "/" + id}
+	}
+	return jobs
+}
+
+// discardLogger drops everything, so per-job logs do not dominate a
+// measurement or clutter test output.
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// fakeClock is a Clock that only moves when Advance is called.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []clockWaiter
+}
+
+type clockWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, clockWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward by d, firing every After that is due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+// waitForWaiters blocks until n calls to After are pending, failing tb after
+// a few seconds.
+func (c *fakeClock) waitForWaiters(tb testing.TB, n int) {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		pending := len(c.waiters)
+		c.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("%d clock waiters pending, want %d", pending, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// checkGoroutines fails tb unless the number of goroutines drops back to at
+// most want within a few seconds, as exiting goroutines take a moment.
+func checkGoroutines(tb testing.TB, want int) {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := runtime.NumGoroutine()
+		if got <= want {
+			return
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("%d goroutines still running, want at most %d", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use, for capturing logs.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// bufferLogger returns a logger writing every level as text to the returned
+// buffer.
+func bufferLogger() (*slog.Logger, *syncBuffer) {
+	buf := &syncBuffer{}
+	return slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})), buf
+}
+
+// concurrencyTracker records the most callers inside a section at once.
+type concurrencyTracker struct {
+	current, peak atomic.Int64
+}
+
+// enter marks a caller entering the section and returns the func that
+// marks it leaving.
+func (c *concurrencyTracker) enter() (leave func()) {
+	n := c.current.Add(1)
+	for {
+		peak := c.peak.Load()
+		if n <= peak || c.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	return func() { c.current.Add(-1) }
+}
+
+// trackingSink is a discardSink that records how many writes overlap, each
+// taking at least delay.
+type trackingSink struct {
+	concurrencyTracker
+	delay time.Duration
+}
+
+func (s *trackingSink) Write(ctx context.Context, meta ImageMeta, r io.Reader) error {
+	defer s.enter()()
+	time.Sleep(s.delay)
+	return discardSink{}.Write(ctx, meta, r)
+}
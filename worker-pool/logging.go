@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// newLogger builds a logger writing to w at the given level
+// (debug, info, warn or error) in the given format (text or json).
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
+
+// sensitiveHeaderHints are substrings of header names whose values are
+// redacted when logged, as they usually carry credentials.
+var sensitiveHeaderHints = []string{"auth", "cookie", "token", "secret", "key", "password", "session"}
+
+// redacted replaces sensitive values in logs.
+const redacted = "REDACTED"
+
+// redactHeaders returns h as a log value with the values of credential
+// headers, such as Authorization or X-Api-Key, replaced by redacted.
+func redactHeaders(h http.Header) slog.Value {
+	names := slices.Sorted(maps.Keys(h))
+	attrs := make([]slog.Attr, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(h[name], ", ")
+		lower := strings.ToLower(name)
+		for _, hint := range sensitiveHeaderHints {
+			if strings.Contains(lower, hint) {
+				value = redacted
+				break
+			}
+		}
+		attrs = append(attrs, slog.String(name, value))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// LogValue implements slog.LogValuer, logging the options with header
+// values that carry credentials redacted.
+func (o ClientOptions) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Any("headers", redactHeaders(o.Headers)),
+		slog.Bool("insecure_skip_verify", o.InsecureSkipVerify),
+		slog.Int("max_redirects", positiveOr(o.MaxRedirects, defaultMaxRedirects)),
+		slog.Int("max_idle_conns", positiveOr(o.MaxIdleConns, defaultMaxIdleConns)),
+		slog.Int("max_idle_conns_per_host", positiveOr(o.MaxIdleConnsPerHost, defaultMaxIdleConnsPerHost)),
+		slog.Duration("idle_conn_timeout", positiveOr(o.IdleConnTimeout, defaultIdleConnTimeout)),
+		slog.Duration("dial_timeout", o.DialTimeout),
+		slog.Duration("tls_handshake_timeout", o.TLSHandshakeTimeout),
+		slog.Duration("response_header_timeout", o.ResponseHeaderTimeout),
+	)
+}
+
+// LogValue implements slog.LogValuer, logging the effective configuration
+// of the run so that its log documents how it was started. Defaults are
+// resolved where RunContext would resolve them, and limits that are off are
+// logged as 0.
+func (c Config) LogValue() slog.Value {
+	source := "picsum"
+	switch {
+	case c.Source != nil:
+		source = fmt.Sprintf("%T", c.Source)
+	case c.Lister != nil:
+		source = fmt.Sprintf("%T", c.Lister)
+	}
+	var author string
+	if c.Author != nil {
+		author = c.Author.String()
+	}
+	var rps, bandwidth float64
+	if c.Limiter != nil {
+		rps = float64(c.Limiter.Limit())
+	}
+	if c.Bandwidth != nil {
+		bandwidth = float64(c.Bandwidth.Limit())
+	}
+
+	attrs := []slog.Attr{
+		slog.Int("workers", resolveWorkers(c.Workers)),
+		slog.String("source", source),
+		slog.Int("limit", c.Limit),
+		slog.Bool("download", c.Download),
+		slog.Bool("dry_run", c.DryRun),
+		slog.Bool("verify_files", c.VerifyFiles),
+		slog.String("output_dir", c.OutputDir),
+		slog.Duration("validate_timeout", c.ValidateTimeout),
+		slog.Duration("download_timeout", c.DownloadTimeout),
+		slog.Bool("sized_timeout", c.SizedTimeout != nil),
+		slog.String("convert", c.Convert),
+		slog.Duration("run_timeout", c.RunTimeout),
+		slog.Duration("shutdown_grace", c.ShutdownGrace),
+		slog.Duration("stagger", c.Stagger),
+		slog.Int("retries", c.Retries),
+		slog.Duration("retry_base_delay", positiveOr(c.RetryBaseDelay, baseRetryDelay)),
+		slog.Duration("retry_max_delay", positiveOr(c.RetryMaxDelay, maxRetryDelay)),
+		slog.Float64("rps", rps),
+		slog.Float64("bandwidth", bandwidth),
+		slog.Int("max_downloads", cap(c.DownloadSlots)),
+		slog.Int("max_inflight", cap(c.InflightSlots)),
+		slog.Int64("max_bytes", c.MaxBytes),
+		slog.Bool("fail_fast", c.FailFast),
+		slog.Int("max_failures", c.MaxFailures),
+		slog.Int("stop_after", c.StopAfter),
+		slog.Bool("sharded", c.Sharded),
+		slog.Bool("autoscale", c.Autoscale != nil),
+		slog.Bool("warmup", c.Warmup),
+		slog.Int("checkpointed", c.Checkpoint.Len()),
+		slog.Bool("ordered", c.Order != nil),
+		slog.Bool("shuffle", c.Shuffle),
+		slog.Int("min_width", c.MinWidth),
+		slog.Int("min_height", c.MinHeight),
+		slog.String("author", author),
+		slog.Bool("grayscale", c.Grayscale),
+		slog.Int("blur", c.Blur),
+	}
+	if c.Client == nil {
+		attrs = append(attrs, slog.Any("client", c.ClientOptions))
+	}
+	return slog.GroupValue(attrs...)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "warn", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("debug line")
+	logger.Info("info line")
+	logger.Warn("warn line")
+	logger.Error("error line")
+
+	out := buf.String()
+	for _, line := range []string{"debug line", "info line"} {
+		if strings.Contains(out, line) {
+			t.Errorf("output has %q below the warn level:\n%s", line, out)
+		}
+	}
+	for _, line := range []string{"warn line", "error line"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("output lacks %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestNewLoggerInvalid(t *testing.T) {
+	if _, err := newLogger(&bytes.Buffer{}, "loud", "text"); err == nil {
+		t.Error("invalid level accepted")
+	}
+	if _, err := newLogger(&bytes.Buffer{}, "info", "xml"); err == nil {
+		t.Error("invalid format accepted")
+	}
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "INFO", "JSON")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hello")
+	if !strings.HasPrefix(buf.String(), "{") {
+		t.Errorf("json format wrote %q", buf.String())
+	}
+}
+
+func TestInjectedLogger(t *testing.T) {
+	srv := newStatusServer(t)
+	logger, buf := bufferLogger()
+	cfg := validateConfig(srv, 1, SliceSource{{ID: "42", DownloadURL: srv.URL + "/missing"}})
+	cfg.Logger = logger
+	Run(cfg)
+
+	out := buf.String()
+	for _, want := range []string{"Starting image downloader", "Validation failed", "image_id=42", "Image processing failed"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("injected logger lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestQuietLoggerSuppressesPerImageLines(t *testing.T) {
+	srv := newStatusServer(t)
+	jobs := SliceSource{
+		{ID: "1", DownloadURL: srv.URL + "/ok"},
+		{ID: "2", DownloadURL: srv.URL + "/missing"},
+	}
+
+	for _, quiet := range []bool{false, true} {
+		var buf syncBuffer
+		logger, err := newLogger(&buf, "debug", "text")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := validateConfig(srv, 2, jobs)
+		cfg.Logger = quietLogger(logger, &buf, quiet, "text")
+		cfg.ProgressInterval = time.Millisecond
+		if _, err := Run(cfg); !errors.Is(err, ErrImageFailed) {
+			t.Fatalf("quiet=%t: Run() = %v, want image 2 to fail", quiet, err)
+		}
+
+		perImage := strings.Count(buf.String(), "image_id=")
+		switch {
+		case quiet && perImage != 0:
+			t.Errorf("quiet run logged %d per-image lines:\n%s", perImage, buf.String())
+		case !quiet && perImage == 0:
+			t.Error("normal run logged no per-image lines")
+		}
+	}
+}
+
+func TestConfigLogRecord(t *testing.T) {
+	srv := newStatusServer(t)
+	var buf syncBuffer
+	cfg := DefaultConfig()
+	cfg.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	cfg.Workers = 3
+	cfg.Limit = 7
+	cfg.OutputDir = "out"
+	cfg.ValidateTimeout = 3 * time.Second
+	cfg.Source = SliceSource{{ID: "1", DownloadURL: srv.URL + "/ok"}}
+	cfg.ClientOptions.Headers = http.Header{
+		"Authorization": {"Bearer s3cret"},
+		"X-Api-Key":     {"k3y"},
+		"X-Mirror":      {"eu"},
+	}
+	if _, err := Run(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var record struct {
+		Msg    string `json:"msg"`
+		Config struct {
+			Workers         int    `json:"workers"`
+			Limit           int    `json:"limit"`
+			Download        *bool  `json:"download"`
+			OutputDir       string `json:"output_dir"`
+			ValidateTimeout int64  `json:"validate_timeout"`
+			DownloadTimeout int64  `json:"download_timeout"`
+			Client          struct {
+				Headers map[string]string `json:"headers"`
+			} `json:"client"`
+		} `json:"config"`
+	}
+	line, _, _ := strings.Cut(buf.String(), "\n")
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		t.Fatalf("first log line %q: %v", line, err)
+	}
+	c := record.Config
+	if record.Msg != "Starting image downloader" || c.Workers != 3 || c.Limit != 7 || c.OutputDir != "out" ||
+		c.Download == nil || *c.Download ||
+		time.Duration(c.ValidateTimeout) != 3*time.Second || time.Duration(c.DownloadTimeout) != cfg.DownloadTimeout {
+		t.Errorf("config record is missing fields: %s", line)
+	}
+	headers := c.Client.Headers
+	if headers["Authorization"] != redacted || headers["X-Api-Key"] != redacted || headers["X-Mirror"] != "eu" {
+		t.Errorf("headers logged as %v, want credentials redacted", headers)
+	}
+	if out := buf.String(); strings.Contains(out, "s3cret") || strings.Contains(out, "k3y") {
+		t.Errorf("credentials leaked into the log:\n%s", out)
+	}
+}
@@ -1,17 +1,32 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"regexp"
 	"runtime"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // ImageMeta represents metadata about an image from the Picsum API.
@@ -29,207 +44,1120 @@ type Result struct {
 	ID        string        // Image ID
 	Author    string        // Author of the image
 	Size      string        // Dimensions in WxH format
+	Width     int           // Image width in pixels
+	Height    int           // Image height in pixels
+	Status    Status        // Outcome of processing the image
 	Error     error         // Error encountered during processing (if any)
 	TimeSpent time.Duration // Duration taken to process the image
-}
+	Attempts  int           // Number of HTTP attempts made, including retries
+	ImageType string        // Detected MIME type of the downloaded image
+	Bytes     int64         // Number of bytes downloaded, after any Content-Encoding is decoded
+	WireBytes int64         // Number of bytes received over the network, before decoding
+	Resumed   bool          // Download continued a partial file via an HTTP Range request
+	Worker    int           // ID of the worker that produced the result
+	Path      string        // Where the image was saved, if the sink stores files
+	FileBytes int64         // Size of the saved image, including any resumed part
+	SHA256    string        // Hex SHA-256 of the saved image; empty unless downloaded in this run
+	EXIF      *EXIF         // EXIF metadata of the downloaded image with -exif; nil when it has none
+
+	// NotModified is set on a StatusCached result whose stored file the server
+	// confirmed as current by answering a conditional request from
+	// -cache-index with 304 Not Modified.
+	NotModified bool
+
+	// ActualWidth and ActualHeight are the dimensions decoded from the
+	// downloaded image with -verify-dimensions; 0 when not checked.
+	// DimensionMismatch is set when they differ from Width and Height,
+	// which hints at a wrong or placeholder image.
+	ActualWidth       int
+	ActualHeight      int
+	DimensionMismatch bool
 
-// global logger instance
-var logger = slog.Default()
+	StatusCode int           // HTTP status of the last request made for the image
+	Latency    time.Duration // Time until response headers for that request, excluding retries and body I/O
+	FinalURL   string        // URL that answered that request after following redirects
+}
 
 // imageProcessor reads jobs from the jobs channel, processes each image
 // (validation + download), and sends results to the results channel.
-// It uses a timeout context for each job and decrements the WaitGroup when done.
+// Each job, and its timeouts, runs under jobCtx. Once ctx is cancelled the
+// worker stops starting jobs, but keeps draining them and reports each one as
+// cancelled so that every job still yields a result. Progress on each job is published to
+// beats for stall detection. The WaitGroup is decremented when done.
 func imageProcessor(
+	ctx context.Context,
+	jobCtx context.Context,
 	id int,
 	jobs <-chan ImageMeta,
 	results chan<- Result,
 	wg *sync.WaitGroup,
-	timeout time.Duration,
+	beats *heartbeats,
+	opts WorkerOptions,
 ) {
 	defer wg.Done()
 
+	staggerStart(ctx, opts)
 	for job := range jobs {
-		startTime := time.Now()
-		logger.Info("Worker processing image",
-			"worker_id", id,
+		handleJob(ctx, jobCtx, id, job, results, beats, opts)
+	}
+}
+
+// handleJob processes one job on behalf of worker id, or reports it as
+// cancelled once ctx is, and sends its result.
+func handleJob(
+	ctx context.Context,
+	jobCtx context.Context,
+	id int,
+	job ImageMeta,
+	results chan<- Result,
+	beats *heartbeats,
+	opts WorkerOptions,
+) {
+	if ctx.Err() != nil {
+		result := cancelledResult(ctx, job)
+		result.Worker = id
+		opts.Metrics.observe(id, result)
+		results <- result
+		return
+	}
+
+	beats.start(id, job.ID)
+	result := processJob(jobCtx, id, job, opts)
+	beats.done(id)
+	cause := context.Cause(jobCtx)
+	result.Status = finalStatus(result, cause)
+	if result.Status == StatusCancelled && !errors.Is(result.Error, cause) {
+		// Report why the run was cancelled, not only the context error.
+		result.Error = fmt.Errorf("image %s cancelled: %w: %w", job.ID, cause, result.Error)
+	}
+	result.Worker = id
+	opts.Metrics.observe(id, result)
+	results <- result
+}
+
+// cancelledResult reports job as cancelled, without processing it, because
+// ctx was cancelled.
+func cancelledResult(ctx context.Context, job ImageMeta) Result {
+	return Result{
+		ID:     job.ID,
+		Author: job.Author,
+		Size:   fmt.Sprintf("%dx%d", job.Width, job.Height),
+		Width:  job.Width,
+		Height: job.Height,
+		Status: StatusCancelled,
+		Error:  fmt.Errorf("image %s not processed: %w", job.ID, context.Cause(ctx)),
+	}
+}
+
+// processJob validates and, if requested, downloads a single job. Each stage
+// runs under its own timeout context derived from parent, which is tagged with
+// a fresh job trace ID that also annotates every log line of the job.
+func processJob(parent context.Context, id int, job ImageMeta, opts WorkerOptions) Result {
+	startTime := time.Now()
+	jobID := newTraceID()
+	parent = withJobID(parent, jobID)
+	opts.Logger = opts.Logger.With("job_id", jobID)
+	opts.Logger.Debug("Worker processing image",
+		"worker_id", id,
+		"image_id", job.ID,
+		"author", job.Author,
+	)
+
+	result := Result{
+		ID:     job.ID,
+		Author: job.Author,
+		Size:   fmt.Sprintf("%dx%d", job.Width, job.Height),
+		Width:  job.Width,
+		Height: job.Height,
+	}
+
+	if opts.DryRun {
+		opts.Logger.Info("Dry run, skipping network I/O",
 			"image_id", job.ID,
-			"author", job.Author,
+			"download_url", job.DownloadURL,
+			"download", opts.Download,
 		)
+		result.Status = StatusSkipped
+		return result
+	}
 
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
-		defer cancel()
-
-		result := Result{
-			ID:     job.ID,
-			Author: job.Author,
-			Size:   fmt.Sprintf("%dx%d", job.Width, job.Height),
+	if opts.VerifyFiles {
+		result.Error = verifyStoredFile(job, opts, &result)
+		result.TimeSpent = time.Since(startTime)
+		switch {
+		case result.Error != nil:
+			opts.Logger.Warn("Stored file verification failed", "image_id", job.ID, "error", result.Error)
+		case result.DimensionMismatch:
+			opts.Logger.Warn("Image dimensions differ from metadata",
+				"image_id", job.ID,
+				"expected", fmt.Sprintf("%dx%d", job.Width, job.Height),
+				"actual", fmt.Sprintf("%dx%d", result.ActualWidth, result.ActualHeight),
+			)
 		}
+		return result
+	}
 
-		// First validate the image URL, then download it
-		if err := processImageMeta(ctx, job); err != nil {
+	// First validate the image URL, then download it if requested. The
+	// download checks the status itself, so validating first is optional.
+	if !(opts.SkipValidate && opts.Download) {
+		stats, attempts, err := validateJob(parent, job, opts)
+		result.Attempts += attempts
+		result.StatusCode, result.Latency, result.FinalURL = stats.StatusCode, stats.Latency, stats.FinalURL
+		if err != nil {
 			result.Error = err
 			result.TimeSpent = time.Since(startTime)
-			results <- result
-			logger.Warn("Validation failed",
+			opts.Logger.Warn("Validation failed",
 				"image_id", job.ID,
 				"error", err,
+				"attempts", result.Attempts,
 				"time_spent", result.TimeSpent,
 			)
-			continue
+			return result
 		}
+	}
 
-		/* 		if err := downloadImage(ctx, job); err != nil {
+	if opts.Download {
+		info, attempts, err := downloadJob(parent, job, opts)
+		result.Attempts += attempts
+		result.ImageType = info.ImageType
+		if info.Cached {
+			result.Status = StatusCached
+		}
+		result.NotModified = info.NotModified
+		result.Bytes = info.Bytes
+		result.WireBytes = info.WireBytes
+		result.Resumed = info.Resumed
+		result.Path = info.Path
+		result.FileBytes = info.FileBytes
+		result.SHA256 = info.SHA256
+		result.EXIF = info.EXIF
+		result.ActualWidth, result.ActualHeight = info.ActualWidth, info.ActualHeight
+		result.DimensionMismatch = dimensionsDiffer(job, info.ActualWidth, info.ActualHeight)
+		if result.DimensionMismatch {
+			opts.Logger.Warn("Image dimensions differ from metadata",
+				"image_id", job.ID,
+				"expected", fmt.Sprintf("%dx%d", job.Width, job.Height),
+				"actual", fmt.Sprintf("%dx%d", info.ActualWidth, info.ActualHeight),
+			)
+		}
+		if info.StatusCode != 0 {
+			result.StatusCode, result.Latency, result.FinalURL = info.StatusCode, info.Latency, info.FinalURL
+		}
+		if err != nil {
 			result.Error = err
 			result.TimeSpent = time.Since(startTime)
-			results <- result
-			logger.Warn("Download failed",
+			opts.Logger.Warn("Download failed",
 				"image_id", job.ID,
 				"error", err,
+				"attempts", result.Attempts,
 				"time_spent", result.TimeSpent,
 			)
-			continue
-		} */
+			return result
+		}
+		if opts.Convert != "" {
+			convertResult(&result, opts)
+		}
+	}
 
-		result.TimeSpent = time.Since(startTime)
-		results <- result
-		logger.Info("Image processed successfully",
-			"image_id", job.ID,
-			"author", job.Author,
-			"size", result.Size,
-			"time_spent", result.TimeSpent,
-		)
+	result.TimeSpent = time.Since(startTime)
+	opts.Logger.Debug("Image processed successfully",
+		"image_id", job.ID,
+		"author", job.Author,
+		"size", result.Size,
+		"status", result.Status,
+		"final_url", result.FinalURL,
+		"time_spent", result.TimeSpent,
+	)
+	return result
+}
+
+// validateJob runs processImageMeta with retries under opts.ValidateTimeout.
+// Keeping each stage in its own function ensures its context is cancelled as
+// soon as the stage is done, instead of piling up deferred cancels for the
+// lifetime of the worker.
+func validateJob(parent context.Context, job ImageMeta, opts WorkerOptions) (httpStats, int, error) {
+	ctx, cancel := withClockTimeout(parent, opts.Clock, opts.ValidateTimeout)
+	defer cancel()
+
+	var stats httpStats
+	attempts, err := withRetry(ctx, opts.retryPolicy(job), func() error {
+		if err := waitForLimiter(ctx, opts.Limiter); err != nil {
+			return err
+		}
+		release, err := acquireRequestSlots(ctx, job, opts)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if err := opts.Breaker.Allow(); err != nil {
+			return err
+		}
+		stats, err = processImageMeta(ctx, opts.Client, job)
+		opts.Breaker.Record(ctx, err)
+		return err
+	})
+	return stats, attempts, err
+}
+
+// downloadJob runs downloadImage with retries under the download timeout of
+// job; see WorkerOptions.downloadTimeout.
+func downloadJob(parent context.Context, job ImageMeta, opts WorkerOptions) (downloadInfo, int, error) {
+	ctx, cancel := withClockTimeout(parent, opts.Clock, opts.downloadTimeout(job))
+	defer cancel()
+
+	var info downloadInfo
+	attempts, err := withRetry(ctx, opts.retryPolicy(job), func() error {
+		if err := waitForLimiter(ctx, opts.Limiter); err != nil {
+			return err
+		}
+		release, err := acquireRequestSlots(ctx, job, opts)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if err := opts.Breaker.Allow(); err != nil {
+			return err
+		}
+		info, err = downloadImage(ctx, job, opts)
+		opts.Breaker.Record(ctx, err)
+		return err
+	})
+	return info, attempts, err
+}
+
+// acquireRequestSlots takes the per-host slot for job's download host and
+// then one of opts.InflightSlots, so that a request waiting on a busy host
+// does not hold a slot other hosts could use. The returned func releases
+// both.
+func acquireRequestSlots(ctx context.Context, job ImageMeta, opts WorkerOptions) (func(), error) {
+	host := requestHost(job.DownloadURL)
+	if err := opts.HostSlots.Acquire(ctx, host); err != nil {
+		return nil, err
+	}
+	if err := opts.InflightSlots.Acquire(ctx); err != nil {
+		opts.HostSlots.Release(host)
+		return nil, err
 	}
+	return func() {
+		opts.InflightSlots.Release()
+		opts.HostSlots.Release(host)
+	}, nil
+}
+
+// requestHost returns the host a request for rawURL is sent to. Redirects
+// are not followed, so a redirected request counts against the original
+// host. An unparsable URL yields "", which fails later when the request is
+// made.
+func requestHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
+
+// httpStats describes a single HTTP exchange.
+type httpStats struct {
+	StatusCode int           // Response status; 0 if no response was received
+	Latency    time.Duration // Time from sending the request until response headers arrived
+	FinalURL   string        // URL that answered after following redirects; empty without a response
 }
 
 // processImageMeta performs an HTTP GET request to the image download URL
-// to validate that it returns a 200 OK status.
-func processImageMeta(ctx context.Context, meta ImageMeta) error {
+// to validate that it returns a 200 OK status. Failures are reported as a
+// *ValidationError; network errors, 429 and 5xx responses are marked retryable.
+func processImageMeta(ctx context.Context, client *http.Client, meta ImageMeta) (httpStats, error) {
+	var stats httpStats
+
 	req, err := http.NewRequestWithContext(ctx, "GET", meta.DownloadURL, nil)
 	if err != nil {
-		return fmt.Errorf("failed to create request for image %s: %w", meta.ID, err)
+		return stats, &ValidationError{ID: meta.ID, Err: fmt.Errorf("failed to create request: %w", err)}
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	sent := time.Now()
+	resp, err := client.Do(req)
+	stats.Latency = time.Since(sent)
 	if err != nil {
-		return fmt.Errorf("image %s download check failed: %w", meta.ID, err)
+		return stats, classifyRequestError(&ValidationError{ID: meta.ID, Err: err})
 	}
 	defer resp.Body.Close()
+	stats.StatusCode = resp.StatusCode
+	stats.FinalURL = resp.Request.URL.String()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("image %s returned status %d", meta.ID, resp.StatusCode)
+		return stats, classifyStatus(resp, &ValidationError{ID: meta.ID, Status: resp.StatusCode})
 	}
 
-	return nil
+	return stats, nil
 }
 
-// downloadImage fetches the image content from the download URL and saves it
-// to the local filesystem under the "images/" directory as <ID>.jpg.
-func downloadImage(ctx context.Context, meta ImageMeta) error {
+// downloadInfo describes a download attempt.
+type downloadInfo struct {
+	httpStats
+	ImageType string // MIME type detected from the payload
+	Cached    bool   // True if the sink already held the image, so nothing was downloaded
+	Bytes     int64  // Number of bytes written to the sink by this download
+	WireBytes int64  // Number of body bytes received, before any Content-Encoding is decoded
+	Resumed   bool   // True if a partial file was continued with a Range request
+	Path      string // Where the sink saved the image, if it stores files
+	FileBytes int64  // Size of the stored image, including any resumed part
+	SHA256    string // Hex SHA-256 of the stored image
+	EXIF      *EXIF  // Metadata decoded with WorkerOptions.EXIF; nil when absent
+
+	// NotModified is set with Cached when the server answered the
+	// conditional request for a stored image with 304 Not Modified.
+	NotModified bool
+
+	// ActualWidth and ActualHeight are decoded from the image with
+	// WorkerOptions.VerifyDimensions; 0 when not checked.
+	ActualWidth, ActualHeight int
+}
+
+// downloadImage fetches the image content from the download URL and streams
+// it into opts.Sink. Payloads that are not recognizable images are rejected
+// before anything is written, writing holds one of opts.DownloadSlots, and
+// payloads larger than opts.MaxBytes are rejected.
+//
+// Sinks that know which images they hold (like FileSink) let an already
+// stored image be reported as cached unless opts.Force is set. Sinks that can
+// resume let an interrupted download continue with an HTTP Range request
+// when the server answers 206; it restarts when the server answers 200.
+// Failures are reported as a *DownloadError; network errors, 429 and 5xx
+// responses are marked retryable.
+func downloadImage(ctx context.Context, meta ImageMeta, opts WorkerOptions) (downloadInfo, error) {
+	var info downloadInfo
+	fail := func(err error) error {
+		return &DownloadError{ID: meta.ID, Status: info.StatusCode, Err: err}
+	}
+
+	// Resolve the file name up front, so a name collision is reported as
+	// such rather than as a failure of whichever sink call hits it first.
+	if ps, ok := opts.Sink.(pathSink); ok {
+		if _, err := ps.Path(meta); err != nil {
+			return info, fail(err)
+		}
+	}
+
+	// A stored image is trusted as is, unless opts.CacheIndex knows how to
+	// ask the server whether it changed since it was downloaded.
+	var validators cacheValidators
+	var revalidate bool
+	if sc, ok := opts.Sink.(storedChecker); ok && !opts.Force && sc.Stored(meta) {
+		if validators, revalidate = opts.CacheIndex.lookup(meta.ID); !revalidate {
+			info.Cached = true
+			return info, nil
+		}
+	}
+
+	rs, canResume := opts.Sink.(resumableSink)
+	var offset int64
+	var head []byte
+	if canResume && !revalidate {
+		var err error
+		offset, head, err = rs.Partial(meta)
+		if err != nil {
+			return info, fail(fmt.Errorf("failed to read partial download: %w", err))
+		}
+	}
+
 	req, err := http.NewRequestWithContext(ctx, "GET", meta.DownloadURL, nil)
 	if err != nil {
-		return fmt.Errorf("failed to create request for image %s: %w", meta.ID, err)
+		return info, fail(fmt.Errorf("failed to create request: %w", err))
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	} else if req.Header.Get("Accept-Encoding") == "" {
+		// Ask for compression explicitly: the transport then leaves the body
+		// encoded, so the bytes on the wire can be counted before decoding.
+		// A resumed range is requested unencoded, as it continues the
+		// decoded file.
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	if revalidate {
+		if validators.ETag != "" {
+			req.Header.Set("If-None-Match", validators.ETag)
+		}
+		if validators.LastModified != "" {
+			req.Header.Set("If-Modified-Since", validators.LastModified)
+		}
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	sent := time.Now()
+	resp, err := opts.Client.Do(req)
+	info.Latency = time.Since(sent)
 	if err != nil {
-		return fmt.Errorf("image %s download request failed: %w", meta.ID, err)
+		return info, classifyRequestError(fail(err))
 	}
 	defer resp.Body.Close()
+	info.StatusCode = resp.StatusCode
+	info.FinalURL = resp.Request.URL.String()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("image %s returned HTTP %d", meta.ID, resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusNotModified && revalidate:
+		info.Cached, info.NotModified = true, true
+		if ps, ok := opts.Sink.(pathSink); ok {
+			if info.Path, err = ps.Path(meta); err != nil {
+				return info, fail(err)
+			}
+		}
+		return info, nil
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		info.Resumed = true
+	case resp.StatusCode == http.StatusOK:
+		// The server ignored the Range header; start over.
+		offset, head = 0, nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		if err := rs.DiscardPartial(meta); err != nil {
+			return info, fail(fmt.Errorf("failed to discard partial download: %w", err))
+		}
+		return info, retryable(fail(errors.New("partial download could not be resumed")))
+	default:
+		return info, classifyStatus(resp, fail(nil))
 	}
 
-	if err := os.MkdirAll("images", 0755); err != nil {
-		return fmt.Errorf("failed to create images directory: %w", err)
+	encoding := contentEncoding(resp)
+	if encoding != "" && info.Resumed {
+		if err := rs.DiscardPartial(meta); err != nil {
+			return info, fail(fmt.Errorf("failed to discard partial download: %w", err))
+		}
+		return info, retryable(fail(fmt.Errorf("resumed range was sent with Content-Encoding %q", encoding)))
+	}
+
+	// Content-Length counts encoded bytes, so it only bounds the decoded
+	// size when the body is not encoded.
+	if encoding == "" && opts.MaxBytes > 0 && offset+resp.ContentLength > opts.MaxBytes {
+		return info, fail(fmt.Errorf("%w of %d bytes (Content-Length %d)", errTooLarge, opts.MaxBytes, offset+resp.ContentLength))
 	}
 
-	filePath := filepath.Join("images", fmt.Sprintf("%s.jpg", meta.ID))
-	file, err := os.Create(filePath)
+	// wire counts the body as received, paced by opts.Bandwidth, and checks
+	// it against Content-Length; everything downstream sees the decoded
+	// image. expected is -1 when the server sent no Content-Length.
+	throttled := &throttledReader{ctx: ctx, r: resp.Body, limiter: opts.Bandwidth}
+	wire := &downloadReader{r: throttled, limit: -1, expected: resp.ContentLength}
+	decoded, err := decodeBody(encoding, wire)
 	if err != nil {
-		return fmt.Errorf("failed to create file for image %s: %w", meta.ID, err)
+		return info, fail(err)
 	}
-	defer file.Close()
+	defer decoded.Close()
 
-	_, err = io.Copy(file, resp.Body)
+	// When resuming, the payload starts mid-file, so sniff the image type
+	// from the head of the partial write instead.
+	body := bufio.NewReaderSize(io.MultiReader(bytes.NewReader(head), decoded), sniffLen)
+	info.ImageType, err = detectImageType(resp.Header.Get("Content-Type"), body)
 	if err != nil {
-		return fmt.Errorf("failed to save image %s: %w", meta.ID, err)
+		return info, fail(err)
+	}
+	if _, err := body.Discard(len(head)); err != nil {
+		return info, fail(err)
 	}
 
-	return nil
+	if err := opts.DownloadSlots.Acquire(ctx); err != nil {
+		return info, fail(fmt.Errorf("waiting for a download slot: %w", err))
+	}
+	defer opts.DownloadSlots.Release()
+
+	// Hash while copying rather than re-reading the stored image afterwards.
+	// A resumed download only streams the remainder, so the partial write
+	// is hashed first.
+	// With opts.EXIF the head of the image is kept alongside, so its EXIF
+	// data can be decoded without reading the stored file back either.
+	hash := sha256.New()
+	var sum io.Writer = hash
+	var exifHead *headBuffer
+	if opts.EXIF && info.ImageType == "image/jpeg" {
+		exifHead = &headBuffer{max: maxEXIFHead}
+		sum = io.MultiWriter(sum, exifHead)
+	}
+	var probe *configProbe
+	if opts.VerifyDimensions {
+		probe = newConfigProbe()
+		sum = io.MultiWriter(sum, probe)
+		defer func() {
+			if probe != nil {
+				probe.result()
+			}
+		}()
+	}
+	if info.Resumed {
+		if err := hashPartial(sum, rs, meta); err != nil {
+			return info, fail(err)
+		}
+	}
+
+	src := &downloadReader{r: io.TeeReader(body, sum), limit: -1, expected: -1}
+	if opts.MaxBytes > 0 {
+		src.limit = max(opts.MaxBytes-offset, 0)
+	}
+
+	if canResume {
+		// Keep a partial write after a failed transfer only if the server
+		// says it can serve the remainder later.
+		keepPartial := resp.Header.Get("Accept-Ranges") == "bytes" || info.Resumed
+		err = rs.WriteFrom(ctx, meta, src, offset, keepPartial)
+	} else {
+		err = opts.Sink.Write(ctx, meta, src)
+	}
+	info.Bytes = src.n
+	info.WireBytes = wire.n
+	if err != nil {
+		return info, fail(fmt.Errorf("failed to save: %w", err))
+	}
+
+	info.FileBytes = offset + src.n
+	info.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	opts.CacheIndex.record(meta.ID, cacheValidators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	})
+	if probe != nil {
+		cfg, err := probe.result()
+		probe = nil
+		if err != nil {
+			// Formats without a registered decoder, such as WebP, cannot
+			// be checked; that says nothing about the image.
+			opts.Logger.Debug("Could not read image dimensions", "image_id", meta.ID, "error", err)
+		} else {
+			info.ActualWidth, info.ActualHeight = cfg.Width, cfg.Height
+		}
+	}
+	if exifHead != nil {
+		// Unreadable EXIF data does not make the image itself unusable.
+		if info.EXIF, err = decodeEXIF(exifHead.buf.Bytes()); err != nil {
+			opts.Logger.Debug("Ignoring unreadable EXIF data", "image_id", meta.ID, "error", err)
+		}
+	}
+	if ps, ok := opts.Sink.(pathSink); ok {
+		if info.Path, err = ps.Path(meta); err != nil {
+			return info, fail(err)
+		}
+	}
+	return info, nil
 }
 
-// fetchImageList queries the Picsum Photos API to retrieve a list of image metadata.
-// It returns a slice of ImageMeta or an error.
-func fetchImageList(limit int) ([]ImageMeta, error) {
-	url := fmt.Sprintf("https://picsum.photos/v2/list?page=1&limit=%d", limit)
-	resp, err := http.Get(url)
+// dimensionsDiffer reports whether decoded dimensions contradict those
+// advertised in meta. Either side being unknown is not a mismatch.
+func dimensionsDiffer(meta ImageMeta, width, height int) bool {
+	if width == 0 || height == 0 || meta.Width == 0 || meta.Height == 0 {
+		return false
+	}
+	return width != meta.Width || height != meta.Height
+}
+
+// hashPartial feeds the interrupted earlier write of meta into hash.
+func hashPartial(hash io.Writer, rs resumableSink, meta ImageMeta) error {
+	partial, err := rs.OpenPartial(meta)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch image list: %w", err)
+		return fmt.Errorf("failed to read partial download: %w", err)
+	}
+	defer partial.Close()
+	if _, err := io.Copy(hash, partial); err != nil {
+		return fmt.Errorf("failed to read partial download: %w", err)
+	}
+	return nil
+}
+
+// acceptEncoding lists the content codings decodeBody understands.
+const acceptEncoding = "gzip, deflate"
+
+// contentEncoding returns the normalized Content-Encoding of resp, or "" if
+// the body is not encoded.
+func contentEncoding(resp *http.Response) string {
+	enc := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if enc == "identity" {
+		return ""
+	}
+	return enc
+}
+
+// decodeBody wraps r so that reads return the payload with the given
+// content coding removed. HTTP "deflate" is zlib-wrapped (RFC 9110).
+// Unsupported codings are rejected rather than saved undecoded.
+func decodeBody(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "":
+		return io.NopCloser(r), nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		return zr, nil
+	case "deflate":
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deflate body: %w", err)
+		}
+		return zr, nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+}
+
+// defaultMaxBytes caps a single download unless overridden with -max-bytes.
+const defaultMaxBytes = 50 << 20 // 50 MiB
+
+// sniffLen is the number of leading bytes inspected to detect the image type.
+const sniffLen = 512
+
+// detectImageType checks the declared Content-Type and the leading bytes of
+// body (without consuming them) and returns the detected image MIME type.
+// It returns an error if either indicates the payload is not an image.
+func detectImageType(contentType string, body *bufio.Reader) (string, error) {
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return "", fmt.Errorf("invalid Content-Type %q: %w", contentType, err)
+		}
+		if !strings.HasPrefix(mediaType, "image/") && mediaType != "application/octet-stream" {
+			return "", fmt.Errorf("unexpected Content-Type %q", mediaType)
+		}
 	}
-	defer resp.Body.Close()
 
-	var images []ImageMeta
-	if err := json.NewDecoder(resp.Body).Decode(&images); err != nil {
-		return nil, fmt.Errorf("invalid JSON: %w", err)
+	head, err := body.Peek(sniffLen)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", retryable(fmt.Errorf("failed to read image header: %w", err))
 	}
 
-	return images, nil
+	detected := http.DetectContentType(head)
+	if !strings.HasPrefix(detected, "image/") {
+		return "", fmt.Errorf("payload is not a recognized image (detected %s)", detected)
+	}
+	return detected, nil
 }
 
-// main is the entry point. It sets up the worker pool to concurrently
-// validate and download images from a real API.
+// ensureOutputDir creates dir if it does not exist yet. It returns an error
+// if the path exists but is not a directory.
+func ensureOutputDir(dir string) error {
+	info, err := os.Stat(dir)
+	switch {
+	case err == nil:
+		if !info.IsDir() {
+			return fmt.Errorf("output path %s exists but is not a directory", dir)
+		}
+		return nil
+	case errors.Is(err, fs.ErrNotExist):
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create output directory %s: %w", dir, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("failed to stat output directory %s: %w", dir, err)
+	}
+}
+
+// maxLimit caps how many images a single run may list from the API.
+const maxLimit = 1000
+
+// validateLimit checks that limit is within 1..maxLimit.
+func validateLimit(limit int) error {
+	if limit < 1 || limit > maxLimit {
+		return fmt.Errorf("limit must be between 1 and %d, got %d", maxLimit, limit)
+	}
+	return nil
+}
+
+// resolveWorkers returns the requested worker count when it is at least 1,
+// falling back to NumCPU*2 otherwise.
+func resolveWorkers(requested int) int {
+	if requested >= 1 {
+		return requested
+	}
+	return runtime.NumCPU() * 2
+}
+
+// main is the entry point. It builds a Config from flags, runs the pool
+// against a real API and exits with the status chosen by exitCode.
 func main() {
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	numWorkers := runtime.NumCPU() * 2
-	const jobTimeout = 4 * time.Second
+	os.Exit(execute())
+}
 
-	logger.Info("Starting image downloader", "workers", numWorkers)
+// execute does the work of main and returns the process exit code, so that
+// deferred cleanup runs before the process exits.
+func execute() int {
+	defaults := DefaultConfig()
+	download := flag.Bool("download", false, "save images to <output>, named by -name-template, instead of only validating them")
+	outputDir := flag.String("output", defaults.OutputDir, "directory where downloaded images are saved")
+	onCollision := flag.String("on-collision", "overwrite", "what to do when two images resolve to the same file name: error, rename or overwrite")
+	checkpoint := flag.String("checkpoint", "", "record completed image IDs in this JSON file and skip the images it lists, to resume an interrupted run")
+	cacheIndex := flag.String("cache-index", "", "with -download, remember ETag and Last-Modified of downloads in this JSON file and revalidate stored images with conditional requests")
+	convert := flag.String("convert", "", "with -download, re-encode every image as png or webp, replacing the downloaded file")
+	archive := flag.String("archive", "", "with -download, collect all images into this .zip or .tar.gz file instead of -output")
+	retries := flag.Int("retries", defaults.Retries, "maximum retries per request on network errors and 5xx responses")
+	bwlimit := flag.Int64("bwlimit", 0, "maximum download bytes per second, shared by all workers (0 means unlimited)")
+	rps := flag.Float64("rps", 0, "maximum image requests per second across all workers (0 means unlimited)")
+	validateTimeout := flag.Duration("validate-timeout", defaults.ValidateTimeout, "timeout for validating a single image URL, including retries")
+	downloadTimeout := flag.Duration("download-timeout", defaults.DownloadTimeout, "timeout for downloading a single image, including retries; usually larger than -validate-timeout")
+	throughput := flag.Int64("assumed-throughput", 0, "derive each image's download timeout from its dimensions at this many bytes per second instead of using -download-timeout (0 disables)")
+	minDownloadTimeout := flag.Duration("min-download-timeout", defaultMinSizedTimeout, "with -assumed-throughput, the shortest download timeout")
+	maxDownloadTimeout := flag.Duration("max-download-timeout", 0, "with -assumed-throughput, the longest download timeout (0 means no limit)")
+	verifyDimensions := flag.Bool("verify-dimensions", false, "with -download, decode each image's real dimensions and flag those that differ from the metadata")
+	exif := flag.Bool("exif", false, "with -download, extract EXIF metadata (camera, timestamp, GPS) from downloaded JPEGs")
+	skipValidate := flag.Bool("skip-validate", false, "with -download, skip the separate validation request and download directly")
+	verifyFiles := flag.Bool("verify-files", false, "instead of requesting images, check that each listed image is stored in -output as a decodable file")
+	dryRun := flag.Bool("dry-run", false, "list the jobs that would be processed without requesting any images")
+	manifest := flag.String("manifest", "", "load image metadata from this JSON file instead of the Picsum API")
+	stdin := flag.Bool("stdin", false, "read newline-delimited download URLs from stdin instead of the Picsum API")
+	maxDownloads := flag.Int("max-downloads", 0, "maximum concurrent disk writes, independent of -workers (0 means unlimited)")
+	progressInterval := flag.Duration("progress-interval", time.Second, "how often to log run progress (0 disables)")
+	minWidth := flag.Int("min-width", 0, "skip images narrower than this many pixels")
+	minHeight := flag.Int("min-height", 0, "skip images shorter than this many pixels")
+	perHostLimit := flag.Int("per-host-limit", 0, "maximum HTTP requests in flight to any single host (0 means unlimited)")
+	breakerThreshold := flag.Int("breaker-threshold", 0, "consecutive transient failures after which requests fail fast for -breaker-cooldown (0 disables)")
+	breakerCooldown := flag.Duration("breaker-cooldown", defaultBreakerCooldown, "with -breaker-threshold, how long requests fail fast before a trial request is let through")
+	maxInflight := flag.Int("max-inflight", 0, "maximum HTTP requests in flight, independent of -workers (0 means unlimited)")
+	maxBytes := flag.Int64("max-bytes", defaults.MaxBytes, "maximum size of a single downloaded image in bytes (0 means unlimited)")
+	limit := flag.Int("limit", defaults.Limit, fmt.Sprintf("number of images to list from the API (1-%d)", maxLimit))
+	jobBuffer := flag.Int("job-buffer", 0, "capacity of the jobs channel (0 uses 2 per worker)")
+	resultBuffer := flag.Int("result-buffer", 0, "capacity of the results channel (0 uses 2 per worker)")
+	stagger := flag.Duration("stagger", 0, "spread worker startup by delaying each worker's first job by a random duration up to this (0 disables)")
+	stallThreshold := flag.Duration("stall-threshold", 0, "warn when a worker spends longer than this on one image (0 disables)")
+	fsync := flag.Bool("fsync", false, "flush every saved image to disk before reporting it done; durable across crashes but slower")
+	quiet := flag.Bool("quiet", false, "suppress per-image and progress logs, printing only the summary and errors")
+	manifestOut := flag.String("manifest-out", "", "write the path, size and SHA-256 of every downloaded image to this JSON file")
+	nameTemplate := flag.String("name-template", "{{.ID}}.jpg", "text/template for downloaded file names, with ImageMeta fields such as {{.ID}}, {{.Author}} and {{.Width}}")
+	grayscale := flag.Bool("grayscale", false, "fetch grayscale variants of the images")
+	blur := flag.Int("blur", 0, fmt.Sprintf("fetch blurred variants of the images, from 1 to %d (0 disables)", maxBlur))
+	author := flag.String("author", "", "only process images whose author matches this regular expression")
+	shuffle := flag.Bool("shuffle", false, "process images in a random order instead of listing order")
+	seed := flag.Uint64("seed", 0, "seed for -shuffle, to reproduce an order (0 picks a random seed and logs it)")
+	order := flag.String("order", "", "process images sorted by id, author, size-asc or size-desc instead of listing order")
+	pageConcurrency := flag.Int("page-concurrency", defaults.PageConcurrency, "maximum number of listing pages fetched at once")
+	warmup := flag.Bool("warmup", false, "before starting the workers, send one request for the first image to warm up DNS and connections")
+	shard := flag.Bool("shard", false, "route each image to a fixed worker by hashing its ID instead of sharing one queue")
+	maxIdleConns := flag.Int("max-idle-conns", defaultMaxIdleConns, "maximum idle HTTP connections kept across all hosts")
+	maxIdleConnsPerHost := flag.Int("max-idle-conns-per-host", defaultMaxIdleConnsPerHost, "maximum idle HTTP connections kept per host")
+	idleConnTimeout := flag.Duration("idle-conn-timeout", defaultIdleConnTimeout, "how long an idle HTTP connection is kept before closing")
+	dialTimeout := flag.Duration("dial-timeout", 0, "timeout for opening a connection, separate from the per-image timeouts (0 uses the net/http default of 30s)")
+	tlsHandshakeTimeout := flag.Duration("tls-handshake-timeout", 0, "timeout for the TLS handshake (0 uses the net/http default of 10s)")
+	responseHeaderTimeout := flag.Duration("response-header-timeout", 0, "timeout for response headers once a request is sent (0 means no limit beyond the per-image timeouts)")
+	maxRedirects := flag.Int("max-redirects", defaultMaxRedirects, "maximum redirects followed per request")
+	retryBase := flag.Duration("retry-base", defaults.RetryBaseDelay, "backoff before the first retry; doubles on every further retry")
+	retryMax := flag.Duration("retry-max", defaults.RetryMaxDelay, "maximum backoff between retries")
+	retryBudget := flag.Int("retry-budget", 0, "maximum retries per minute across all workers (0 disables)")
+	shutdownGrace := flag.Duration("shutdown-grace", defaults.ShutdownGrace, "on interrupt, how long in-flight images may finish before being cancelled; a second interrupt exits immediately")
+	failFast := flag.Bool("fail-fast", false, "cancel the run as soon as any image fails")
+	maxFailures := flag.Int("max-failures", 0, "cancel the run once this many images have failed (0 means no limit)")
+	stopAfter := flag.Int("stop-after", 0, "cancel the run once this many images have succeeded, reporting exactly that many (0 means no limit)")
+	traceID := flag.String("trace-id", "", "trace ID included in every log line (random when empty)")
+	runTimeout := flag.Duration("run-timeout", 0, "abort the whole run after this long (0 disables)")
+	workers := flag.Int("workers", 0, "number of workers, or the maximum with -autoscale (default NumCPU*2 when not positive)")
+	autoscale := flag.Bool("autoscale", false, "start few workers and add more, up to -workers, while jobs queue up; idle workers exit after -scale-cooldown")
+	minWorkers := flag.Int("min-workers", 1, "with -autoscale, workers kept even while idle")
+	scaleBacklog := flag.Int("scale-backlog", 1, "with -autoscale, queued jobs that make the pool add a worker")
+	scaleCooldown := flag.Duration("scale-cooldown", defaultScaleCooldown, "with -autoscale, how long a worker may sit idle before it exits")
+	force := flag.Bool("force", false, "re-download images even if the output file already exists")
+	csvPath := flag.String("csv", "", "write one CSV row per processed image to this file")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics on /metrics at this address while running")
+	format := flag.String("format", "text", "result output format: text (log lines) or json (array on stdout)")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	fields := flag.String("fields", "", "with -format json, comma-separated result fields to include, such as id,author,time_spent_ms (empty includes all)")
+	logFormat := flag.String("log-format", "text", "log output format: text or json")
+	insecure := flag.Bool("insecure", false, "skip TLS certificate verification (for self-signed mirrors only)")
+	headers := headerFlag{}
+	flag.Var(headers, "header", "extra request header as key=value; may be repeated")
+	flag.Parse()
 
-	images, err := fetchImageList(10)
+	logger, err := newLogger(os.Stderr, *logLevel, *logFormat)
 	if err != nil {
-		logger.Error("Failed to fetch image list", "error", err)
-		return
+		slog.Error("Invalid logging configuration", "error", err)
+		return 2
 	}
 
-	jobs := make(chan ImageMeta, len(images))
-	results := make(chan Result, len(images))
-	var wg sync.WaitGroup
+	if *archive != "" && !*download {
+		logger.Error("Invalid mode", "error", "-archive requires -download")
+		return 2
+	}
+	// Resuming would recreate the archive, losing the images the checkpoint
+	// then skips.
+	if *archive != "" && *checkpoint != "" {
+		logger.Error("Invalid mode", "error", "-checkpoint cannot be combined with -archive")
+		return 2
+	}
+	if *cacheIndex != "" && !*download {
+		logger.Error("Invalid mode", "error", "-cache-index requires -download")
+		return 2
+	}
+	if *convert != "" && (!*download || *archive != "") {
+		logger.Error("Invalid mode", "error", "-convert requires -download and cannot be combined with -archive")
+		return 2
+	}
 
-	// Fan-Out
-	for w := 1; w <= numWorkers; w++ {
-		wg.Add(1)
-		go imageProcessor(w, jobs, results, &wg, jobTimeout)
+	collisionMode, err := parseCollisionMode(*onCollision)
+	if err != nil {
+		logger.Error("Invalid collision mode", "error", err)
+		return 2
 	}
 
-	for _, img := range images {
-		jobs <- img
+	nameTmpl, err := parseNameTemplate(*nameTemplate)
+	if err != nil {
+		logger.Error("Invalid name template", "template", *nameTemplate, "error", err)
+		return 2
 	}
-	close(jobs)
 
-	// Fan-In
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
+	var authorPattern *regexp.Regexp
+	if *author != "" {
+		authorPattern, err = regexp.Compile(*author)
+		if err != nil {
+			logger.Error("Invalid author pattern", "pattern", *author, "error", err)
+			return 2
+		}
+	}
 
-	// closing a channel only means "no more values will be sent to it."
-	// Reading from a closed channel is still safe.
-	for result := range results {
-		if result.Error != nil {
-			logger.Warn("Image processing failed",
-				"image_id", result.ID,
-				"author", result.Author,
-				"error", result.Error,
-				"time_spent", result.TimeSpent,
-			)
-		} else {
-			logger.Info("Image processed",
-				"image_id", result.ID,
-				"author", result.Author,
-				"size", result.Size,
-				"time_spent", result.TimeSpent,
-			)
+	compare, err := parseOrder(*order)
+	if err != nil {
+		logger.Error("Invalid order", "error", err)
+		return 2
+	}
+
+	if *format != "text" && *format != "json" {
+		logger.Error("Invalid output format", "format", *format)
+		return 2
+	}
+	if *fields != "" && *format != "json" {
+		logger.Error("Invalid output format", "error", "-fields requires -format json")
+		return 2
+	}
+	outputFields, err := parseFields(*fields)
+	if err != nil {
+		logger.Error("Invalid output fields", "error", err)
+		return 2
+	}
+
+	// The summary and any fatal errors are still logged to logger below.
+	runLogger := quietLogger(logger, os.Stderr, *quiet, *logFormat)
+
+	if *insecure {
+		logger.Warn("TLS certificate verification is DISABLED; connections can be intercepted")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// Restore the default signal behaviour after the first signal, so that
+	// a second one terminates the process even during the shutdown grace.
+	context.AfterFunc(ctx, stop)
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	clientOpts := ClientOptions{
+		Headers:             http.Header(headers),
+		InsecureSkipVerify:  *insecure,
+		MaxRedirects:        *maxRedirects,
+		MaxIdleConns:        *maxIdleConns,
+		MaxIdleConnsPerHost: *maxIdleConnsPerHost,
+		IdleConnTimeout:     *idleConnTimeout,
+
+		DialTimeout:           *dialTimeout,
+		TLSHandshakeTimeout:   *tlsHandshakeTimeout,
+		ResponseHeaderTimeout: *responseHeaderTimeout,
+	}
+
+	cfg := Config{
+		WorkerOptions: WorkerOptions{
+			ValidateTimeout:  *validateTimeout,
+			DownloadTimeout:  *downloadTimeout,
+			Download:         *download,
+			OutputDir:        *outputDir,
+			NameTemplate:     nameTmpl,
+			ShutdownGrace:    *shutdownGrace,
+			RetryBaseDelay:   *retryBase,
+			RetryMaxDelay:    *retryMax,
+			StallThreshold:   *stallThreshold,
+			Stagger:          *stagger,
+			Fsync:            *fsync,
+			JobBuffer:        *jobBuffer,
+			ResultBuffer:     *resultBuffer,
+			Force:            *force,
+			DryRun:           *dryRun,
+			VerifyFiles:      *verifyFiles,
+			SkipValidate:     *skipValidate,
+			EXIF:             *exif,
+			VerifyDimensions: *verifyDimensions,
+			OnCollision:      collisionMode,
+			Convert:          *convert,
+			Retries:          *retries,
+			Limiter:          newRateLimiter(*rps),
+			Bandwidth:        newBandwidthLimiter(*bwlimit),
+			RetryBudget:      newRetryBudget(*retryBudget),
+			DownloadSlots:    NewSemaphore(*maxDownloads),
+			InflightSlots:    NewSemaphore(*maxInflight),
+			HostSlots:        NewHostSemaphore(*perHostLimit),
+			Breaker:          NewCircuitBreaker(*breakerThreshold, *breakerCooldown, nil, runLogger),
+			MaxBytes:         *maxBytes,
+			Logger:           runLogger,
+		},
+		ClientOptions:    clientOpts,
+		Workers:          resolveWorkers(*workers),
+		Limit:            *limit,
+		MinWidth:         *minWidth,
+		MinHeight:        *minHeight,
+		PageConcurrency:  *pageConcurrency,
+		Sharded:          *shard,
+		Author:           authorPattern,
+		Grayscale:        *grayscale,
+		Blur:             *blur,
+		Order:            compare,
+		Shuffle:          *shuffle,
+		Seed:             *seed,
+		FailFast:         *failFast,
+		MaxFailures:      *maxFailures,
+		StopAfter:        *stopAfter,
+		RunTimeout:       *runTimeout,
+		Warmup:           *warmup,
+		ProgressInterval: *progressInterval,
+	}
+
+	// Generate the trace ID here rather than in RunContext so that the
+	// summary and other logs written after the run carry it too.
+	cfg.TraceID = *traceID
+	if cfg.TraceID == "" {
+		cfg.TraceID = newTraceID()
+	}
+	logger = logger.With("trace_id", cfg.TraceID)
+
+	switch {
+	case *manifest != "" && *stdin:
+		logger.Error("Invalid source", "error", "-manifest and -stdin are mutually exclusive")
+		return 2
+	case *manifest != "":
+		cfg.Source = &ManifestSource{Path: *manifest}
+	case *stdin:
+		cfg.Source = &URLListSource{R: os.Stdin}
+	}
+
+	if *throughput > 0 {
+		cfg.SizedTimeout = &SizedTimeout{
+			Throughput: float64(*throughput),
+			Min:        *minDownloadTimeout,
+			Max:        *maxDownloadTimeout,
+		}
+	}
+
+	if *autoscale {
+		cfg.Autoscale = &AutoscaleOptions{
+			MinWorkers: *minWorkers,
+			Backlog:    *scaleBacklog,
+			Cooldown:   *scaleCooldown,
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		logger.Error("Invalid configuration", "error", err)
+		return 2
+	}
+
+	if *metricsAddr != "" {
+		reg := prometheus.NewRegistry()
+		cfg.Metrics = NewMetrics(reg)
+		shutdown, err := serveMetrics(*metricsAddr, reg, logger)
+		if err != nil {
+			logger.Error("Failed to start metrics server", "addr", *metricsAddr, "error", err)
+			return 2
+		}
+		defer shutdown()
+	}
+
+	var archiveSink *ArchiveSink
+	if *archive != "" {
+		archiveSink, err = NewArchiveSink(*archive, nameTmpl)
+		if err != nil {
+			logger.Error("Invalid archive", "error", err)
+			return 2
+		}
+		archiveSink.Claims = NewNameClaims(collisionMode)
+		cfg.Sink = archiveSink
+	}
+
+	if *cacheIndex != "" {
+		cfg.CacheIndex, err = LoadCacheIndex(*cacheIndex)
+		if err != nil {
+			logger.Error("Invalid cache index", "error", err)
+			return 2
+		}
+	}
+
+	if *checkpoint != "" {
+		cfg.Checkpoint, err = LoadCheckpoint(*checkpoint)
+		if err != nil {
+			logger.Error("Invalid checkpoint", "error", err)
+			return 2
+		}
+	}
+
+	results, err := RunContext(ctx, cfg)
+	if cfg.CacheIndex != nil {
+		// Saved even after failures, so what did download is not fetched
+		// again in full next time.
+		if serr := cfg.CacheIndex.Save(); serr != nil {
+			err = errors.Join(err, serr)
+		}
+	}
+	if archiveSink != nil {
+		// An unfinished archive is unreadable, so this fails the run.
+		if cerr := archiveSink.Close(); cerr != nil {
+			err = errors.Join(err, cerr)
+		}
+	}
+	if results != nil {
+		logSummary(logger, summarize(results))
+	}
+
+	if *format == "json" {
+		if err := writeJSON(os.Stdout, results, outputFields); err != nil {
+			logger.Error("Failed to write results", "error", err)
+		}
+	}
+
+	if *csvPath != "" {
+		if err := writeCSVFile(*csvPath, results); err != nil {
+			logger.Error("Failed to write CSV", "path", *csvPath, "error", err)
+		}
+	}
+
+	if *manifestOut != "" {
+		if err := writeChecksumFile(*manifestOut, results); err != nil {
+			logger.Error("Failed to write checksum manifest", "path", *manifestOut, "error", err)
+		}
+	}
+
+	if ctx.Err() != nil {
+		logger.Warn("Run interrupted", "reason", "received termination signal")
+	}
+
+	switch {
+	case err == nil:
+	case *quiet && !errors.Is(err, ErrListingFailed):
+		// The summary already counts the failed images.
+	default:
+		logger.Error("Run failed", "error", err)
+	}
+	return exitCode(results, err)
+}
+
+// quietLogger returns the logger the run itself logs to: logger, or in quiet
+// mode a logger writing to w in format that only logs errors, which keeps
+// per-image and progress lines out of the output.
+func quietLogger(logger *slog.Logger, w io.Writer, quiet bool, format string) *slog.Logger {
+	if !quiet {
+		return logger
+	}
+	// format was already accepted when logger was built.
+	l, _ := newLogger(w, "error", format)
+	return l
+}
+
+// exitCode maps the outcome of RunContext to the process exit status: 0 when every
+// image succeeded, 1 when any image failed, and 2 when listing itself failed.
+func exitCode(results []Result, err error) int {
+	if errors.Is(err, ErrListingFailed) {
+		return 2
+	}
+	if err != nil {
+		return 1
+	}
+	for _, r := range results {
+		if !r.Status.OK() {
+			return 1
 		}
 	}
+	return 0
 }
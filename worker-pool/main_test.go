@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidateTimeoutByFakeClock(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	clock := newFakeClock()
+	done := make(chan error)
+	go func() {
+		_, _, err := validateJob(context.Background(), ImageMeta{ID: "1", DownloadURL: srv.URL}, WorkerOptions{
+			ValidateTimeout: time.Hour,
+			Client:          srv.Client(),
+			Clock:           clock,
+			Logger:          discardLogger(),
+		})
+		done <- err
+	}()
+
+	clock.waitForWaiters(t, 1)
+	select {
+	case err := <-done:
+		t.Fatalf("validation ended before its timeout: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Hour)
+	var verr *ValidationError
+	if err := <-done; !errors.As(err, &verr) {
+		t.Errorf("err = %v, want a *ValidationError", err)
+	}
+}
+
+func TestDownloadToggle(t *testing.T) {
+	for _, download := range []bool{false, true} {
+		var requests atomic.Int64
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.Write(fakeJPEG)
+		}))
+		dir := t.TempDir()
+
+		results, err := Run(Config{
+			WorkerOptions: WorkerOptions{
+				ValidateTimeout: time.Minute,
+				DownloadTimeout: time.Minute,
+				Download:        download,
+				OutputDir:       dir,
+				Client:          srv.Client(),
+				Logger:          discardLogger(),
+			},
+			Workers: 1,
+			Source:  SliceSource{{ID: "1", DownloadURL: srv.URL}},
+		})
+		srv.Close()
+		if err != nil || len(results) != 1 {
+			t.Fatalf("download=%t: Run() = %d results, %v", download, len(results), err)
+		}
+
+		wantRequests, wantPath := int64(1), ""
+		if download {
+			wantRequests, wantPath = 2, filepath.Join(dir, "1.jpg")
+		}
+		if got := requests.Load(); got != wantRequests {
+			t.Errorf("download=%t: %d requests, want %d", download, got, wantRequests)
+		}
+		if results[0].Path != wantPath {
+			t.Errorf("download=%t: Path = %q, want %q", download, results[0].Path, wantPath)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "1.jpg")); (err == nil) != download {
+			t.Errorf("download=%t: stat of the image file: %v", download, err)
+		}
+	}
+}
+
+func TestResolveWorkers(t *testing.T) {
+	def := runtime.NumCPU() * 2
+	for _, tt := range []struct{ requested, want int }{
+		{1, 1},
+		{7, 7},
+		{0, def},
+		{-3, def},
+	} {
+		if got := resolveWorkers(tt.requested); got != tt.want {
+			t.Errorf("resolveWorkers(%d) = %d, want %d", tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestDetectImageType(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		body        []byte
+		want        string // Empty when the payload must be rejected
+	}{
+		{"jpeg", "image/jpeg", fakeJPEG, "image/jpeg"},
+		{"octet stream", "application/octet-stream", fakeJPEG, "image/jpeg"},
+		{"no content type", "", fakeJPEG, "image/jpeg"},
+		{"text content type", "text/plain; charset=utf-8", fakeJPEG, ""},
+		{"html payload", "image/jpeg", []byte("<html><body>rate limited</body></html>"), ""},
+		{"invalid content type", "image/", fakeJPEG, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body := bufio.NewReader(bytes.NewReader(tt.body))
+			got, err := detectImageType(tt.contentType, body)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("detected %s, want the payload rejected", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("detectImageType() = %q, %v, want %q", got, err, tt.want)
+			}
+			if n, _ := io.Copy(io.Discard, body); n != int64(len(tt.body)) {
+				t.Errorf("%d bytes left to read after detection, want all %d", n, len(tt.body))
+			}
+		})
+	}
+}
+
+func TestStageTimeoutsAreIndependent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+			w.Write(fakeJPEG)
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	job := ImageMeta{ID: "1", DownloadURL: srv.URL}
+	opts := func(validate, download time.Duration) WorkerOptions {
+		return WorkerOptions{
+			ValidateTimeout: validate,
+			DownloadTimeout: download,
+			Download:        true,
+			Sink:            discardSink{},
+			Client:          srv.Client(),
+			Logger:          discardLogger(),
+		}
+	}
+
+	result := processJob(context.Background(), 1, job, opts(20*time.Millisecond, time.Minute))
+	var verr *ValidationError
+	if !errors.As(result.Error, &verr) {
+		t.Errorf("short validate timeout: error %v, want a *ValidationError", result.Error)
+	}
+
+	result = processJob(context.Background(), 1, job, opts(time.Minute, 20*time.Millisecond))
+	var derr *DownloadError
+	if !errors.As(result.Error, &derr) {
+		t.Errorf("short download timeout: error %v, want a *DownloadError after validation passed", result.Error)
+	}
+	if result.StatusCode != http.StatusOK {
+		t.Errorf("short download timeout: validation status %d, want 200", result.StatusCode)
+	}
+}
+
+func TestDryRunRequestsNothing(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer srv.Close()
+
+	results, err := Run(Config{
+		WorkerOptions: WorkerOptions{
+			ValidateTimeout: time.Minute,
+			DownloadTimeout: time.Minute,
+			Download:        true,
+			DryRun:          true,
+			Sink:            discardSink{},
+			Client:          srv.Client(),
+			Logger:          discardLogger(),
+		},
+		Workers: 2,
+		Source:  fakeJobs(srv, 5),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("dry run made %d requests, want none", n)
+	}
+	for _, r := range results {
+		if r.Status != StatusSkipped {
+			t.Errorf("image %s is %v, want %v", r.ID, r.Status, StatusSkipped)
+		}
+	}
+	if len(results) != 5 {
+		t.Errorf("got %d results, want 5", len(results))
+	}
+}
+
+func TestResultBytes(t *testing.T) {
+	srv := newFakeImageServer(t, 0)
+	result := processJob(context.Background(), 1, ImageMeta{ID: "1", DownloadURL: srv.URL}, WorkerOptions{
+		ValidateTimeout: time.Minute,
+		DownloadTimeout: time.Minute,
+		Download:        true,
+		Sink:            discardSink{},
+		Client:          srv.Client(),
+		Logger:          discardLogger(),
+	})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if result.Bytes != int64(len(fakeJPEG)) {
+		t.Errorf("Bytes = %d, want %d", result.Bytes, len(fakeJPEG))
+	}
+}
+
+func TestMaxBytesRejectsOversizeImage(t *testing.T) {
+	// Without a Content-Length, the size is only found out while saving.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(fakeJPEG[:1024])
+		w.(http.Flusher).Flush()
+		w.Write(fakeJPEG[1024:])
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	result := processJob(context.Background(), 1, ImageMeta{ID: "1", DownloadURL: srv.URL}, WorkerOptions{
+		ValidateTimeout: time.Minute,
+		DownloadTimeout: time.Minute,
+		Download:        true,
+		MaxBytes:        4096,
+		Retries:         2,
+		Sink:            &FileSink{Dir: dir},
+		Client:          srv.Client(),
+		Logger:          discardLogger(),
+	})
+	if !errors.Is(result.Error, errTooLarge) {
+		t.Errorf("error = %v, want errTooLarge", result.Error)
+	}
+	if result.Attempts != 2 {
+		t.Errorf("Attempts = %d, want 2: an oversize image is not retried", result.Attempts)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("%s left behind", e.Name())
+	}
+}
+
+func TestRangeResume(t *testing.T) {
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("Content-Type", "image/jpeg")
+		http.ServeContent(w, r, "1.jpg", time.Time{}, bytes.NewReader(fakeJPEG))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	const offset = 1000
+	if err := os.WriteFile(filepath.Join(dir, "1.jpg.tmp"), fakeJPEG[:offset], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	result := processJob(context.Background(), 1, ImageMeta{ID: "1", DownloadURL: srv.URL}, WorkerOptions{
+		ValidateTimeout: time.Minute,
+		DownloadTimeout: time.Minute,
+		Download:        true,
+		SkipValidate:    true,
+		Sink:            &FileSink{Dir: dir},
+		Client:          srv.Client(),
+		Logger:          discardLogger(),
+	})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+
+	if !slices.Equal(ranges, []string{"bytes=1000-"}) {
+		t.Errorf("requested ranges %q, want the remainder after the partial file", ranges)
+	}
+	if !result.Resumed || result.Bytes != int64(len(fakeJPEG)-offset) || result.FileBytes != int64(len(fakeJPEG)) {
+		t.Errorf("Resumed %t, Bytes %d, FileBytes %d; want a resumed download of %d of %d bytes",
+			result.Resumed, result.Bytes, result.FileBytes, len(fakeJPEG)-offset, len(fakeJPEG))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "1.jpg"))
+	if err != nil || !bytes.Equal(data, fakeJPEG) {
+		t.Errorf("resumed file differs from the image: %v", err)
+	}
+	if sum := sha256.Sum256(fakeJPEG); result.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("SHA256 %s does not cover the whole image", result.SHA256)
+	}
+}
+
+func TestValidateLimit(t *testing.T) {
+	for _, tt := range []struct {
+		limit int
+		ok    bool
+	}{
+		{0, false},
+		{-1, false},
+		{1, true},
+		{maxLimit, true},
+		{maxLimit + 1, false},
+	} {
+		if err := validateLimit(tt.limit); (err == nil) != tt.ok {
+			t.Errorf("validateLimit(%d) = %v, want ok %t", tt.limit, err, tt.ok)
+		}
+	}
+}
+
+func TestLatencyWithinTimeSpent(t *testing.T) {
+	srv := newFakeImageServer(t, 20*time.Millisecond)
+	result := processJob(context.Background(), 1, ImageMeta{ID: "1", DownloadURL: srv.URL}, WorkerOptions{
+		ValidateTimeout: time.Minute,
+		DownloadTimeout: time.Minute,
+		Download:        true,
+		Sink:            discardSink{},
+		Client:          srv.Client(),
+		Logger:          discardLogger(),
+	})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	// Latency covers the download request only, TimeSpent validation too.
+	if result.Latency < 20*time.Millisecond || result.Latency >= result.TimeSpent {
+		t.Errorf("Latency %v, TimeSpent %v; want at least the server delay, and less than TimeSpent", result.Latency, result.TimeSpent)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	ok := []Result{{ID: "1", Status: StatusSuccess}, {ID: "2", Status: StatusCached}, {ID: "3", Status: StatusSkipped}}
+	failed := append(slices.Clone(ok), Result{ID: "4", Status: StatusFailed})
+	cancelled := append(slices.Clone(ok), Result{ID: "4", Status: StatusCancelled})
+	imageErr := fmt.Errorf("%w: image 4: boom", ErrImageFailed)
+	listingErr := fmt.Errorf("%w: page 2 failed", ErrListingFailed)
+
+	for _, tt := range []struct {
+		name    string
+		results []Result
+		err     error
+		want    int
+	}{
+		{"all succeeded", ok, nil, 0},
+		{"no images", nil, nil, 0},
+		{"image failed", failed, imageErr, 1},
+		{"image cancelled", cancelled, nil, 1},
+		{"other error", ok, errors.New("checkpoint not saved"), 1},
+		{"listing failed", ok, listingErr, 2},
+		{"listing and image failed", failed, errors.Join(listingErr, imageErr), 2},
+	} {
+		if got := exitCode(tt.results, tt.err); got != tt.want {
+			t.Errorf("%s: exitCode() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSkipValidateRequestsOncePerImage(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		w.Write(fakeJPEG)
+	}))
+	defer srv.Close()
+
+	const jobs = 10
+	sink := NewMemorySink()
+	results, err := Run(Config{
+		WorkerOptions: WorkerOptions{
+			DownloadTimeout: time.Minute,
+			Download:        true,
+			SkipValidate:    true,
+			Sink:            sink,
+			Client:          srv.Client(),
+			Logger:          discardLogger(),
+		},
+		Workers: 3,
+		Source:  fakeJobs(srv, jobs),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != jobs || sink.Len() != jobs {
+		t.Fatalf("got %d results and %d stored images, want %d", len(results), sink.Len(), jobs)
+	}
+	for _, r := range results {
+		if n := requests["/"+r.ID]; n != 1 {
+			t.Errorf("image %s was requested %d times, want 1", r.ID, n)
+		}
+		if r.Attempts != 1 {
+			t.Errorf("image %s took %d attempts, want 1", r.ID, r.Attempts)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.SkipValidate = true
+	if err := cfg.Validate(); err == nil {
+		t.Error("-skip-validate without -download accepted")
+	}
+}
+
+func TestContentEncodingAccounting(t *testing.T) {
+	original := jpegFixture(t, 64, 48)
+	encoded := map[string][]byte{"": original}
+	for _, enc := range []string{"gzip", "deflate"} {
+		var buf bytes.Buffer
+		var w io.WriteCloser = gzip.NewWriter(&buf)
+		if enc == "deflate" {
+			w = zlib.NewWriter(&buf)
+		}
+		w.Write(original)
+		w.Close()
+		encoded[enc] = buf.Bytes()
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := r.URL.Query().Get("enc")
+		if enc != "" {
+			w.Header().Set("Content-Encoding", enc)
+		}
+		w.Write(encoded[enc])
+	}))
+	defer srv.Close()
+
+	for enc, body := range encoded {
+		dir := t.TempDir()
+		result := processJob(context.Background(), 1, ImageMeta{ID: "1", DownloadURL: srv.URL + "?enc=" + enc}, WorkerOptions{
+			DownloadTimeout: time.Minute,
+			Download:        true,
+			SkipValidate:    true,
+			Sink:            &FileSink{Dir: dir},
+			Client:          srv.Client(),
+			Logger:          discardLogger(),
+		})
+		if result.Error != nil {
+			t.Fatalf("encoding %q: %v", enc, result.Error)
+		}
+		if result.WireBytes != int64(len(body)) || result.Bytes != int64(len(original)) {
+			t.Errorf("encoding %q: %d wire and %d decoded bytes, want %d and %d",
+				enc, result.WireBytes, result.Bytes, len(body), len(original))
+		}
+
+		saved, err := os.ReadFile(filepath.Join(dir, "1.jpg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(saved, original) {
+			t.Errorf("encoding %q: saved file is not the decoded image", enc)
+		}
+		if cfg, err := jpeg.DecodeConfig(bytes.NewReader(saved)); err != nil || cfg.Width != 64 || cfg.Height != 48 {
+			t.Errorf("encoding %q: saved file decodes as %dx%d, %v", enc, cfg.Width, cfg.Height, err)
+		}
+	}
+}
+
+func TestLargeBodyAllocationsStayBounded(t *testing.T) {
+	// The body is written from one small chunk, so the server allocates
+	// almost nothing and the measurement is of the download path.
+	const size, maxAllocated = 64 << 20, 1 << 20
+	chunk := make([]byte, 32<<10)
+	copy(chunk, fakeJPEG)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		if r.Method == http.MethodHead {
+			return
+		}
+		for written := 0; written < size; written += len(chunk) {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	sinks := map[string]func(t *testing.T) Sink{
+		"discard": func(t *testing.T) Sink { return discardSink{} },
+		"archive": func(t *testing.T) Sink {
+			archive, err := NewArchiveSink(filepath.Join(t.TempDir(), "images.zip"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { archive.Close() })
+			return archive
+		},
+	}
+	for name, newSink := range sinks {
+		t.Run(name, func(t *testing.T) {
+			opts := WorkerOptions{
+				ValidateTimeout: time.Minute,
+				DownloadTimeout: time.Minute,
+				Download:        true,
+				Sink:            newSink(t),
+				Client:          srv.Client(),
+				Logger:          discardLogger(),
+			}
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			result := processJob(context.Background(), 1, ImageMeta{ID: "1", DownloadURL: srv.URL}, opts)
+			runtime.ReadMemStats(&after)
+
+			if result.Error != nil {
+				t.Fatal(result.Error)
+			}
+			if result.Bytes != size {
+				t.Fatalf("Bytes = %d, want %d", result.Bytes, size)
+			}
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > maxAllocated {
+				t.Errorf("downloading %d MiB allocated %d KiB, want the body streamed in small buffers", size>>20, allocated>>10)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// loadManifest reads image metadata from a local JSON file holding the same
+// []ImageMeta shape that the Picsum list endpoint returns. Parse errors report
+// the line and column, and missing required fields report the entry index.
+func loadManifest(path string) ([]ImageMeta, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", path, err)
+	}
+
+	var images []ImageMeta
+	if err := json.Unmarshal(data, &images); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			line, col := lineAndColumn(data, syntaxErr.Offset)
+			return nil, fmt.Errorf("manifest %s:%d:%d: %w", path, line, col, err)
+		case errors.As(err, &typeErr):
+			line, col := lineAndColumn(data, typeErr.Offset)
+			return nil, fmt.Errorf("manifest %s:%d:%d: %w", path, line, col, err)
+		}
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+
+	for i, img := range images {
+		switch {
+		case img.ID == "":
+			return nil, fmt.Errorf("manifest %s: entry %d: missing id", path, i)
+		case img.DownloadURL == "":
+			return nil, fmt.Errorf("manifest %s: entry %d (id %s): missing download_url", path, i, img.ID)
+		}
+	}
+
+	return images, nil
+}
+
+// lineAndColumn converts a byte offset in data into a 1-based line and column.
+func lineAndColumn(data []byte, offset int64) (int, int) {
+	offset = min(max(offset, 0), int64(len(data)))
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
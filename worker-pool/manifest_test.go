@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeManifest saves content as a manifest file and returns its path.
+func writeManifest(tb testing.TB, content string) string {
+	tb.Helper()
+	path := filepath.Join(tb.TempDir(), "manifest.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadManifest(t *testing.T) {
+	path := writeManifest(t, `[
+  {"id": "0", "author": "Alejandro Escamilla", "width": 5000, "height": 3333,
+   "url": "https://unsplash.com/photos/yC-Yzbqy7PY", "download_url": "https://picsum.photos/id/0/5000/3333"},
+  {"id": "1", "author": "Paul Jarvis", "width": 2500, "height": 1667, "download_url": "https://picsum.photos/id/1/2500/1667"}
+]`)
+
+	images, err := loadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ImageMeta{
+		{ID: "0", Author: "Alejandro Escamilla", Width: 5000, Height: 3333,
+			URL: "https://unsplash.com/photos/yC-Yzbqy7PY", DownloadURL: "https://picsum.photos/id/0/5000/3333"},
+		{ID: "1", Author: "Paul Jarvis", Width: 2500, Height: 1667, DownloadURL: "https://picsum.photos/id/1/2500/1667"},
+	}
+	if !reflect.DeepEqual(images, want) {
+		t.Errorf("loadManifest() = %+v, want %+v", images, want)
+	}
+}
+
+func TestLoadManifestErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"syntax error", "[\n  {\"id\": \"0\",,}\n]", "manifest.json:2:"},
+		{"wrong type", "[\n  {\"id\": 7}\n]", "manifest.json:2:"},
+		{"missing id", `[{"download_url": "https://picsum.photos/id/0/10/10"}]`, "entry 0: missing id"},
+		{"missing download URL", `[{"id": "0"}, {"id": "1"}]`, "entry 0 (id 0): missing download_url"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadManifest(writeManifest(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("loadManifest() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := loadManifest(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing manifest loaded without an error")
+	}
+}
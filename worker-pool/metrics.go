@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the per-worker Prometheus collectors updated by imageProcessor.
+type Metrics struct {
+	processed *prometheus.CounterVec
+	failures  *prometheus.CounterVec
+	duration  *prometheus.HistogramVec
+}
+
+// NewMetrics creates the collectors and registers them with reg.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		processed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "images_processed_total",
+			Help: "Number of images processed, including failures.",
+		}, []string{"worker_id"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "image_failures_total",
+			Help: "Number of images that failed validation or download.",
+		}, []string{"worker_id"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "image_processing_seconds",
+			Help:    "Time spent processing a single image.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"worker_id"}),
+	}
+	reg.MustRegister(m.processed, m.failures, m.duration)
+	return m
+}
+
+// observe records result as processed by worker id. A nil Metrics is a no-op.
+func (m *Metrics) observe(id int, result Result) {
+	if m == nil {
+		return
+	}
+	worker := strconv.Itoa(id)
+	m.processed.WithLabelValues(worker).Inc()
+	if result.Error != nil {
+		m.failures.WithLabelValues(worker).Inc()
+	}
+	m.duration.WithLabelValues(worker).Observe(result.TimeSpent.Seconds())
+}
+
+// metricsShutdownTimeout bounds how long stopping the metrics server may take.
+const metricsShutdownTimeout = 5 * time.Second
+
+// serveMetrics starts an HTTP server exposing reg on /metrics at addr,
+// reporting server errors to logger. The returned function shuts it down.
+func serveMetrics(addr string, reg *prometheus.Registry, logger *slog.Logger) (func(), error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Metrics server failed", "error", err)
+		}
+	}()
+	logger.Info("Serving metrics", "addr", ln.Addr().String())
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Warn("Metrics server shutdown failed", "error", err)
+		}
+	}, nil
+}
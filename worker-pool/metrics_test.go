@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	srv := newStatusServer(t)
+	reg := prometheus.NewRegistry()
+	cfg := validateConfig(srv, 1, SliceSource{
+		{ID: "1", DownloadURL: srv.URL + "/ok"},
+		{ID: "2", DownloadURL: srv.URL + "/ok"},
+		{ID: "3", DownloadURL: srv.URL + "/missing"},
+	})
+	cfg.Metrics = NewMetrics(reg)
+	Run(cfg)
+
+	// Find a free port to serve on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	stop, err := serveMetrics(addr, reg, discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`images_processed_total{worker_id="1"} 3`,
+		`image_failures_total{worker_id="1"} 1`,
+		`image_processing_seconds_count{worker_id="1"} 3`,
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("metrics lack %s:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsCountCancelledJobs(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pool := NewWorkerPool(ctx, 1, WorkerOptions{
+		ValidateTimeout: time.Minute,
+		Metrics:         NewMetrics(reg),
+		Logger:          discardLogger(),
+	})
+	const jobs = 3
+	for i := range jobs {
+		pool.Submit(ImageMeta{ID: strconv.Itoa(i), DownloadURL: "http://images.invalid/" + strconv.Itoa(i)})
+	}
+	pool.Close()
+	for r := range pool.Results() {
+		if r.Status != StatusCancelled {
+			t.Errorf("image %s: status %v, want cancelled", r.ID, r.Status)
+		}
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			if c := m.GetCounter(); c != nil {
+				counts[f.GetName()] += c.GetValue()
+			}
+			if h := m.GetHistogram(); h != nil {
+				counts[f.GetName()] += float64(h.GetSampleCount())
+			}
+		}
+	}
+	for _, name := range []string{"images_processed_total", "image_failures_total", "image_processing_seconds"} {
+		if counts[name] != jobs {
+			t.Errorf("%s = %v, want every cancelled job counted", name, counts[name])
+		}
+	}
+}
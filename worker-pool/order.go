@@ -0,0 +1,132 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+)
+
+// imageOrders maps each -order value to the comparison it sorts jobs by.
+var imageOrders = map[string]func(a, b ImageMeta) int{
+	"id": func(a, b ImageMeta) int {
+		return cmp.Compare(a.ID, b.ID)
+	},
+	"author": func(a, b ImageMeta) int {
+		return cmp.Compare(a.Author, b.Author)
+	},
+	"size-asc": func(a, b ImageMeta) int {
+		return cmp.Compare(pixels(a), pixels(b))
+	},
+	"size-desc": func(a, b ImageMeta) int {
+		return cmp.Compare(pixels(b), pixels(a))
+	},
+}
+
+// pixels returns the image area, using int64 so large images cannot overflow.
+func pixels(img ImageMeta) int64 {
+	return int64(img.Width) * int64(img.Height)
+}
+
+// parseOrder returns the comparison for name, or nil when name is empty and
+// images should keep the source's order.
+func parseOrder(name string) (func(a, b ImageMeta) int, error) {
+	if name == "" {
+		return nil, nil
+	}
+	compare, ok := imageOrders[name]
+	if !ok {
+		names := make([]string, 0, len(imageOrders))
+		for n := range imageOrders {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		return nil, fmt.Errorf("unknown order %q, want one of %s", name, strings.Join(names, ", "))
+	}
+	return compare, nil
+}
+
+// SortedSource lists the images of Source sorted by Compare. Images with
+// equal keys keep their original relative order. Sorting needs the full
+// list, so nothing is sent until Source has finished listing.
+type SortedSource struct {
+	Source  ImageSource
+	Compare func(a, b ImageMeta) int
+}
+
+// Images implements ImageSource.
+func (s *SortedSource) Images(ctx context.Context) (<-chan ImageMeta, error) {
+	in, err := s.Source.Images(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan ImageMeta)
+	go func() {
+		defer close(out)
+		var images []ImageMeta
+		for img := range in {
+			images = append(images, img)
+		}
+		slices.SortStableFunc(images, s.Compare)
+
+		for _, img := range images {
+			select {
+			case out <- img:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Err implements ImageSource.
+func (s *SortedSource) Err() error {
+	return s.Source.Err()
+}
+
+// ShuffledSource lists the images of Source in a random order determined by
+// Seed, so the same seed and listing always give the same order. Like
+// SortedSource, nothing is sent until Source has finished listing.
+type ShuffledSource struct {
+	Source ImageSource
+	Seed   uint64
+}
+
+// Images implements ImageSource.
+func (s *ShuffledSource) Images(ctx context.Context) (<-chan ImageMeta, error) {
+	in, err := s.Source.Images(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan ImageMeta)
+	go func() {
+		defer close(out)
+		var images []ImageMeta
+		for img := range in {
+			images = append(images, img)
+		}
+		r := rand.New(rand.NewPCG(s.Seed, 0))
+		r.Shuffle(len(images), func(i, j int) {
+			images[i], images[j] = images[j], images[i]
+		})
+
+		for _, img := range images {
+			select {
+			case out <- img:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Err implements ImageSource.
+func (s *ShuffledSource) Err() error {
+	return s.Source.Err()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// orderFixture has distinct IDs, authors and sizes, with a tie in size
+// between b and d.
+var orderFixture = SliceSource{
+	{ID: "c", Author: "Bob", Width: 30, Height: 30},
+	{ID: "a", Author: "Dana", Width: 10, Height: 10},
+	{ID: "d", Author: "Alice", Width: 20, Height: 20},
+	{ID: "b", Author: "Carol", Width: 40, Height: 10},
+}
+
+// imageIDs returns the IDs of images in order.
+func imageIDs(images []ImageMeta) []string {
+	ids := make([]string, len(images))
+	for i, img := range images {
+		ids[i] = img.ID
+	}
+	return ids
+}
+
+func TestImageOrders(t *testing.T) {
+	for _, tt := range []struct {
+		order string
+		want  []string
+	}{
+		{"id", []string{"a", "b", "c", "d"}},
+		{"author", []string{"d", "c", "b", "a"}},
+		{"size-asc", []string{"a", "d", "b", "c"}}, // d and b tie, keeping listing order
+		{"size-desc", []string{"c", "d", "b", "a"}},
+	} {
+		compare, err := parseOrder(tt.order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		images := collectImages(t, context.Background(), &SortedSource{Source: orderFixture, Compare: compare})
+		if got := imageIDs(images); !slices.Equal(got, tt.want) {
+			t.Errorf("-order %s: %v, want %v", tt.order, got, tt.want)
+		}
+	}
+
+	if compare, err := parseOrder(""); compare != nil || err != nil {
+		t.Errorf("parseOrder(\"\") = %v, want no order", err)
+	}
+	if _, err := parseOrder("random"); err == nil {
+		t.Error("unknown order accepted")
+	}
+}
+
+func TestShuffledSourceSeed(t *testing.T) {
+	images := make(SliceSource, 50)
+	for i := range images {
+		images[i] = ImageMeta{ID: strconv.Itoa(i)}
+	}
+	shuffle := func(seed uint64) []string {
+		return imageIDs(collectImages(t, context.Background(), &ShuffledSource{Source: images, Seed: seed}))
+	}
+
+	first := shuffle(42)
+	if again := shuffle(42); !slices.Equal(first, again) {
+		t.Errorf("seed 42 gave %v, then %v", first, again)
+	}
+	if other := shuffle(43); slices.Equal(first, other) {
+		t.Error("seeds 42 and 43 gave the same order")
+	}
+	if slices.Equal(first, imageIDs(images)) {
+		t.Error("seed 42 kept the listing order")
+	}
+	if !slices.Equal(slices.Sorted(slices.Values(first)), slices.Sorted(slices.Values(imageIDs(images)))) {
+		t.Errorf("shuffle changed the set of images: %v", first)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// resultJSON is the wire representation of a Result.
+type resultJSON struct {
+	ID          string  `json:"id"`
+	Author      string  `json:"author"`
+	Size        string  `json:"size"`
+	Status      Status  `json:"status"`
+	Error       *string `json:"error"`
+	TimeSpentMS int64   `json:"time_spent_ms"`
+	EXIF        *EXIF   `json:"exif,omitempty"`
+
+	DimensionMismatch bool `json:"dimension_mismatch,omitempty"`
+}
+
+// MarshalJSON encodes the error as its message (or null) and the time spent
+// in milliseconds, since neither error nor time.Duration marshal usefully.
+func (r Result) MarshalJSON() ([]byte, error) {
+	out := resultJSON{
+		ID:          r.ID,
+		Author:      r.Author,
+		Size:        r.Size,
+		Status:      r.Status,
+		TimeSpentMS: r.TimeSpent.Milliseconds(),
+		EXIF:        r.EXIF,
+
+		DimensionMismatch: r.DimensionMismatch,
+	}
+	if r.Error != nil {
+		msg := r.Error.Error()
+		out.Error = &msg
+	}
+	return json.Marshal(out)
+}
+
+// resultFields lists the keys of resultJSON in the order they are written.
+var resultFields = jsonKeys(reflect.TypeFor[resultJSON]())
+
+// jsonKeys returns the JSON key of every field of the struct type t.
+func jsonKeys(t reflect.Type) []string {
+	keys := make([]string, 0, t.NumField())
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		keys = append(keys, name)
+	}
+	return keys
+}
+
+// parseFields splits a comma-separated list of result keys, as passed to
+// -fields, and checks each against resultFields. An empty list selects
+// every field and yields nil.
+func parseFields(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var fields []string
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		if !slices.Contains(resultFields, f) {
+			return nil, fmt.Errorf("unknown result field %q, want any of %s", f, strings.Join(resultFields, ", "))
+		}
+		if !slices.Contains(fields, f) {
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
+
+// projectedResult is a Result that marshals only the keys in fields, in the
+// order of resultFields. Keys left out of a Result's own encoding because
+// they are empty stay left out.
+type projectedResult struct {
+	Result
+	fields []string
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p projectedResult) MarshalJSON() ([]byte, error) {
+	data, err := p.Result.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, key := range resultFields {
+		value, ok := all[key]
+		if !ok || !slices.Contains(p.fields, key) {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%q:%s", key, value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// writeJSON writes results to w as a single indented JSON array. When
+// fields is non-nil, each result only includes those keys; see parseFields.
+func writeJSON(w io.Writer, results []Result, fields []string) error {
+	var out any = results
+	switch {
+	case fields != nil:
+		projected := make([]projectedResult, len(results))
+		for i, r := range results {
+			projected[i] = projectedResult{Result: r, fields: fields}
+		}
+		out = projected
+	case results == nil:
+		out = []Result{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		return fmt.Errorf("failed to write JSON results: %w", err)
+	}
+	return nil
+}
+
+// csvHeader lists the columns written by writeCSV.
+var csvHeader = []string{"id", "author", "width", "height", "success", "status", "time_spent_ms", "error"}
+
+// writeCSV writes a header followed by one row per result to w.
+func writeCSV(w io.Writer, results []Result) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return fmt.Errorf("failed to write CSV header: %w", err)
+	}
+
+	for _, r := range results {
+		var errMsg string
+		if r.Error != nil {
+			errMsg = r.Error.Error()
+		}
+		row := []string{
+			r.ID,
+			r.Author,
+			strconv.Itoa(r.Width),
+			strconv.Itoa(r.Height),
+			strconv.FormatBool(r.Status.OK()),
+			r.Status.String(),
+			strconv.FormatInt(r.TimeSpent.Milliseconds(), 10),
+			errMsg,
+		}
+		if err := cw.Write(row); err != nil {
+			return fmt.Errorf("failed to write CSV row for image %s: %w", r.ID, err)
+		}
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("failed to flush CSV: %w", err)
+	}
+	return nil
+}
+
+// writeCSVFile creates path and writes results to it as CSV. The file is
+// closed even when writing fails part way.
+func writeCSVFile(path string, results []Result) (err error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create CSV file %s: %w", path, err)
+	}
+	defer func() {
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("failed to close CSV file %s: %w", path, cerr)
+		}
+	}()
+
+	return writeCSV(file, results)
+}
+
+// checksumEntry is one image in the checksum manifest.
+type checksumEntry struct {
+	ID     string `json:"id"`
+	Path   string `json:"path,omitempty"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// writeChecksums writes a JSON array describing every image downloaded in
+// this run to w, so the saved files can be verified later. Cached and failed
+// images are left out, as nothing was downloaded for them.
+func writeChecksums(w io.Writer, results []Result) error {
+	entries := []checksumEntry{}
+	for _, r := range results {
+		if r.Error != nil || r.SHA256 == "" {
+			continue
+		}
+		entries = append(entries, checksumEntry{
+			ID:     r.ID,
+			Path:   r.Path,
+			Bytes:  r.FileBytes,
+			SHA256: r.SHA256,
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(entries); err != nil {
+		return fmt.Errorf("failed to write checksums: %w", err)
+	}
+	return nil
+}
+
+// writeChecksumFile creates path and writes the checksum manifest to it. The
+// file is closed even when writing fails part way.
+func writeChecksumFile(path string, results []Result) (err error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create checksum file %s: %w", path, err)
+	}
+	defer func() {
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("failed to close checksum file %s: %w", path, cerr)
+		}
+	}()
+
+	return writeChecksums(file, results)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteJSONRoundTrip(t *testing.T) {
+	results := []Result{
+		{ID: "1", Author: "Alice", Size: "10x20", Status: StatusSuccess, TimeSpent: 1500 * time.Millisecond},
+		{ID: "2", Author: "Bob", Size: "30x40", Status: StatusFailed, Error: errors.New("image 2 returned status 404")},
+	}
+
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, results, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Status only marshals, so it is decoded as its name.
+	type decoded struct {
+		ID          string  `json:"id"`
+		Author      string  `json:"author"`
+		Size        string  `json:"size"`
+		Status      string  `json:"status"`
+		Error       *string `json:"error"`
+		TimeSpentMS int64   `json:"time_spent_ms"`
+	}
+	var got []decoded
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("output is not valid JSON: %v\n%s", err, buf.Bytes())
+	}
+
+	msg := "image 2 returned status 404"
+	want := []decoded{
+		{ID: "1", Author: "Alice", Size: "10x20", Status: "success", TimeSpentMS: 1500},
+		{ID: "2", Author: "Bob", Size: "30x40", Status: "failed", Error: &msg},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteJSONEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(buf.String()); got != "[]" {
+		t.Errorf("writeJSON(nil) = %s, want []", got)
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	fields, err := parseFields(" status ,id,status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"status", "id"}; !slices.Equal(fields, want) {
+		t.Errorf("parseFields = %q, want %q without the duplicate", fields, want)
+	}
+	if fields, err := parseFields(""); fields != nil || err != nil {
+		t.Errorf("parseFields(\"\") = %q, %v, want every field", fields, err)
+	}
+	if _, err := parseFields("id,bogus"); err == nil || !strings.Contains(err.Error(), `"bogus"`) {
+		t.Errorf("parseFields with an unknown field = %v, want it named", err)
+	}
+}
+
+func TestWriteJSONFields(t *testing.T) {
+	results := []Result{
+		{ID: "1", Author: "Alice", Size: "10x20", Status: StatusSuccess, TimeSpent: time.Second},
+		{ID: "2", Author: "Bob", Status: StatusFailed, Error: errors.New("image 2 returned status 404")},
+	}
+	fields, err := parseFields("error,id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, results, fields); err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, buf.String())
+	}
+	want := []map[string]any{
+		{"id": "1", "error": nil},
+		{"id": "2", "error": "image 2 returned status 404"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("writeJSON with fields = %v, want %v", got, want)
+	}
+	// Keys follow resultFields, not the order they were listed in.
+	if first := strings.Index(buf.String(), `"id"`); first > strings.Index(buf.String(), `"error"`) {
+		t.Errorf("error written before id:\n%s", buf.String())
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	results := []Result{
+		{ID: "1", Author: "Alice, Jr.", Width: 10, Height: 20, Status: StatusSuccess, TimeSpent: 42 * time.Millisecond},
+		{ID: "2", Author: "Bob", Width: 30, Height: 40, Status: StatusFailed, Error: errors.New(`bad "quote"`)},
+	}
+
+	var buf bytes.Buffer
+	if err := writeCSV(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		csvHeader,
+		{"1", "Alice, Jr.", "10", "20", "true", "success", "42", ""},
+		{"2", "Bob", "30", "40", "false", "failed", "0", `bad "quote"`},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %q, want %q", rows, want)
+	}
+}
+
+func TestWriteChecksums(t *testing.T) {
+	fixtures := map[string][]byte{
+		"1": append(slices.Clone(fakeJPEG), "first"...),
+		"2": append(slices.Clone(fakeJPEG), "second"...),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := fixtures[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	// Image 3 is already stored, so it is cached rather than downloaded.
+	if err := os.WriteFile(filepath.Join(dir, "3.jpg"), fakeJPEG, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fixtures["3"] = fakeJPEG
+	results, _ := Run(Config{
+		WorkerOptions: WorkerOptions{
+			ValidateTimeout: time.Minute,
+			DownloadTimeout: time.Minute,
+			Download:        true,
+			OutputDir:       dir,
+			Client:          srv.Client(),
+			Logger:          discardLogger(),
+		},
+		Workers: 2,
+		Source:  fakeJobs(srv, 5), // Image 0 and 4 are missing.
+	})
+
+	var buf bytes.Buffer
+	if err := writeChecksums(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	var entries []checksumEntry
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(entries, func(a, b checksumEntry) int { return strings.Compare(a.ID, b.ID) })
+	if len(entries) != 2 || entries[0].ID != "1" || entries[1].ID != "2" {
+		t.Fatalf("manifest lists %+v, want only the downloaded images 1 and 2", entries)
+	}
+	for _, e := range entries {
+		sum := sha256.Sum256(fixtures[e.ID])
+		if e.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("image %s: checksum %s, want %x", e.ID, e.SHA256, sum)
+		}
+		if e.Bytes != int64(len(fixtures[e.ID])) {
+			t.Errorf("image %s: %d bytes, want %d", e.ID, e.Bytes, len(fixtures[e.ID]))
+		}
+		saved, err := os.ReadFile(e.Path)
+		if err != nil || !bytes.Equal(saved, fixtures[e.ID]) {
+			t.Errorf("image %s: path %s does not hold the fixture: %v", e.ID, e.Path, err)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// WorkerPool owns the jobs and results channels and a fixed set of workers
+// that process images concurrently.
+//
+// Both channels are small and bounded, so the pool never holds a whole batch
+// in memory. In exchange, results must be consumed while jobs are being
+// submitted: if nobody reads Results, workers block sending, the jobs buffer
+// fills up and Submit blocks too. Submit from one goroutine and range over
+// Results from another.
+//
+// Buffer sizes (WorkerOptions.JobBuffer and ResultBuffer) trade memory for
+// smoothing: a larger jobs buffer keeps workers busy while the source is
+// momentarily slow, and a larger results buffer keeps them from stalling
+// while the consumer is busy, at the cost of holding that many jobs or
+// results in memory. Beyond a few per worker there is little to gain, since
+// throughput is bounded by the workers themselves.
+//
+// Ordering: jobs are picked up in submission order, but results are delivered
+// in completion order, which varies with worker scheduling and network
+// latency. Callers needing submission order should match results by ID.
+type WorkerPool struct {
+	jobs    chan ImageMeta
+	shards  []chan ImageMeta // Per-worker job channels; nil unless sharded
+	results chan Result
+	wg      sync.WaitGroup
+	active  atomic.Int64  // Running workers; see Workers
+	closing chan struct{} // Closed by Close; nil unless autoscaling
+}
+
+// poolLayout selects how startWorkerPool dispatches jobs to workers.
+type poolLayout struct {
+	sharded   bool              // One jobs channel per worker; see NewShardedWorkerPool
+	autoscale *AutoscaleOptions // Varying worker count; see NewAutoscalingWorkerPool
+}
+
+// WorkerOptions controls how each worker processes a job.
+type WorkerOptions struct {
+	// ValidateTimeout bounds the validation request. DownloadTimeout bounds
+	// the download separately and should generally be larger, since fetching
+	// the full image takes longer than checking its status.
+	ValidateTimeout time.Duration
+	DownloadTimeout time.Duration
+	Download        bool          // Save images to Sink after validation; validate only when false
+	Sink            Sink          // Destination for downloads; a FileSink on OutputDir when nil
+	OutputDir       string        // Directory used by the default FileSink
+	Force           bool          // Re-download even if the output file already exists
+	MaxBytes        int64         // Largest accepted image in bytes; unlimited when not positive
+	DryRun          bool          // Log each job and report success without any network I/O
+	VerifyFiles     bool          // Check each job's stored file instead of requesting it; see verifyStoredFile
+	SkipValidate    bool          // With Download, download directly without a separate validation request
+	EXIF            bool          // With Download, decode EXIF metadata from downloaded JPEGs into Result.EXIF
+	Retries         int           // Maximum retries per request on transient failures
+	Client          *http.Client  // Client used for all requests; a default is used when nil
+	Limiter         *rate.Limiter // Shared limiter each request waits on; unlimited when nil
+	RetryBudget     *rate.Limiter // Shared budget each retry takes a token from; unlimited when nil
+	Bandwidth       *rate.Limiter // Shared byte budget every download body is read against; unlimited when nil
+	DownloadSlots   Semaphore     // Bounds concurrent disk writes across workers; unlimited when nil
+	InflightSlots   Semaphore     // Bounds concurrent HTTP requests, body included, across workers; unlimited when nil
+	Metrics         *Metrics      // Collectors updated after every job; disabled when nil
+	Logger          *slog.Logger  // Destination for per-job logs; slog.Default() when nil
+
+	// VerifyDimensions, with Download, decodes the real dimensions of each
+	// downloaded image and flags results whose dimensions differ from the
+	// metadata; see Result.DimensionMismatch.
+	VerifyDimensions bool
+
+	// CacheIndex, when set, makes stored images revalidate with a
+	// conditional request and records the validators of every download;
+	// see CacheIndex.
+	CacheIndex *CacheIndex
+
+	// HostSlots bounds concurrent HTTP requests to each host, keyed by the
+	// host of the image's DownloadURL; unlimited when nil. A request takes
+	// its host slot before one of InflightSlots.
+	HostSlots *HostSemaphore
+
+	// Breaker, when set, fast-fails requests with ErrCircuitOpen while the
+	// download host keeps failing; see CircuitBreaker.
+	Breaker *CircuitBreaker
+
+	// SizedTimeout, when set, replaces DownloadTimeout with a timeout
+	// derived from each image's dimensions, falling back to
+	// DownloadTimeout for images without them.
+	SizedTimeout *SizedTimeout
+
+	// Convert, with Download, names the format every image stored by the
+	// default FileSink is re-encoded in right after its download, "png" or
+	// "webp"; see convertResult. Images are kept as downloaded when empty.
+	Convert string
+
+	// RetryBaseDelay and RetryMaxDelay are the backoff before the first
+	// retry and the cap on its doubling; baseRetryDelay and maxRetryDelay
+	// when not positive.
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	// Clock times the delays between retries and of Stagger, Retry-After
+	// dates, the validate and download timeouts and StallThreshold; real
+	// time when nil.
+	Clock Clock
+
+	// Fsync makes the default FileSink flush every image to stable storage
+	// before reporting success; see FileSink.
+	Fsync bool
+
+	// Processor, when set, receives every downloaded image in place of Sink.
+	// Use MultiProcessor and SaveProcessor to keep saving images as well.
+	Processor Processor
+
+	// ShutdownGrace is how long in-flight jobs may keep running once the
+	// pool's context is cancelled, for example on interrupt, before they are
+	// cancelled too. Queued jobs are reported as cancelled right away either
+	// way, and a passed deadline or a run aborted by FailFast, MaxFailures or
+	// StopAfter cancels in-flight jobs without grace.
+	ShutdownGrace time.Duration
+
+	// StallThreshold, when positive, logs a warning for every worker that
+	// spends longer than this on a single job, retries included.
+	StallThreshold time.Duration
+
+	// Stagger, when positive, makes each worker wait a random delay of up
+	// to Stagger before taking its first job, so the first requests are
+	// spread out rather than all sent at once.
+	Stagger time.Duration
+
+	// JobBuffer and ResultBuffer are the capacities of the jobs and results
+	// channels; defaultBufferPerWorker per worker when not positive. A
+	// sharded pool splits JobBuffer evenly across the per-worker channels.
+	JobBuffer    int
+	ResultBuffer int
+
+	// NameTemplate names the files written by the default FileSink;
+	// <ID>.jpg when nil. See parseNameTemplate.
+	NameTemplate *template.Template
+
+	// OnCollision decides what the default FileSink does when two images
+	// resolve to the same file name; they overwrite each other by default.
+	OnCollision CollisionMode
+}
+
+// NewWorkerPool starts numWorkers workers that process jobs according to opts.
+// Cancelling ctx aborts in-flight jobs, after opts.ShutdownGrace if set, and
+// any job received afterwards is reported as cancelled without being processed.
+// The results channel is closed once all workers have finished.
+func NewWorkerPool(ctx context.Context, numWorkers int, opts WorkerOptions) *WorkerPool {
+	return startWorkerPool(ctx, numWorkers, opts, poolLayout{})
+}
+
+// NewShardedWorkerPool is like NewWorkerPool, but instead of sharing one jobs
+// channel each worker gets its own, and every job is routed to the worker
+// chosen by shardFor. The same ID therefore always lands on the same worker,
+// which makes runs reproducible when debugging worker-specific behaviour.
+// A slow job holds up every later job routed to the same worker.
+func NewShardedWorkerPool(ctx context.Context, numWorkers int, opts WorkerOptions) *WorkerPool {
+	return startWorkerPool(ctx, numWorkers, opts, poolLayout{sharded: true})
+}
+
+func startWorkerPool(ctx context.Context, numWorkers int, opts WorkerOptions, layout poolLayout) *WorkerPool {
+	if opts.Client == nil {
+		opts.Client = NewHTTPClient(ClientOptions{})
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	switch {
+	case opts.Processor != nil:
+		opts.Sink = opts.Processor
+	case opts.Sink == nil:
+		opts.Sink = &FileSink{
+			Dir:    opts.OutputDir,
+			Name:   opts.NameTemplate,
+			Sync:   opts.Fsync,
+			Claims: NewNameClaims(opts.OnCollision),
+		}
+	}
+
+	jobBuffer := bufferSize(opts.JobBuffer, numWorkers)
+	p := &WorkerPool{
+		results: make(chan Result, bufferSize(opts.ResultBuffer, numWorkers)),
+	}
+	if layout.sharded {
+		p.shards = make([]chan ImageMeta, numWorkers)
+	} else {
+		p.jobs = make(chan ImageMeta, jobBuffer)
+	}
+
+	jobCtx, cancelJobs := withShutdownGrace(ctx, opts.Logger, opts.ShutdownGrace)
+
+	var beats *heartbeats
+	stallDone := make(chan struct{})
+	if opts.StallThreshold > 0 {
+		beats = newHeartbeats(numWorkers, opts.Clock)
+		go watchStalls(opts.Logger, beats, opts.StallThreshold, stallDone)
+	}
+
+	// Fan-Out
+	if layout.autoscale != nil {
+		startScaler(ctx, jobCtx, p, numWorkers, *layout.autoscale, beats, opts)
+	}
+	for w := 1; w <= numWorkers && layout.autoscale == nil; w++ {
+		p.active.Add(1)
+		jobs := p.jobs
+		if layout.sharded {
+			jobs = make(chan ImageMeta, max(jobBuffer/numWorkers, 1))
+			p.shards[w-1] = jobs
+		}
+		p.wg.Add(1)
+		go imageProcessor(ctx, jobCtx, w, jobs, p.results, &p.wg, beats, opts)
+	}
+
+	// Fan-In
+	go func() {
+		p.wg.Wait()
+		p.active.Store(0)
+		cancelJobs()
+		close(stallDone)
+		close(p.results)
+	}()
+
+	return p
+}
+
+// withShutdownGrace returns the context jobs run under. When ctx is cancelled
+// gracefully (see gracefulCause) it stays alive for up to grace so in-flight
+// jobs can finish, and is then cancelled as well. It is cancelled together
+// with ctx when grace is not positive or ctx ends any other way, always with
+// ctx's cause, and never outlives ctx's deadline.
+func withShutdownGrace(ctx context.Context, logger *slog.Logger, grace time.Duration) (context.Context, context.CancelFunc) {
+	if grace <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	// Only cancellation is graceful; a deadline still applies to the jobs.
+	base := context.WithoutCancel(ctx)
+	cancelDeadline := context.CancelFunc(func() {})
+	if deadline, ok := ctx.Deadline(); ok {
+		base, cancelDeadline = context.WithDeadline(base, deadline)
+	}
+	jobCtx, cancel := context.WithCancelCause(base)
+
+	stop := context.AfterFunc(ctx, func() {
+		if !gracefulCause(context.Cause(ctx)) {
+			cancel(context.Cause(ctx))
+			return
+		}
+		logger.Warn("Shutting down, waiting for in-flight jobs", "grace", grace)
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			logger.Warn("Shutdown grace period elapsed, cancelling in-flight jobs")
+			cancel(context.Cause(ctx))
+		case <-jobCtx.Done():
+		}
+	})
+	return jobCtx, func() {
+		stop()
+		cancel(nil)
+		cancelDeadline()
+	}
+}
+
+// gracefulCause reports whether a context cancelled with cause may let its
+// in-flight jobs finish: a plain cancellation or an interrupt does, which
+// signal.NotifyContext reports with a cause of its own, while a passed
+// deadline or a run aborted on purpose does not.
+func gracefulCause(cause error) bool {
+	for _, abort := range []error{context.DeadlineExceeded, ErrFailFast, ErrTooManyFailures, ErrStopAfter} {
+		if errors.Is(cause, abort) {
+			return false
+		}
+	}
+	return true
+}
+
+// staggerStart waits for a random delay of up to opts.Stagger, timed by
+// opts.Clock, or until ctx is done.
+func staggerStart(ctx context.Context, opts WorkerOptions) {
+	if opts.Stagger <= 0 {
+		return
+	}
+	clock := opts.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	select {
+	case <-clock.After(rand.N(opts.Stagger)):
+	case <-ctx.Done():
+	}
+}
+
+// retryPolicy returns the retry policy for requests made for job.
+func (opts WorkerOptions) retryPolicy(job ImageMeta) retryPolicy {
+	return retryPolicy{
+		maxRetries: opts.Retries,
+		baseDelay:  opts.RetryBaseDelay,
+		maxDelay:   opts.RetryMaxDelay,
+		budget:     opts.RetryBudget,
+		logger:     opts.Logger.With("image_id", job.ID),
+		clock:      opts.Clock,
+	}
+}
+
+// defaultBufferPerWorker sizes each channel buffer per worker unless
+// overridden in WorkerOptions.
+const defaultBufferPerWorker = 2
+
+// bufferSize returns requested when positive, otherwise the default for
+// numWorkers workers.
+func bufferSize(requested, numWorkers int) int {
+	if requested > 0 {
+		return requested
+	}
+	return defaultBufferPerWorker * numWorkers
+}
+
+// shardFor returns the 1-based ID of the worker that handles id when the pool
+// is sharded across numWorkers workers.
+func shardFor(id string, numWorkers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32()%uint32(numWorkers)) + 1
+}
+
+// Submit queues a job for processing. It blocks while the jobs buffer is full,
+// so results must be consumed concurrently. Submit must not be called after Close.
+func (p *WorkerPool) Submit(job ImageMeta) {
+	if p.shards != nil {
+		p.shards[shardFor(job.ID, len(p.shards))-1] <- job
+		return
+	}
+	p.jobs <- job
+}
+
+// Results returns the channel on which every submitted job yields exactly one
+// Result, including jobs reported as cancelled. It must be read until closed,
+// or workers block forever sending to it; see Drain.
+func (p *WorkerPool) Results() <-chan Result {
+	return p.results
+}
+
+// ResultSplit carries the results of a pool on two channels, split by
+// whether their Status is OK. Cancelled jobs count as failures.
+type ResultSplit struct {
+	Successes <-chan Result
+	Failures  <-chan Result
+}
+
+// Split routes every result to the Successes or Failures channel of the
+// returned ResultSplit, closing both once Results is closed. It takes over
+// Results, which must not be read as well. As a result waits until its
+// channel is read, both channels must be read concurrently, for example in
+// one select loop, until both are closed.
+func (p *WorkerPool) Split() ResultSplit {
+	successes := make(chan Result)
+	failures := make(chan Result)
+	go func() {
+		defer close(successes)
+		defer close(failures)
+		for r := range p.results {
+			if r.Status.OK() {
+				successes <- r
+			} else {
+				failures <- r
+			}
+		}
+	}()
+	return ResultSplit{Successes: successes, Failures: failures}
+}
+
+// Drain discards results until Results is closed, so that every worker can
+// exit. Callers that stop reading Results early, for example on cancellation,
+// must call it; cancelling the pool's context first makes it return quickly,
+// as the remaining jobs are then reported as cancelled instead of processed.
+func (p *WorkerPool) Drain() {
+	for range p.results {
+	}
+}
+
+// Close signals that no more jobs will be submitted. Workers exit after
+// draining the remaining jobs, after which Results is closed.
+func (p *WorkerPool) Close() {
+	if p.closing != nil {
+		close(p.closing)
+	}
+	if p.shards != nil {
+		for _, shard := range p.shards {
+			close(shard)
+		}
+		return
+	}
+	close(p.jobs)
+}
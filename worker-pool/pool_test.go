@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os/signal"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// contextRecorder records the context of every request it passes on to base,
+// by URL path.
+type contextRecorder struct {
+	base http.RoundTripper
+	mu   sync.Mutex
+	ctxs map[string][]context.Context
+}
+
+func (t *contextRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.ctxs[req.URL.Path] = append(t.ctxs[req.URL.Path], req.Context())
+	t.mu.Unlock()
+	return t.base.RoundTrip(req)
+}
+
+func (t *contextRecorder) contexts(path string) []context.Context {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ctxs[path]
+}
+
+func TestPoolCancelsEachJobContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	client := srv.Client()
+	rec := &contextRecorder{base: client.Transport, ctxs: make(map[string][]context.Context)}
+	client.Transport = rec
+
+	// A single long-lived worker runs every job, so a job's timeout context
+	// is only released in time if it is cancelled as soon as the job is done,
+	// not when the worker exits.
+	const jobs = 50
+	pool := NewWorkerPool(context.Background(), 1, WorkerOptions{
+		ValidateTimeout: time.Hour,
+		Client:          client,
+		Logger:          discardLogger(),
+	})
+	go func() {
+		for i := range jobs {
+			pool.Submit(ImageMeta{ID: strconv.Itoa(i), DownloadURL: srv.URL + "/" + strconv.Itoa(i)})
+		}
+	}()
+	for range jobs {
+		result := <-pool.Results()
+		if result.Error != nil {
+			t.Errorf("image %s: %v", result.ID, result.Error)
+		}
+		ctxs := rec.contexts("/" + result.ID)
+		if len(ctxs) == 0 {
+			t.Errorf("image %s made no request", result.ID)
+		}
+		for _, ctx := range ctxs {
+			if ctx.Err() == nil {
+				t.Errorf("image %s: request context still live after its result was delivered", result.ID)
+			}
+		}
+	}
+	pool.Close()
+	pool.Drain()
+}
+
+func TestShutdownGraceOnInterrupt(t *testing.T) {
+	const grace = 200 * time.Millisecond
+	arrived := make(chan struct{}, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		wait := time.Duration(0) // The slow image never finishes by itself.
+		if r.URL.Path == "/fast" {
+			wait = grace / 4
+		}
+		if wait == 0 {
+			<-r.Context().Done()
+			return
+		}
+		time.Sleep(wait)
+	}))
+	defer srv.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT)
+	defer stop()
+	pool := NewWorkerPool(ctx, 2, WorkerOptions{
+		ValidateTimeout: time.Minute,
+		ShutdownGrace:   grace,
+		Client:          srv.Client(),
+		Logger:          discardLogger(),
+	})
+	pool.Submit(ImageMeta{ID: "fast", DownloadURL: srv.URL + "/fast"})
+	pool.Submit(ImageMeta{ID: "slow", DownloadURL: srv.URL + "/slow"})
+	pool.Close()
+	<-arrived
+	<-arrived
+
+	interrupted := time.Now()
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[string]Status)
+	for result := range pool.Results() {
+		statuses[result.ID] = result.Status
+	}
+	elapsed := time.Since(interrupted)
+
+	if statuses["fast"] != StatusSuccess {
+		t.Errorf("fast image finishing within the grace period is %v, want %v", statuses["fast"], StatusSuccess)
+	}
+	if statuses["slow"] != StatusCancelled {
+		t.Errorf("slow image outliving the grace period is %v, want %v", statuses["slow"], StatusCancelled)
+	}
+	if elapsed < grace || elapsed > grace+time.Second {
+		t.Errorf("in-flight jobs were cancelled %v after the interrupt, want about %v", elapsed, grace)
+	}
+}
+
+func TestShutdownGraceSkippedOnAbort(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	for _, cause := range []error{ErrFailFast, ErrTooManyFailures, ErrStopAfter} {
+		t.Run(cause.Error(), func(t *testing.T) {
+			ctx, cancel := context.WithCancelCause(context.Background())
+			pool := NewWorkerPool(ctx, 1, WorkerOptions{
+				ValidateTimeout: time.Minute,
+				ShutdownGrace:   time.Minute,
+				Client:          srv.Client(),
+				Logger:          discardLogger(),
+			})
+			pool.Submit(ImageMeta{ID: "slow", DownloadURL: srv.URL})
+			pool.Close()
+			time.AfterFunc(50*time.Millisecond, func() { cancel(cause) })
+
+			done := make(chan struct{})
+			go func() {
+				pool.Drain()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("pool waited for the grace period after an abort")
+			}
+		})
+	}
+}
+
+func TestPoolOneResultPerJob(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	const jobs = 100
+	pool := NewWorkerPool(context.Background(), 8, WorkerOptions{
+		ValidateTimeout: time.Minute,
+		Client:          srv.Client(),
+		Logger:          discardLogger(),
+	})
+	go func() {
+		for i := range jobs {
+			url := srv.URL
+			if i%3 == 0 {
+				url += "?fail=1"
+			}
+			pool.Submit(ImageMeta{ID: strconv.Itoa(i), DownloadURL: url})
+		}
+		pool.Close()
+	}()
+
+	seen := make(map[string]int)
+	for result := range pool.Results() {
+		seen[result.ID]++
+	}
+	for i := range jobs {
+		if n := seen[strconv.Itoa(i)]; n != 1 {
+			t.Errorf("image %d yielded %d results, want 1", i, n)
+		}
+	}
+	if len(seen) != jobs {
+		t.Errorf("got results for %d images, want %d", len(seen), jobs)
+	}
+}
+
+func TestPoolReturnsPromptlyAfterCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := NewWorkerPool(ctx, 4, WorkerOptions{
+		ValidateTimeout: time.Minute,
+		Client:          srv.Client(),
+		Logger:          discardLogger(),
+	})
+	const jobs = 20
+	go func() {
+		for i := range jobs {
+			pool.Submit(ImageMeta{ID: strconv.Itoa(i), DownloadURL: srv.URL})
+		}
+		pool.Close()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancelled := time.Now()
+	cancel()
+	got := 0
+	for result := range pool.Results() {
+		got++
+		if result.Status != StatusCancelled {
+			t.Errorf("image %s is %v, want %v", result.ID, result.Status, StatusCancelled)
+		}
+	}
+	if elapsed := time.Since(cancelled); elapsed > time.Second {
+		t.Errorf("workers took %v to return after cancel", elapsed)
+	}
+	if got != jobs {
+		t.Errorf("got %d results, want %d", got, jobs)
+	}
+}
+
+func TestShardedPoolRoutesIDsToFixedWorkers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	const workers, jobs = 4, 50
+	for run := range 3 {
+		pool := NewShardedWorkerPool(context.Background(), workers, WorkerOptions{
+			ValidateTimeout: time.Minute,
+			Client:          srv.Client(),
+			Logger:          discardLogger(),
+		})
+		go func() {
+			for i := range jobs {
+				pool.Submit(ImageMeta{ID: strconv.Itoa(i), DownloadURL: srv.URL})
+			}
+			pool.Close()
+		}()
+		for result := range pool.Results() {
+			if want := shardFor(result.ID, workers); result.Worker != want {
+				t.Errorf("run %d: image %s handled by worker %d, want %d", run, result.ID, result.Worker, want)
+			}
+		}
+	}
+}
+
+func TestShardFor(t *testing.T) {
+	used := make(map[int]bool)
+	for i := range 100 {
+		id := strconv.Itoa(i)
+		shard := shardFor(id, 4)
+		if shard < 1 || shard > 4 {
+			t.Fatalf("image %s sharded to worker %d, want 1..4", id, shard)
+		}
+		if again := shardFor(id, 4); again != shard {
+			t.Errorf("image %s sharded to worker %d, then %d", id, shard, again)
+		}
+		used[shard] = true
+	}
+	if len(used) != 4 {
+		t.Errorf("100 IDs used %d of 4 workers", len(used))
+	}
+}
+
+func TestDrainAfterCancelLeaksNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/0" && r.URL.Path != "/1" {
+			<-r.Context().Done()
+		}
+	}))
+	client := srv.Client()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := NewWorkerPool(ctx, 4, WorkerOptions{
+		ValidateTimeout: time.Minute,
+		Client:          client,
+		Logger:          discardLogger(),
+	})
+	submitted := make(chan struct{})
+	go func() {
+		defer close(submitted)
+		for i := range 50 {
+			pool.Submit(ImageMeta{ID: strconv.Itoa(i), DownloadURL: srv.URL + "/" + strconv.Itoa(i)})
+		}
+		pool.Close()
+	}()
+
+	// Stop reading part way, as a caller giving up on the run would.
+	<-pool.Results()
+	cancel()
+	pool.Drain()
+	<-submitted
+
+	client.CloseIdleConnections()
+	srv.Close()
+	checkGoroutines(t, before)
+}
+
+func TestPoolSmallBuffers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		name  string
+		start func(context.Context, int, WorkerOptions) *WorkerPool
+	}{
+		{"shared", NewWorkerPool},
+		{"sharded", NewShardedWorkerPool},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			const jobs = 500
+			pool := tt.start(context.Background(), 4, WorkerOptions{
+				ValidateTimeout: time.Minute,
+				JobBuffer:       1,
+				ResultBuffer:    1,
+				Client:          srv.Client(),
+				Logger:          discardLogger(),
+			})
+			go func() {
+				for i := range jobs {
+					pool.Submit(ImageMeta{ID: strconv.Itoa(i), DownloadURL: srv.URL})
+				}
+				pool.Close()
+			}()
+
+			done := make(chan int)
+			go func() {
+				got := 0
+				for range pool.Results() {
+					got++
+				}
+				done <- got
+			}()
+			select {
+			case got := <-done:
+				if got != jobs {
+					t.Errorf("got %d results, want %d", got, jobs)
+				}
+			case <-time.After(30 * time.Second):
+				t.Fatal("pool with buffers of 1 did not finish")
+			}
+		})
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	if got := bufferSize(0, 4); got != defaultBufferPerWorker*4 {
+		t.Errorf("default buffer for 4 workers is %d, want %d", got, defaultBufferPerWorker*4)
+	}
+	if got := bufferSize(1, 4); got != 1 {
+		t.Errorf("requested buffer of 1 is %d", got)
+	}
+}
+
+func TestPoolSplit(t *testing.T) {
+	srv := newStatusServer(t)
+	pool := NewWorkerPool(context.Background(), 4, WorkerOptions{
+		ValidateTimeout: time.Minute,
+		Client:          srv.Client(),
+		Logger:          discardLogger(),
+	})
+	const jobs = 60
+	go func() {
+		for i := range jobs {
+			path := "/ok"
+			if i%3 == 0 {
+				path = "/missing"
+			}
+			pool.Submit(ImageMeta{ID: strconv.Itoa(i), DownloadURL: srv.URL + path})
+		}
+		pool.Close()
+	}()
+
+	split := pool.Split()
+	successes, failures := split.Successes, split.Failures
+	seen := make(map[string]bool)
+	for successes != nil || failures != nil {
+		select {
+		case r, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			seen[r.ID] = true
+			if id, _ := strconv.Atoi(r.ID); id%3 == 0 || r.Error != nil {
+				t.Errorf("image %s (%v) was routed to Successes", r.ID, r.Status)
+			}
+		case r, ok := <-failures:
+			if !ok {
+				failures = nil
+				continue
+			}
+			seen[r.ID] = true
+			if id, _ := strconv.Atoi(r.ID); id%3 != 0 || r.Error == nil {
+				t.Errorf("image %s (%v) was routed to Failures", r.ID, r.Status)
+			}
+		}
+	}
+	if len(seen) != jobs {
+		t.Errorf("split delivered %d results, want %d", len(seen), jobs)
+	}
+}
+
+func TestStaggerSpreadsFirstRequests(t *testing.T) {
+	// Requests are held until released, so each worker makes exactly one.
+	var requests atomic.Int64
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	const workers = 4
+	clock := newFakeClock()
+	start := clock.Now()
+	pool := NewWorkerPool(context.Background(), workers, WorkerOptions{
+		ValidateTimeout: time.Minute,
+		Stagger:         time.Second,
+		Clock:           clock,
+		Client:          srv.Client(),
+		Logger:          discardLogger(),
+	})
+	defer pool.Drain()
+	for i := range workers {
+		pool.Submit(ImageMeta{ID: strconv.Itoa(i), DownloadURL: srv.URL})
+	}
+	pool.Close()
+
+	// Every worker waits its own delay before its first request.
+	clock.waitForWaiters(t, workers)
+	clock.mu.Lock()
+	var delays []time.Duration
+	for _, w := range clock.waiters {
+		delays = append(delays, w.at.Sub(start))
+	}
+	clock.mu.Unlock()
+	slices.Sort(delays)
+	for i, d := range delays {
+		if d < 0 || d >= time.Second {
+			t.Errorf("worker delay %s, want within [0, 1s)", d)
+		}
+		if i > 0 && d == delays[i-1] {
+			t.Errorf("two workers start after the same delay %s", d)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := requests.Load(); n != 0 {
+		t.Errorf("server got %d requests before any delay elapsed", n)
+	}
+
+	// Only the worker with the shortest delay starts once it has elapsed.
+	clock.Advance(delays[0])
+	deadline := time.Now().Add(5 * time.Second)
+	for requests.Load() < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := requests.Load(); n != 1 {
+		t.Errorf("server got %d requests after the shortest delay, want 1", n)
+	}
+
+	clock.Advance(time.Second)
+	for requests.Load() < workers && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := requests.Load(); n != workers {
+		t.Errorf("server got %d requests once every delay elapsed, want %d", n, workers)
+	}
+	close(release)
+	got := 0
+	for r := range pool.Results() {
+		if r.Error != nil {
+			t.Errorf("image %s: %v", r.ID, r.Error)
+		}
+		got++
+	}
+	if got != workers {
+		t.Errorf("got %d results, want %d", got, workers)
+	}
+}
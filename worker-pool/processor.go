@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Processor handles the content of a downloaded image as it streams in, for
+// example to generate a thumbnail or extract EXIF data. It must fully consume
+// body or return an error. Like a Sink, it only sees payloads that passed
+// content sniffing and the size limit.
+//
+// A Processor should work on body as it arrives rather than read it into
+// memory whole; see Sink. MultiProcessor hands each processor the body
+// through a pipe, so one that buffers holds the whole image even though the
+// others do not.
+//
+// Processor implements Sink, so any Processor can stand in for one. Unlike
+// FileSink it cannot tell whether an image is already stored or resume a
+// partial download, so every image is downloaded in full.
+type Processor func(ctx context.Context, meta ImageMeta, body io.Reader) error
+
+// Write implements Sink.
+func (p Processor) Write(ctx context.Context, meta ImageMeta, r io.Reader) error {
+	return p(ctx, meta, r)
+}
+
+// SaveProcessor returns the default download behaviour, storing each image in
+// s, as a Processor so it can be combined with others by MultiProcessor.
+func SaveProcessor(s Sink) Processor {
+	return s.Write
+}
+
+// MultiProcessor returns a Processor that streams every body to all of ps
+// concurrently, so the image is only downloaded once. A processor that
+// returns before reading everything does not hold up the others. The errors
+// of all failed processors are joined.
+func MultiProcessor(ps ...Processor) Processor {
+	return func(ctx context.Context, meta ImageMeta, body io.Reader) error {
+		writers := make([]io.Writer, len(ps))
+		pipes := make([]*io.PipeWriter, len(ps))
+		errs := make([]error, len(ps))
+
+		var wg sync.WaitGroup
+		for i, p := range ps {
+			pr, pw := io.Pipe()
+			writers[i], pipes[i] = pw, pw
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = p(ctx, meta, pr)
+				// Keep accepting data so the copy below never blocks on a
+				// processor that is done.
+				io.Copy(io.Discard, pr)
+			}()
+		}
+
+		_, err := io.Copy(io.MultiWriter(writers...), body)
+		for _, pw := range pipes {
+			pw.CloseWithError(err)
+		}
+		wg.Wait()
+
+		if err != nil {
+			return err
+		}
+		return errors.Join(errs...)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// byteCounter is a Processor recording how many bytes it read per image.
+type byteCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (c *byteCounter) process(ctx context.Context, meta ImageMeta, body io.Reader) error {
+	n, err := io.Copy(io.Discard, body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[meta.ID] = n
+	return err
+}
+
+func TestMultiProcessorCountsAndSaves(t *testing.T) {
+	// Each image gets a body of its own length.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(fakeJPEG)
+		w.Write([]byte(strings.Repeat("x", len(r.URL.Path))))
+	}))
+	defer srv.Close()
+
+	counter := &byteCounter{counts: make(map[string]int64)}
+	saved := NewMemorySink()
+	jobs := fakeJobs(srv, 20)
+	results, err := Run(Config{
+		WorkerOptions: WorkerOptions{
+			ValidateTimeout: time.Minute,
+			DownloadTimeout: time.Minute,
+			Download:        true,
+			Processor:       MultiProcessor(counter.process, SaveProcessor(saved)),
+			Client:          srv.Client(),
+			Logger:          discardLogger(),
+		},
+		Workers: 4,
+		Source:  jobs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(counter.counts) != len(jobs) || saved.Len() != len(jobs) {
+		t.Fatalf("counted %d and saved %d images, want %d", len(counter.counts), saved.Len(), len(jobs))
+	}
+	for _, r := range results {
+		want := int64(len(fakeJPEG) + len("/"+r.ID))
+		if got := counter.counts[r.ID]; got != want {
+			t.Errorf("image %s: counted %d bytes, want %d", r.ID, got, want)
+		}
+		if data, _ := saved.Get(r.ID); int64(len(data)) != want {
+			t.Errorf("image %s: saved %d bytes, want %d", r.ID, len(data), want)
+		}
+	}
+}
+
+func TestMultiProcessorJoinsErrors(t *testing.T) {
+	failure := errors.New("thumbnail failed")
+	quitter := func(ctx context.Context, meta ImageMeta, body io.Reader) error { return failure }
+	saved := NewMemorySink()
+	p := MultiProcessor(quitter, SaveProcessor(saved))
+
+	data := bytes.Repeat([]byte("x"), 1<<20)
+	err := p(context.Background(), ImageMeta{ID: "1"}, bytes.NewReader(data))
+	if !errors.Is(err, failure) {
+		t.Errorf("MultiProcessor() = %v, want the failing processor's error", err)
+	}
+	if got, _ := saved.Get("1"); !bytes.Equal(got, data) {
+		t.Errorf("processor returning early held up the others: saved %d of %d bytes", len(got), len(data))
+	}
+}
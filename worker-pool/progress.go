@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// progress counts submitted jobs and consumed results so they can be
+// reported periodically. The number of submitted jobs grows while the listing
+// is still being streamed.
+type progress struct {
+	submitted atomic.Int64
+	processed atomic.Int64
+	failed    atomic.Int64
+}
+
+// record counts result as processed, and as failed if its Status is
+// StatusFailed. Cancelled results are not failures, so the cancellations
+// that follow an aborted run do not add up in MaxFailures.
+func (p *progress) record(result Result) {
+	p.processed.Add(1)
+	if result.Status == StatusFailed {
+		p.failed.Add(1)
+	}
+}
+
+// log writes the current counts to logger.
+func (p *progress) log(logger *slog.Logger) {
+	logger.Info("Progress",
+		"processed", p.processed.Load(),
+		"submitted", p.submitted.Load(),
+		"failures", p.failed.Load(),
+	)
+}
+
+// startProgress logs p every interval until the returned stop function is
+// called. stop waits for the reporter goroutine to exit. A non-positive
+// interval disables reporting.
+func startProgress(logger *slog.Logger, p *progress, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				p.log(logger)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+	}
+}
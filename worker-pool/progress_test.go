@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartProgress(t *testing.T) {
+	logger, buf := bufferLogger()
+	var p progress
+	p.submitted.Store(3)
+	p.record(Result{Status: StatusSuccess})
+	p.record(Result{Status: StatusFailed})
+
+	stop := startProgress(logger, &p, 5*time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(buf.String(), "msg=Progress") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+
+	out := buf.String()
+	if !strings.Contains(out, "msg=Progress processed=2 submitted=3 failures=1") {
+		t.Errorf("no progress line with the counts:\n%s", out)
+	}
+	// Nothing is logged once stop has returned.
+	time.Sleep(20 * time.Millisecond)
+	if buf.String() != out {
+		t.Error("progress was logged after stop returned")
+	}
+}
+
+func TestStartProgressDisabled(t *testing.T) {
+	logger, buf := bufferLogger()
+	stop := startProgress(logger, &progress{}, 0)
+	time.Sleep(10 * time.Millisecond)
+	stop()
+	if buf.String() != "" {
+		t.Errorf("disabled progress logged:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// newRateLimiter returns a limiter shared by all workers that allows rps
+// requests per second, or nil (no limit) when rps is not positive.
+func newRateLimiter(rps float64) *rate.Limiter {
+	if rps <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(rps), 1)
+}
+
+// newRetryBudget returns a token bucket shared by all workers that allows
+// perMinute retries per minute in total, refilled evenly, or nil (no budget)
+// when perMinute is not positive. Under widespread failures this makes the
+// pool as a whole back off instead of every worker retrying on its own.
+func newRetryBudget(perMinute int) *rate.Limiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Every(time.Minute/time.Duration(perMinute)), perMinute)
+}
+
+// maxBandwidthBurst caps the bytes a bandwidth limiter releases at once, so
+// a throttled download proceeds in small steps instead of long pauses.
+const maxBandwidthBurst = 32 << 10
+
+// newBandwidthLimiter returns a limiter shared by all workers that allows
+// bytesPerSec bytes per second across every download combined, or nil (no
+// limit) when bytesPerSec is not positive.
+func newBandwidthLimiter(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(min(bytesPerSec, maxBandwidthBurst)))
+}
+
+// throttledReader paces reads from r to what limiter allows. A nil limiter
+// does not throttle.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.limiter == nil {
+		return t.r.Read(p)
+	}
+	if burst := t.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.limiter.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// waitForLimiter blocks until limiter permits another request or ctx is done.
+// A nil limiter never blocks.
+func waitForLimiter(ctx context.Context, limiter *rate.Limiter) error {
+	if limiter == nil {
+		return nil
+	}
+	return limiter.Wait(ctx)
+}
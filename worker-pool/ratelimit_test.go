@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterSpacesRequests(t *testing.T) {
+	if newRateLimiter(0) != nil || newRateLimiter(-1) != nil {
+		t.Error("newRateLimiter without a positive rate is not nil")
+	}
+
+	var mu sync.Mutex
+	var times []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	const rps = 20
+	_, err := Run(Config{
+		WorkerOptions: WorkerOptions{
+			ValidateTimeout: time.Minute,
+			Limiter:         newRateLimiter(rps),
+			Client:          srv.Client(),
+			Logger:          discardLogger(),
+		},
+		Workers: 4,
+		Source:  fakeJobs(srv, 6),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slices.SortFunc(times, time.Time.Compare)
+	for i := 1; i < len(times); i++ {
+		// Allow for the server noting requests a little after they were let through.
+		if gap := times[i].Sub(times[i-1]); gap < time.Second/rps*8/10 {
+			t.Errorf("requests %d and %d were %v apart, want about %v", i, i+1, gap, time.Second/rps)
+		}
+	}
+}
+
+func TestRetryBudgetExhausted(t *testing.T) {
+	if newRetryBudget(0) != nil {
+		t.Error("newRetryBudget(0) is not nil")
+	}
+
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	// Every image fails at once, wanting 3 retries each, but the whole run
+	// may only retry 5 times.
+	const jobs, budget = 10, 5
+	cfg := validateConfig(srv, jobs, fakeJobs(srv, jobs))
+	cfg.Retries = 3
+	cfg.RetryBaseDelay = time.Millisecond
+	cfg.RetryBudget = newRetryBudget(budget)
+	results, _ := Run(cfg)
+
+	if got := requests.Load(); got != jobs+budget {
+		t.Errorf("server got %d requests, want %d first attempts and %d retries", got, jobs, budget)
+	}
+	for _, r := range results {
+		if !errors.Is(r.Error, ErrRetryBudgetExhausted) {
+			t.Errorf("image %s: error %v, want ErrRetryBudgetExhausted", r.ID, r.Error)
+		}
+	}
+}
+
+func TestThrottledReaderRespectsRate(t *testing.T) {
+	if newBandwidthLimiter(0) != nil {
+		t.Error("newBandwidthLimiter(0) is not nil")
+	}
+
+	// Two concurrent downloads share the limit, so together they take as
+	// long as one download of both sizes would.
+	const rate, size = 1 << 20, 256 << 10
+	limiter := newBandwidthLimiter(rate)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := &throttledReader{ctx: context.Background(), r: bytes.NewReader(make([]byte, size)), limiter: limiter}
+			if n, err := io.Copy(io.Discard, r); n != size || err != nil {
+				t.Errorf("read %d bytes, %v", n, err)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// The first burst is free.
+	want := time.Duration(float64(2*size-maxBandwidthBurst) / rate * float64(time.Second))
+	if elapsed < want*9/10 || elapsed > want*3 {
+		t.Errorf("reading %d bytes at %d bytes/s took %v, want about %v", 2*size, rate, elapsed, want)
+	}
+}
+
+func TestThrottledReaderStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := &throttledReader{ctx: ctx, r: bytes.NewReader(make([]byte, 1<<20)), limiter: newBandwidthLimiter(1)}
+	if _, err := io.Copy(io.Discard, r); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled read = %v, want context.Canceled", err)
+	}
+}
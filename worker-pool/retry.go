@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// baseRetryDelay is the default backoff before the first retry; it doubles
+// on every subsequent attempt up to maxRetryDelay.
+const baseRetryDelay = 200 * time.Millisecond
+
+// maxRetryDelay is the default cap on the exponential backoff, so a long
+// deadline cannot make the spacing between retries grow without bound.
+const maxRetryDelay = 30 * time.Second
+
+// ErrRetryBudgetExhausted is wrapped by the error of an operation that would
+// have been retried but was denied by the shared retry budget.
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// retryableError marks a failure as transient, i.e. worth retrying.
+// A valid retryAfter, the Retry-After header of the response, overrides the
+// exponential backoff for the next attempt.
+type retryableError struct {
+	err        error
+	retryAfter string
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// retryable wraps err so that withRetry will try the operation again.
+func retryable(err error) error {
+	return &retryableError{err: err}
+}
+
+// isRetryable reports whether err, or any error it wraps, is marked retryable.
+func isRetryable(err error) bool {
+	var re *retryableError
+	return errors.As(err, &re)
+}
+
+// classifyRequestError marks err, returned by http.Client.Do, as retryable
+// unless retrying cannot help, as when the redirect cap was exceeded.
+func classifyRequestError(err error) error {
+	if errors.Is(err, ErrTooManyRedirects) {
+		return err
+	}
+	return retryable(err)
+}
+
+// isRetryableStatus reports whether an HTTP status code indicates a
+// transient server-side failure.
+func isRetryableStatus(code int) bool {
+	return code >= http.StatusInternalServerError
+}
+
+// classifyStatus marks err, which describes a non-200 resp, as retryable when
+// the status is transient. For 429 it honors the Retry-After header, which
+// withRetry interprets by its clock.
+func classifyStatus(resp *http.Response, err error) error {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return &retryableError{
+			err:        err,
+			retryAfter: resp.Header.Get("Retry-After"),
+		}
+	case isRetryableStatus(resp.StatusCode):
+		return retryable(err)
+	}
+	return err
+}
+
+// parseRetryAfter interprets a Retry-After header given either as delay
+// seconds or as an HTTP date. It returns 0 when the header is absent or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
+
+// retryPolicy controls how withRetry retries.
+type retryPolicy struct {
+	maxRetries int
+	baseDelay  time.Duration // Backoff before the first retry; baseRetryDelay when not positive
+	maxDelay   time.Duration // Cap on the backoff; maxRetryDelay when not positive
+	budget     *rate.Limiter // Shared retry budget; unlimited when nil
+	logger     *slog.Logger  // Receives a debug entry per retry; silent when nil
+	clock      Clock         // Times the delay between retries; real time when nil
+}
+
+// withRetry calls fn until it succeeds, returns a non-retryable error, or
+// p.maxRetries retries have been used. Retries are spaced by the server's
+// Retry-After when given, otherwise with capped exponential backoff and full
+// jitter, and stop as soon as ctx is done. Each retry also takes a token from
+// p.budget, when set, and the last error is returned wrapped in
+// ErrRetryBudgetExhausted if none are left. It returns the number of attempts
+// made along with the last error.
+func withRetry(ctx context.Context, p retryPolicy, fn func() error) (int, error) {
+	clock := p.clock
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	var attempts int
+	for {
+		attempts++
+		err := fn()
+
+		var re *retryableError
+		if err == nil || !errors.As(err, &re) || attempts > p.maxRetries || ctx.Err() != nil {
+			return attempts, err
+		}
+		if p.budget != nil && !p.budget.Allow() {
+			return attempts, fmt.Errorf("%w: %w", ErrRetryBudgetExhausted, err)
+		}
+
+		delay := parseRetryAfter(re.retryAfter, clock.Now())
+		if delay <= 0 {
+			delay = backoff(attempts, p.baseDelay, p.maxDelay)
+		}
+		if p.logger != nil {
+			p.logger.Debug("Retrying request",
+				"attempt", attempts+1,
+				"delay", delay,
+				"error", err,
+			)
+		}
+
+		select {
+		case <-ctx.Done():
+			return attempts, err
+		case <-clock.After(delay):
+		}
+	}
+}
+
+// backoff returns a random delay in [0, min(base*2^(attempt-1), maxDelay)),
+// using the package defaults for base and maxDelay when they are not positive.
+func backoff(attempt int, base, maxDelay time.Duration) time.Duration {
+	if base <= 0 {
+		base = baseRetryDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = maxRetryDelay
+	}
+
+	// Stop doubling once the cap is reached; this also avoids overflow.
+	d := base
+	for i := 1; i < attempt && d < maxDelay; i++ {
+		d *= 2
+	}
+	return rand.N(min(d, maxDelay))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWithRetryExhaustedByFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	failure := errors.New("transient")
+	calls := 0
+	type outcome struct {
+		attempts int
+		err      error
+	}
+	done := make(chan outcome)
+	go func() {
+		attempts, err := withRetry(context.Background(), retryPolicy{
+			maxRetries: 3,
+			baseDelay:  time.Hour,
+			maxDelay:   time.Hour,
+			clock:      clock,
+		}, func() error {
+			calls++
+			return retryable(failure)
+		})
+		done <- outcome{attempts, err}
+	}()
+
+	for range 3 {
+		clock.waitForWaiters(t, 1)
+		clock.Advance(time.Hour)
+	}
+	got := <-done
+	if got.attempts != 4 || calls != 4 {
+		t.Errorf("attempts = %d with %d calls, want 4", got.attempts, calls)
+	}
+	if !errors.Is(got.err, failure) {
+		t.Errorf("err = %v, want the last failure", got.err)
+	}
+}
+
+func TestRetryAfterDateByFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	resp := &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"Retry-After": {clock.Now().Add(10 * time.Second).Format(http.TimeFormat)}},
+	}
+	calls := make(chan struct{}, 2)
+	done := make(chan int)
+	go func() {
+		attempts, _ := withRetry(context.Background(), retryPolicy{maxRetries: 1, clock: clock}, func() error {
+			calls <- struct{}{}
+			return classifyStatus(resp, errors.New("too many requests"))
+		})
+		done <- attempts
+	}()
+
+	<-calls
+	clock.waitForWaiters(t, 1)
+	clock.Advance(9 * time.Second)
+	select {
+	case <-calls:
+		t.Fatal("retried before the Retry-After date")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	if attempts := <-done; attempts != 2 {
+		t.Errorf("attempts = %d, want 2", attempts)
+	}
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	result := processJob(context.Background(), 1, ImageMeta{ID: "1", DownloadURL: srv.URL}, WorkerOptions{
+		ValidateTimeout: time.Minute,
+		Retries:         3,
+		RetryBaseDelay:  time.Millisecond,
+		Client:          srv.Client(),
+		Logger:          discardLogger(),
+	})
+	if result.Error != nil {
+		t.Fatalf("validation failed: %v", result.Error)
+	}
+	if result.Attempts != 3 {
+		t.Errorf("Attempts = %d, want 3", result.Attempts)
+	}
+}
+
+func TestRetryAfterOn429(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+
+	clock := newFakeClock()
+	done := make(chan Result)
+	go func() {
+		done <- processJob(context.Background(), 1, ImageMeta{ID: "1", DownloadURL: srv.URL}, WorkerOptions{
+			ValidateTimeout: time.Minute,
+			Retries:         1,
+			RetryBaseDelay:  time.Hour, // Only Retry-After can make the retry come in time.
+			Client:          srv.Client(),
+			Clock:           clock,
+			Logger:          discardLogger(),
+		})
+	}()
+
+	// The validate timeout waits on the clock as well as the retry.
+	clock.waitForWaiters(t, 2)
+	clock.Advance(999 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("%d requests before Retry-After elapsed, want 1", n)
+	}
+	clock.Advance(time.Millisecond)
+	result := <-done
+	if result.Error != nil || result.Attempts != 2 {
+		t.Errorf("result = %d attempts, %v; want success on the second attempt", result.Attempts, result.Error)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"1", time.Second},
+		{"-5", 0},
+		{"soon", 0},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	} {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestBackoffNeverExceedsCap(t *testing.T) {
+	for _, tt := range []struct {
+		base, maxDelay, limit time.Duration
+	}{
+		{10 * time.Millisecond, time.Second, time.Second},
+		{time.Second, 30 * time.Second, 30 * time.Second},
+		{0, 0, maxRetryDelay}, // Package defaults
+		{time.Hour, time.Minute, time.Minute},
+	} {
+		var longest time.Duration
+		for attempt := 1; attempt <= 200; attempt++ {
+			for range 20 {
+				d := backoff(attempt, tt.base, tt.maxDelay)
+				if d < 0 || d >= tt.limit {
+					t.Fatalf("backoff(%d, %v, %v) = %v, want within [0, %v)", attempt, tt.base, tt.maxDelay, d, tt.limit)
+				}
+				longest = max(longest, d)
+			}
+		}
+		// Far past the cap, delays spread over the whole range.
+		if longest < tt.limit/2 {
+			t.Errorf("base %v, cap %v: longest delay %v, want close to the cap", tt.base, tt.maxDelay, longest)
+		}
+	}
+}
+
+func TestWithRetryLogsAttempts(t *testing.T) {
+	logger, logs := bufferLogger()
+	policy := retryPolicy{maxRetries: 3, baseDelay: time.Millisecond, maxDelay: 2 * time.Millisecond, logger: logger}
+	attempts, _ := withRetry(context.Background(), policy, func() error {
+		return retryable(errors.New("flaky"))
+	})
+	if attempts != 4 {
+		t.Fatalf("made %d attempts, want 4", attempts)
+	}
+
+	out := logs.String()
+	if n := strings.Count(out, "Retrying request"); n != 3 {
+		t.Errorf("logged %d retries, want 3:\n%s", n, out)
+	}
+	for _, attempt := range []string{"attempt=2", "attempt=3", "attempt=4"} {
+		if !strings.Contains(out, attempt) {
+			t.Errorf("no retry logged with %s:\n%s", attempt, out)
+		}
+	}
+	if !strings.Contains(out, "delay=") {
+		t.Errorf("retries logged without their delay:\n%s", out)
+	}
+}
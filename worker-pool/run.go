@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"regexp"
+	"time"
+)
+
+// ErrImageFailed is wrapped by every per-image error in the error returned
+// from RunContext.
+var ErrImageFailed = errors.New("image processing failed")
+
+// ErrListingFailed is wrapped by the error returned from RunContext when the
+// image source could not list images.
+var ErrListingFailed = errors.New("image listing failed")
+
+// ErrFailFast is the cause reported for images cancelled because another image
+// failed while Config.FailFast was set.
+var ErrFailFast = errors.New("fail-fast")
+
+// ErrTooManyFailures is the cause reported for images cancelled because
+// Config.MaxFailures images had already failed.
+var ErrTooManyFailures = errors.New("too many failures")
+
+// ErrStopAfter is the cause reported for images cancelled because
+// Config.StopAfter images had already succeeded.
+var ErrStopAfter = errors.New("stop-after target reached")
+
+// Config describes a complete run: where images come from and how the
+// worker pool should process them.
+type Config struct {
+	WorkerOptions
+	Workers int // Number of workers; NumCPU*2 when not positive
+	Limit   int // Number of images to list when Source is nil
+
+	// ClientOptions configure the client built for the run when Client is
+	// nil; they are ignored otherwise.
+	ClientOptions ClientOptions
+
+	// Source provides the images to process. When nil, Limit images are
+	// listed from the Picsum API, or from Lister when set.
+	Source ImageSource
+
+	// Lister replaces the Picsum API as the listing behind the default
+	// Source, keeping its paging, concurrency and retries; see
+	// PicsumSource. A StaticLister makes a run independent of the network.
+	Lister Lister
+
+	// MinWidth and MinHeight skip images smaller than these dimensions.
+	MinWidth  int
+	MinHeight int
+
+	// Author, when set, restricts the run to images whose author matches.
+	Author *regexp.Regexp
+
+	// Grayscale and Blur request Picsum's processed variants of each image
+	// by adding the matching modifiers to its download URL. Blur ranges
+	// from 1 to maxBlur and is off when 0; see validateBlur.
+	Grayscale bool
+	Blur      int
+
+	// PageConcurrency bounds how many listing pages the default Picsum
+	// source fetches at once; pages are fetched one at a time when not
+	// positive.
+	PageConcurrency int
+
+	// OnResult, when set, is called with every result as it completes. Calls
+	// are made one at a time from the goroutine running RunContext, so the callback
+	// need not be safe for concurrent use, but a slow callback stalls the pool.
+	OnResult func(Result)
+
+	// Sharded routes each image to a fixed worker; see NewShardedWorkerPool.
+	Sharded bool
+
+	// Autoscale, when set, varies the number of workers with the backlog
+	// instead, using Workers as the maximum; see NewAutoscalingWorkerPool.
+	// It cannot be combined with Sharded.
+	Autoscale *AutoscaleOptions
+
+	// Order, when set, sorts images before submission instead of processing
+	// them in listing order; see parseOrder.
+	Order func(a, b ImageMeta) int
+
+	// Shuffle processes images in a random order instead, for example so
+	// that FailFast is not biased towards the first images listed. Seed
+	// makes the order reproducible; a random seed is used, and logged, when
+	// it is 0. Shuffle and Order are mutually exclusive; Shuffle wins if
+	// both are set without calling Validate.
+	Shuffle bool
+	Seed    uint64
+
+	// FailFast cancels the run as soon as any image fails. Images that have
+	// not finished yet are reported as cancelled, without ShutdownGrace.
+	FailFast bool
+
+	// MaxFailures, when positive, cancels the run like FailFast once this
+	// many images have failed, to stop early when the service is clearly
+	// down. Images cancelled as a result do not count.
+	MaxFailures int
+
+	// StopAfter, when positive, cancels the run once this many images have
+	// succeeded, for example to sample a listing. Results that arrive after
+	// that, cancelled or not, are left out, so exactly StopAfter successes
+	// are returned; images already in flight may still have been saved.
+	StopAfter int
+
+	// TraceID identifies the run in every log line and through RunID; a
+	// random ID is generated when empty.
+	TraceID string
+
+	// RunTimeout aborts the whole run once elapsed, reporting unfinished
+	// images as cancelled; disabled when not positive.
+	RunTimeout time.Duration
+
+	// Stages transform results as they stream out of the pool, in order and
+	// before OnResult sees them, so work such as writing each result out
+	// overlaps with processing. See ResultStage and MapResults.
+	Stages []ResultStage
+
+	// Checkpoint, when set, skips the images it records as completed and
+	// records every image that succeeds, so an interrupted run can be
+	// resumed; see Checkpoint. Dry runs only skip, as they complete nothing.
+	// It cannot be combined with an ArchiveSink, which starts a new archive
+	// on every run.
+	Checkpoint *Checkpoint
+
+	// Warmup sends one HEAD request for the first image before any job is
+	// submitted, so the workers start on warm connections; see warmUp. It is
+	// skipped with DryRun and VerifyFiles, which make no requests.
+	Warmup bool
+
+	// ProgressInterval is how often a progress line is logged; disabled
+	// when not positive.
+	ProgressInterval time.Duration
+}
+
+// Run is RunContext with context.Background.
+func Run(cfg Config) ([]Result, error) {
+	return RunContext(context.Background(), cfg)
+}
+
+// RunContext streams images from cfg.Source through a WorkerPool and returns
+// every result. The error joins the ErrListingFailed-wrapped listing error,
+// if any, with one ErrImageFailed-wrapped error per failed image, or reports
+// why the run could not start at all. Results are in completion order, not
+// listing order.
+//
+// Every request and timeout derives from ctx: cancelling it stops listing,
+// aborts in-flight jobs (after cfg.ShutdownGrace, unless the context's
+// deadline passed) and reports the remaining ones as cancelled.
+func RunContext(ctx context.Context, cfg Config) ([]Result, error) {
+	numWorkers := resolveWorkers(cfg.Workers)
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+
+	// Every log line of the run, including those of the workers, carries
+	// the trace ID.
+	traceID := cfg.TraceID
+	if traceID == "" {
+		traceID = newTraceID()
+	}
+	ctx = withRunID(ctx, traceID)
+	cfg.Logger = cfg.Logger.With("trace_id", traceID)
+	logger := cfg.Logger
+
+	if cfg.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.RunTimeout)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// Logged before the default client is built, so that the options it is
+	// built from are part of the record.
+	logger.Info("Starting image downloader", "config", cfg)
+	if cfg.Client == nil {
+		cfg.Client = NewHTTPClient(cfg.ClientOptions)
+	}
+
+	if cfg.Download && cfg.Sink == nil && cfg.Processor == nil {
+		if err := ensureOutputDir(cfg.OutputDir); err != nil {
+			return nil, err
+		}
+	}
+
+	source := cfg.Source
+	if source == nil {
+		source = &PicsumSource{
+			Lister:      cfg.Lister,
+			Client:      cfg.Client,
+			Count:       cfg.Limit,
+			Concurrency: cfg.PageConcurrency,
+			Retries:     cfg.Retries,
+		}
+	}
+	switch {
+	case cfg.Shuffle:
+		// Filtering does not depend on the order, so shuffling the whole
+		// listing gives the same result as shuffling what passes the filters.
+		seed := cfg.Seed
+		if seed == 0 {
+			seed = rand.Uint64()
+		}
+		logger.Info("Shuffling images", "seed", seed)
+		source = &ShuffledSource{Source: source, Seed: seed}
+	case cfg.Order != nil:
+		source = &SortedSource{Source: source, Compare: cfg.Order}
+	}
+	images, err := source.Images(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrListingFailed, err)
+	}
+
+	// Duplicates would be processed twice and race on the same output file.
+	filters := []imageFilter{dedupFilter(logger)}
+	if f := minSizeFilter(logger, cfg.MinWidth, cfg.MinHeight); f != nil {
+		filters = append(filters, f)
+	}
+	keepAuthor, reportAuthors := authorFilter(logger, cfg.Author)
+	if keepAuthor != nil {
+		filters = append(filters, keepAuthor)
+	}
+	keepPending, reportResumed := checkpointFilter(logger, cfg.Checkpoint)
+	if keepPending != nil {
+		filters = append(filters, keepPending)
+	}
+
+	var pool *WorkerPool
+	switch {
+	case cfg.Autoscale != nil:
+		pool = NewAutoscalingWorkerPool(ctx, numWorkers, *cfg.Autoscale, cfg.WorkerOptions)
+	case cfg.Sharded:
+		pool = NewShardedWorkerPool(ctx, numWorkers, cfg.WorkerOptions)
+	default:
+		pool = NewWorkerPool(ctx, numWorkers, cfg.WorkerOptions)
+	}
+	prog := &progress{}
+
+	// Submit from a separate goroutine so results are consumed while jobs
+	// are still being listed and queued; otherwise a batch larger than the
+	// channel buffers would deadlock.
+	go func() {
+		defer pool.Close()
+		warm := cfg.Warmup && !cfg.DryRun && !cfg.VerifyFiles
+		for img := range images {
+			if !keepImage(img, filters) {
+				continue
+			}
+			if cfg.Grayscale || cfg.Blur > 0 {
+				img.DownloadURL = withPicsumEffects(img.DownloadURL, cfg.Grayscale, cfg.Blur)
+			}
+			if warm {
+				warm = false
+				warmUp(ctx, cfg.Client, img.DownloadURL, cfg.ValidateTimeout, logger)
+			}
+			pool.Submit(img)
+			prog.submitted.Add(1)
+		}
+		if reportAuthors != nil {
+			reportAuthors()
+		}
+		if reportResumed != nil {
+			reportResumed()
+		}
+	}()
+
+	stopProgress := startProgress(logger, prog, cfg.ProgressInterval)
+	defer stopProgress()
+
+	// The loop below reads every result, but if OnResult panics the workers
+	// must still be able to finish rather than block on a full channel.
+	// Draining the last stage drains every stage before it, and the pool.
+	stream := chainStages(pool.Results(), cfg.Stages...)
+	defer func() {
+		cancel(nil)
+		for range stream {
+		}
+	}()
+
+	// closing a channel only means "no more values will be sent to it."
+	// Reading from a closed channel is still safe.
+	var results []Result
+	var errs []error
+	var succeeded, discarded int
+	for result := range stream {
+		if cfg.StopAfter > 0 && succeeded >= cfg.StopAfter {
+			discarded++
+			continue
+		}
+		results = append(results, result)
+		prog.record(result)
+		if cfg.OnResult != nil {
+			cfg.OnResult(result)
+		}
+		switch result.Status {
+		case StatusSuccess, StatusCached:
+			logger.Debug("Image processed",
+				"image_id", result.ID,
+				"author", result.Author,
+				"size", result.Size,
+				"status", result.Status,
+				"time_spent", result.TimeSpent,
+			)
+			if err := cfg.Checkpoint.Mark(result.ID); err != nil {
+				logger.Warn("Failed to save checkpoint", "error", err)
+			}
+		case StatusSkipped:
+			// Dry runs complete nothing, so there is nothing to checkpoint.
+		case StatusFailed, StatusCancelled:
+			if cfg.FailFast && result.Status == StatusFailed && ctx.Err() == nil {
+				logger.Error("Failing fast, cancelling remaining images", "image_id", result.ID, "error", result.Error)
+				cancel(fmt.Errorf("%w: image %s failed", ErrFailFast, result.ID))
+			}
+			if cfg.MaxFailures > 0 && ctx.Err() == nil && prog.failed.Load() >= int64(cfg.MaxFailures) {
+				logger.Error("Failure threshold reached, cancelling remaining images", "failures", prog.failed.Load(), "max_failures", cfg.MaxFailures)
+				cancel(fmt.Errorf("%w: %d images failed", ErrTooManyFailures, prog.failed.Load()))
+			}
+			errs = append(errs, fmt.Errorf("%w: image %s: %w", ErrImageFailed, result.ID, result.Error))
+			logger.Warn("Image processing failed",
+				"image_id", result.ID,
+				"author", result.Author,
+				"status", result.Status,
+				"error", result.Error,
+				"time_spent", result.TimeSpent,
+			)
+		}
+		if result.Status.OK() {
+			succeeded++
+			if succeeded == cfg.StopAfter && ctx.Err() == nil {
+				logger.Info("Stop-after target reached, cancelling remaining images", "succeeded", succeeded)
+				cancel(fmt.Errorf("%w: %d images succeeded", ErrStopAfter, succeeded))
+			}
+		}
+	}
+	if discarded > 0 {
+		logger.Info("Discarded results beyond the stop-after target", "discarded", discarded)
+	}
+
+	// Saved even after an interrupt, which is when resuming matters most.
+	if err := cfg.Checkpoint.Save(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		logger.Warn("Run timeout reached", "run_timeout", cfg.RunTimeout)
+	}
+	if ctx.Err() != nil {
+		var abandoned int
+		for _, r := range results {
+			if r.Status == StatusCancelled {
+				abandoned++
+			}
+		}
+		logger.Info("Shutdown complete", "completed", len(results)-abandoned, "abandoned", abandoned)
+	}
+
+	// The listing error goes first so it is the most visible. Listing that
+	// merely stopped because the run was cancelled is not a failure of its own.
+	if err := source.Err(); err != nil && (ctx.Err() == nil || !errors.Is(err, ctx.Err())) {
+		errs = append([]error{fmt.Errorf("%w: %w", ErrListingFailed, err)}, errs...)
+	}
+	return results, errors.Join(errs...)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newStatusServer answers requests for /ok with 200 and everything else
+// with 404.
+func newStatusServer(tb testing.TB) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			http.NotFound(w, r)
+		}
+	}))
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+// validateConfig validates the images of source against srv with workers
+// workers.
+func validateConfig(srv *httptest.Server, workers int, source ImageSource) Config {
+	return Config{
+		WorkerOptions: WorkerOptions{
+			ValidateTimeout: time.Minute,
+			Client:          srv.Client(),
+			Logger:          discardLogger(),
+		},
+		Workers: workers,
+		Source:  source,
+	}
+}
+
+func TestRunErrImageFailed(t *testing.T) {
+	srv := newStatusServer(t)
+
+	_, err := Run(validateConfig(srv, 2, SliceSource{{ID: "1", DownloadURL: srv.URL + "/ok"}}))
+	if err != nil {
+		t.Errorf("all images succeeded, but Run() = %v", err)
+	}
+
+	_, err = Run(validateConfig(srv, 2, SliceSource{
+		{ID: "1", DownloadURL: srv.URL + "/ok"},
+		{ID: "2", DownloadURL: srv.URL + "/missing"},
+	}))
+	if !errors.Is(err, ErrImageFailed) {
+		t.Errorf("Run() = %v, want it to wrap ErrImageFailed", err)
+	}
+	if errors.Is(err, ErrListingFailed) {
+		t.Errorf("Run() = %v, want no listing failure", err)
+	}
+}
+
+func TestRunTinyResultBufferDoesNotDeadlock(t *testing.T) {
+	srv := newStatusServer(t)
+	jobs := make(SliceSource, 1000)
+	for i := range jobs {
+		jobs[i] = ImageMeta{ID: strconv.Itoa(i), DownloadURL: srv.URL + "/ok"}
+	}
+	cfg := validateConfig(srv, 8, jobs)
+	cfg.ResultBuffer = 1
+
+	done := make(chan []Result)
+	go func() {
+		results, _ := Run(cfg)
+		done <- results
+	}()
+	select {
+	case results := <-done:
+		if len(results) != len(jobs) {
+			t.Errorf("got %d results, want %d", len(results), len(jobs))
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("run with a results buffer of 1 did not finish")
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	cfg := validateConfig(srv, 2, fakeJobs(srv, 6))
+	cfg.RunTimeout = 50 * time.Millisecond
+	cfg.ShutdownGrace = time.Minute // A deadline does not wait for the grace period.
+	start := time.Now()
+	results, _ := Run(cfg)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("run took %v, want it to end at the run timeout", elapsed)
+	}
+	if len(results) != 6 {
+		t.Fatalf("got %d results, want 6", len(results))
+	}
+	for _, r := range results {
+		if r.Status != StatusCancelled {
+			t.Errorf("image %s is %v, want %v", r.ID, r.Status, StatusCancelled)
+		}
+	}
+}
+
+func TestRunOnResult(t *testing.T) {
+	srv := newStatusServer(t)
+	jobs := make(SliceSource, 100)
+	for i := range jobs {
+		url := srv.URL + "/ok"
+		if i%4 == 0 {
+			url = srv.URL + "/missing"
+		}
+		jobs[i] = ImageMeta{ID: strconv.Itoa(i), DownloadURL: url}
+	}
+	cfg := validateConfig(srv, 8, jobs)
+	var calls concurrencyTracker
+	seen := make(map[string]int)
+	cfg.OnResult = func(r Result) {
+		defer calls.enter()()
+		seen[r.ID]++ // Unsynchronized: calls must be sequential.
+		time.Sleep(time.Millisecond)
+	}
+
+	results, _ := Run(cfg)
+	if len(seen) != len(jobs) || len(results) != len(jobs) {
+		t.Errorf("OnResult saw %d images for %d results, want %d", len(seen), len(results), len(jobs))
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("OnResult called %d times for image %s, want 1", n, id)
+		}
+	}
+	if peak := calls.peak.Load(); peak != 1 {
+		t.Errorf("OnResult ran %d calls at once, want 1", peak)
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	started := make(chan struct{}, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan []Result)
+	go func() {
+		results, _ := RunContext(ctx, validateConfig(srv, 2, fakeJobs(srv, 20)))
+		done <- results
+	}()
+	<-started
+	<-started
+	cancel()
+
+	select {
+	case results := <-done:
+		// Listing stops too, so only the images submitted by then report.
+		if len(results) < 2 || len(results) > 20 {
+			t.Errorf("got %d results, want at least the 2 in flight", len(results))
+		}
+		for _, r := range results {
+			if r.Status != StatusCancelled {
+				t.Errorf("image %s is %v, want %v", r.ID, r.Status, StatusCancelled)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not stop after its context was cancelled")
+	}
+}
+
+func TestRunFailFast(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			http.NotFound(w, r)
+			return
+		}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	jobs := SliceSource{{ID: "bad", DownloadURL: srv.URL + "/bad"}}
+	for i := range 50 {
+		jobs = append(jobs, ImageMeta{ID: strconv.Itoa(i), DownloadURL: srv.URL + "/slow"})
+	}
+	cfg := validateConfig(srv, 2, jobs)
+	cfg.FailFast = true
+
+	done := make(chan []Result)
+	go func() {
+		results, _ := Run(cfg)
+		done <- results
+	}()
+	var results []Result
+	select {
+	case results = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("run did not stop after the first failure")
+	}
+
+	if len(results) == len(jobs) {
+		t.Errorf("all %d images were submitted, want listing to stop early", len(jobs))
+	}
+	for _, r := range results {
+		switch {
+		case r.ID == "bad":
+			if r.Status != StatusFailed {
+				t.Errorf("failing image is %v, want %v", r.Status, StatusFailed)
+			}
+		case r.Status != StatusCancelled:
+			t.Errorf("image %s is %v, want %v", r.ID, r.Status, StatusCancelled)
+		case !errors.Is(r.Error, ErrFailFast) || !strings.Contains(r.Error.Error(), "image bad failed"):
+			t.Errorf("image %s: error %v, want it to name the image that aborted the run", r.ID, r.Error)
+		}
+	}
+}
+
+func TestRunMaxFailures(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		time.Sleep(5 * time.Millisecond)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	const jobs, threshold = 200, 3
+	cfg := validateConfig(srv, 2, fakeJobs(srv, jobs))
+	cfg.MaxFailures = threshold
+	results, err := Run(cfg)
+
+	// Jobs in flight when the threshold is reached may still fail with their
+	// own 404 or be cancelled; either way every result is one of those.
+	var failed int
+	for _, r := range results {
+		switch {
+		case r.Status == StatusFailed:
+			failed++
+			if errors.Is(r.Error, ErrTooManyFailures) {
+				t.Errorf("image %s failed with the abort cause %v, want its own error", r.ID, r.Error)
+			}
+		case r.Status == StatusCancelled && errors.Is(r.Error, ErrTooManyFailures):
+		default:
+			t.Errorf("image %s: status %v, error %v, want failed or cancelled with ErrTooManyFailures", r.ID, r.Status, r.Error)
+		}
+	}
+	if failed < threshold {
+		t.Errorf("run stopped after %d failures, want at least %d", failed, threshold)
+	}
+	if n := requests.Load(); int64(failed) > n {
+		t.Errorf("%d images failed but the server only got %d requests", failed, n)
+	}
+	// Beyond the threshold only jobs already in flight or buffered may fail.
+	if n := requests.Load(); n > jobs/4 {
+		t.Errorf("server got %d of %d requests, want the run aborted early", n, jobs)
+	}
+	if !errors.Is(err, ErrImageFailed) {
+		t.Errorf("Run() = %v, want it to report the failed images", err)
+	}
+}
+
+func TestRunStopAfter(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		time.Sleep(2 * time.Millisecond)
+		if r.URL.Path != "/ok" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// Every third image fails, so failures are interleaved with successes.
+	const jobs, target = 300, 10
+	source := make(SliceSource, jobs)
+	for i := range source {
+		path := "/ok"
+		if i%3 == 2 {
+			path = "/missing"
+		}
+		source[i] = ImageMeta{ID: strconv.Itoa(i), DownloadURL: srv.URL + path}
+	}
+	cfg := validateConfig(srv, 4, source)
+	cfg.StopAfter = target
+	results, err := Run(cfg)
+	if len(results) == 0 {
+		t.Fatalf("Run() returned no results, error %v", err)
+	}
+
+	succeeded := 0
+	for _, r := range results {
+		if r.Status.OK() {
+			succeeded++
+		}
+	}
+	if succeeded != target {
+		t.Errorf("got %d successes, want exactly %d", succeeded, target)
+	}
+	if last := results[len(results)-1]; !last.Status.OK() {
+		t.Errorf("last result %s has status %v, want the results to end with the target success", last.ID, last.Status)
+	}
+	if n := requests.Load(); n > jobs/4 {
+		t.Errorf("server got %d of %d requests, want the run stopped early", n, jobs)
+	}
+	if !errors.Is(err, ErrImageFailed) {
+		t.Errorf("Run() = %v, want it to report the failures before the target", err)
+	}
+}
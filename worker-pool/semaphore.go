@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Semaphore bounds how many goroutines may hold it at once. A nil Semaphore
+// imposes no limit.
+type Semaphore chan struct{}
+
+// NewSemaphore returns a Semaphore with n slots, or nil (unlimited) when n is
+// not positive.
+func NewSemaphore(n int) Semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(Semaphore, n)
+}
+
+// Acquire blocks until a slot is free or ctx is done.
+func (s Semaphore) Acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken by a successful Acquire.
+func (s Semaphore) Release() {
+	if s == nil {
+		return
+	}
+	<-s
+}
+
+// HostSemaphore keeps a Semaphore of the same size per host, so requests to
+// one host are bounded without holding up requests to another. A nil
+// HostSemaphore imposes no limit.
+type HostSemaphore struct {
+	n     int
+	mu    sync.Mutex
+	hosts map[string]Semaphore
+}
+
+// NewHostSemaphore returns a HostSemaphore with n slots per host, or nil
+// (unlimited) when n is not positive.
+func NewHostSemaphore(n int) *HostSemaphore {
+	if n <= 0 {
+		return nil
+	}
+	return &HostSemaphore{n: n, hosts: make(map[string]Semaphore)}
+}
+
+// Acquire blocks until a slot for host is free or ctx is done.
+func (h *HostSemaphore) Acquire(ctx context.Context, host string) error {
+	if h == nil {
+		return nil
+	}
+	return h.host(host).Acquire(ctx)
+}
+
+// Release frees a slot for host taken by a successful Acquire.
+func (h *HostSemaphore) Release(host string) {
+	if h == nil {
+		return
+	}
+	h.host(host).Release()
+}
+
+// host returns the Semaphore for host, creating it on first use.
+func (h *HostSemaphore) host(host string) Semaphore {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.hosts[host]
+	if !ok {
+		s = NewSemaphore(h.n)
+		h.hosts[host] = s
+	}
+	return s
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDownloadSlotsSerializeWrites(t *testing.T) {
+	srv := newFakeImageServer(t, 0)
+	for _, tt := range []struct {
+		slots    Semaphore
+		wantPeak func(int64) bool
+	}{
+		{NewSemaphore(1), func(peak int64) bool { return peak == 1 }},
+		{nil, func(peak int64) bool { return peak > 1 }},
+	} {
+		sink := &trackingSink{delay: 10 * time.Millisecond}
+		_, err := Run(Config{
+			WorkerOptions: WorkerOptions{
+				ValidateTimeout: time.Minute,
+				DownloadTimeout: time.Minute,
+				Download:        true,
+				SkipValidate:    true,
+				Sink:            sink,
+				DownloadSlots:   tt.slots,
+				Client:          srv.Client(),
+				Logger:          discardLogger(),
+			},
+			Workers: 4,
+			Source:  fakeJobs(srv, 12),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if peak := sink.peak.Load(); !tt.wantPeak(peak) {
+			t.Errorf("%d download slots: %d writes overlapped", cap(tt.slots), peak)
+		}
+	}
+}
+
+func TestInflightSlotsBoundRequests(t *testing.T) {
+	var inflight concurrencyTracker
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer inflight.enter()()
+		time.Sleep(5 * time.Millisecond)
+		w.Write(fakeJPEG)
+	}))
+	defer srv.Close()
+
+	const limit = 3
+	_, err := Run(Config{
+		WorkerOptions: WorkerOptions{
+			ValidateTimeout: time.Minute,
+			DownloadTimeout: time.Minute,
+			Download:        true,
+			Sink:            discardSink{},
+			InflightSlots:   NewSemaphore(limit),
+			Client:          srv.Client(),
+			Logger:          discardLogger(),
+		},
+		Workers: 12,
+		Source:  fakeJobs(srv, 60),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peak := inflight.peak.Load(); peak != limit {
+		t.Errorf("%d workers made %d requests at once, want %d", 12, peak, limit)
+	}
+}
+
+func TestHostSlotsLimitEachHost(t *testing.T) {
+	if NewHostSemaphore(0) != nil {
+		t.Error("NewHostSemaphore(0) is not nil")
+	}
+
+	var total concurrencyTracker
+	newHost := func(tracker *concurrencyTracker) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer total.enter()()
+			defer tracker.enter()()
+			time.Sleep(5 * time.Millisecond)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	var a, b concurrencyTracker
+	hostA, hostB := newHost(&a), newHost(&b)
+
+	var jobs SliceSource
+	for i := range 20 {
+		srv := hostA
+		if i%2 == 1 {
+			srv = hostB
+		}
+		jobs = append(jobs, ImageMeta{ID: strconv.Itoa(i), DownloadURL: srv.URL})
+	}
+	cfg := validateConfig(hostA, 8, jobs)
+	cfg.HostSlots = NewHostSemaphore(1)
+	if _, err := Run(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.peak.Load() != 1 || b.peak.Load() != 1 {
+		t.Errorf("hosts saw %d and %d requests at once, want 1 each", a.peak.Load(), b.peak.Load())
+	}
+	if total.peak.Load() != 2 {
+		t.Errorf("%d requests ran at once across both hosts, want 2", total.peak.Load())
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Sink stores the content of downloaded images.
+//
+// Implementations should stream r to where it is stored, in chunks, rather
+// than reading it into memory whole: a body may be up to
+// WorkerOptions.MaxBytes long, and with every worker writing one at a time a
+// buffering sink holds that many bodies at once. The download path itself
+// never holds more than small fixed-size buffers of a body.
+type Sink interface {
+	// Write stores everything read from r as the content of meta. It must
+	// fully consume r or return an error.
+	Write(ctx context.Context, meta ImageMeta, r io.Reader) error
+}
+
+// storedChecker is implemented by sinks that can tell whether an image is
+// already stored, allowing the download to be skipped.
+type storedChecker interface {
+	Stored(meta ImageMeta) bool
+}
+
+// pathSink is implemented by sinks that store images at a file path, which is
+// then reported on the Result.
+type pathSink interface {
+	Path(meta ImageMeta) (string, error)
+}
+
+// resumableSink is implemented by sinks that can continue an interrupted
+// write, allowing downloads to resume with an HTTP Range request.
+type resumableSink interface {
+	// Partial returns the size and up to sniffLen leading bytes of an
+	// interrupted earlier write of meta, or a zero size when there is none.
+	Partial(meta ImageMeta) (size int64, head []byte, err error)
+	// OpenPartial opens the content of an interrupted earlier write of meta.
+	OpenPartial(meta ImageMeta) (io.ReadCloser, error)
+	// DiscardPartial drops an interrupted earlier write of meta.
+	DiscardPartial(meta ImageMeta) error
+	// WriteFrom continues the write of meta at offset (0 starts over). When
+	// keepPartial is set, a retryable read error leaves the partial write in
+	// place for a later call to resume.
+	WriteFrom(ctx context.Context, meta ImageMeta, r io.Reader, offset int64, keepPartial bool) error
+}
+
+// FileSink saves images as <Dir>/<name>, where name is rendered from Name, or
+// is <ID>.jpg when Name is nil. Files are written atomically via a
+// <name>.tmp file, which is also what interrupted downloads resume from.
+// Dir must already exist; see ensureOutputDir.
+//
+// With Sync set, every file and the directory entry created by its rename are
+// flushed to stable storage before Write returns, so saved images survive a
+// crash or power loss. This costs at least one disk flush per image, which
+// can cut throughput sharply on slow disks.
+type FileSink struct {
+	Dir    string
+	Name   *template.Template // File name template; see parseNameTemplate
+	Sync   bool
+	Claims *NameClaims // Resolves images sharing a file name; nil lets them overwrite each other
+}
+
+// Path returns the file meta is saved as.
+func (s *FileSink) Path(meta ImageMeta) (string, error) {
+	name := meta.ID + ".jpg"
+	if s.Name != nil {
+		var err error
+		if name, err = renderFileName(s.Name, meta); err != nil {
+			return "", err
+		}
+	}
+	name, err := s.Claims.Claim(meta.ID, name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Dir, name), nil
+}
+
+// parseNameTemplate parses a text/template for file names, such as
+// "{{.Author}}-{{.ID}}.jpg", whose data is the image's ImageMeta. The
+// template is rendered once against an empty ImageMeta so that references to
+// unknown fields are reported now rather than on the first download.
+// Templates that map different images to the same name make them overwrite
+// each other unless a NameClaims resolves the collision.
+func parseNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("name").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template: %w", err)
+	}
+	if err := tmpl.Execute(io.Discard, ImageMeta{}); err != nil {
+		return nil, fmt.Errorf("invalid name template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// renderFileName renders tmpl for meta and sanitizes the result into a
+// single path element.
+func renderFileName(tmpl *template.Template, meta ImageMeta) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, meta); err != nil {
+		return "", fmt.Errorf("failed to render file name for image %s: %w", meta.ID, err)
+	}
+	name := sanitizeFileName(b.String())
+	if name == "" {
+		return "", fmt.Errorf("file name for image %s is empty", meta.ID)
+	}
+	return name, nil
+}
+
+// sanitizeFileName replaces path separators, characters that are illegal in
+// file names on common filesystems, and control characters with '_', then
+// trims the spaces and dots some filesystems reject at either end. This also
+// rules out "." and "..".
+func sanitizeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	return strings.Trim(name, " .")
+}
+
+// Write implements Sink.
+func (s *FileSink) Write(ctx context.Context, meta ImageMeta, r io.Reader) error {
+	return s.WriteFrom(ctx, meta, r, 0, false)
+}
+
+// Stored reports whether a non-empty file for meta already exists.
+func (s *FileSink) Stored(meta ImageMeta) bool {
+	path, err := s.Path(meta)
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular() && fi.Size() > 0
+}
+
+// Partial returns the size and leading bytes of meta's temporary file.
+func (s *FileSink) Partial(meta ImageMeta) (int64, []byte, error) {
+	path, err := s.Path(meta)
+	if err != nil {
+		return 0, nil, err
+	}
+	tmpPath := path + ".tmp"
+	fi, err := os.Stat(tmpPath)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() == 0 {
+		return 0, nil, nil
+	}
+	head, err := readHead(tmpPath, sniffLen)
+	if err != nil {
+		return 0, nil, err
+	}
+	return fi.Size(), head, nil
+}
+
+// OpenPartial opens meta's temporary file.
+func (s *FileSink) OpenPartial(meta ImageMeta) (io.ReadCloser, error) {
+	path, err := s.Path(meta)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path + ".tmp")
+}
+
+// DiscardPartial removes meta's temporary file, if any.
+func (s *FileSink) DiscardPartial(meta ImageMeta) error {
+	path, err := s.Path(meta)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path + ".tmp")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// WriteFrom implements resumableSink; see saveFile.
+func (s *FileSink) WriteFrom(ctx context.Context, meta ImageMeta, r io.Reader, offset int64, keepPartial bool) error {
+	path, err := s.Path(meta)
+	if err != nil {
+		return err
+	}
+	return saveFile(path, r, offset, keepPartial, s.Sync)
+}
+
+// saveFile copies r into path via a temporary <path>.tmp file that is renamed
+// into place only once the copy has fully succeeded, so a file at path is
+// always complete. A positive offset appends to an existing temporary file
+// instead of truncating it. The temporary file is removed on any error, except
+// that a retryable read error leaves it in place when keepPartial is set.
+// When sync is set, the file is fsynced before the rename and the directory
+// after it.
+func saveFile(path string, r io.Reader, offset int64, keepPartial, sync bool) (err error) {
+	tmpPath := path + ".tmp"
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(tmpPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			file.Close()
+			if !keepPartial || !isRetryable(err) {
+				os.Remove(tmpPath)
+			}
+		}
+	}()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+	if sync {
+		if err := syncFile(file); err != nil {
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	if sync {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// syncDir flushes the directory dir, making renames within it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return syncFile(d)
+}
+
+// syncFile flushes file to stable storage. It is a variable so tests can
+// observe which files are flushed.
+var syncFile = (*os.File).Sync
+
+// readHead returns up to n leading bytes of the file at path.
+func readHead(path string, n int) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, n)
+	read, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return head[:read], nil
+}
+
+// MemorySink keeps image content in memory, keyed by image ID. It is safe for
+// concurrent use. As it holds every image of the run, it suits tests and
+// small runs only.
+type MemorySink struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// NewMemorySink returns an empty MemorySink.
+func NewMemorySink() *MemorySink {
+	return &MemorySink{files: make(map[string][]byte)}
+}
+
+// Write implements Sink. Content is only stored once r is fully read.
+func (s *MemorySink) Write(ctx context.Context, meta ImageMeta, r io.Reader) error {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[meta.ID] = buf.Bytes()
+	return nil
+}
+
+// Get returns the content stored for id.
+func (s *MemorySink) Get(id string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[id]
+	return data, ok
+}
+
+// Len returns the number of images stored.
+func (s *MemorySink) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files)
+}
+
+// errTooLarge reports a payload exceeding the configured maximum size.
+var errTooLarge = errors.New("payload exceeds the maximum size")
+
+// downloadReader wraps a response body on its way into a Sink. It counts the
+// bytes read, fails with errTooLarge once more than limit bytes have been
+// read (unless limit is negative), and marks other read errors retryable.
+// When expected is not negative, a body ending before expected bytes is
+// reported as a retryable truncation rather than io.EOF, so the sink never
+// commits a short file.
+type downloadReader struct {
+	r        io.Reader
+	n        int64
+	limit    int64
+	expected int64
+}
+
+func (d *downloadReader) Read(p []byte) (int, error) {
+	// Read one byte past the cap so an oversized payload can be told apart
+	// from one that is exactly limit bytes long.
+	if d.limit >= 0 && int64(len(p)) > d.limit-d.n+1 {
+		p = p[:d.limit-d.n+1]
+	}
+
+	n, err := d.r.Read(p)
+	d.n += int64(n)
+	if d.limit >= 0 && d.n > d.limit {
+		return n, fmt.Errorf("%w of %d bytes", errTooLarge, d.limit)
+	}
+	if err == io.EOF && d.expected >= 0 && d.n < d.expected {
+		return n, retryable(fmt.Errorf("body truncated after %d of %d bytes", d.n, d.expected))
+	}
+	if err != nil && err != io.EOF {
+		err = retryable(err)
+	}
+	return n, err
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnsureOutputDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "nested", "images")
+	if err := ensureOutputDir(dir); err != nil {
+		t.Fatalf("creating %s: %v", dir, err)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Fatalf("%s was not created as a directory: %v", dir, err)
+	}
+	if err := ensureOutputDir(dir); err != nil {
+		t.Errorf("existing directory: %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := ensureOutputDir(file)
+	if err == nil || !strings.Contains(err.Error(), "exists but is not a directory") {
+		t.Errorf("ensureOutputDir(file) = %v, want it rejected as not a directory", err)
+	}
+}
+
+func TestFileSinkWrite(t *testing.T) {
+	dir := t.TempDir()
+	sink := &FileSink{Dir: dir}
+	if err := sink.Write(context.Background(), ImageMeta{ID: "1"}, strings.NewReader("image data")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "1.jpg"))
+	if err != nil || string(data) != "image data" {
+		t.Errorf("1.jpg = %q, %v, want the written data", data, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("output directory holds %d entries, want only 1.jpg", len(entries))
+	}
+}
+
+func TestFileSinkStored(t *testing.T) {
+	dir := t.TempDir()
+	sink := &FileSink{Dir: dir}
+	if sink.Stored(ImageMeta{ID: "1"}) {
+		t.Error("missing file reported as stored")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "empty.jpg"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if sink.Stored(ImageMeta{ID: "empty"}) {
+		t.Error("empty file reported as stored")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "1.jpg"), []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !sink.Stored(ImageMeta{ID: "1"}) {
+		t.Error("existing file not reported as stored")
+	}
+}
+
+func TestForceRedownloadsStoredFile(t *testing.T) {
+	srv := newFakeImageServer(t, 0)
+	for _, force := range []bool{false, true} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "1.jpg")
+		if err := os.WriteFile(path, []byte("old"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		result := processJob(context.Background(), 1, ImageMeta{ID: "1", DownloadURL: srv.URL}, WorkerOptions{
+			ValidateTimeout: time.Minute,
+			DownloadTimeout: time.Minute,
+			Download:        true,
+			Force:           force,
+			Sink:            &FileSink{Dir: dir},
+			Client:          srv.Client(),
+			Logger:          discardLogger(),
+		})
+		if result.Error != nil {
+			t.Fatalf("force=%t: %v", force, result.Error)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if downloaded := !bytes.Equal(data, []byte("old")); downloaded != force {
+			t.Errorf("force=%t: file downloaded again = %t", force, downloaded)
+		}
+		if cached := result.Status == StatusCached; cached == force {
+			t.Errorf("force=%t: status %v", force, result.Status)
+		}
+	}
+}
+
+// failingReader yields data and then fails with err.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestSaveFileFailingReader(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		err         error
+		keepPartial bool
+		wantPartial bool
+	}{
+		{"permanent error", errors.New("broken"), true, false},
+		{"retryable error", retryable(errors.New("reset")), false, false},
+		{"retryable error kept for resuming", retryable(errors.New("reset")), true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "1.jpg")
+			err := saveFile(path, &failingReader{data: []byte("partial"), err: tt.err}, 0, tt.keepPartial, false)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("saveFile() = %v, want %v", err, tt.err)
+			}
+			if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("final file exists after a failed copy: %v", err)
+			}
+			if _, err := os.Stat(path + ".tmp"); (err == nil) != tt.wantPartial {
+				t.Errorf("partial file kept = %t, want %t", err == nil, tt.wantPartial)
+			}
+		})
+	}
+}
+
+func TestMemorySink(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(append(slices.Clip(fakeJPEG), r.URL.Path...))
+	}))
+	defer srv.Close()
+
+	sink := NewMemorySink()
+	_, err := Run(Config{
+		WorkerOptions: WorkerOptions{
+			ValidateTimeout: time.Minute,
+			DownloadTimeout: time.Minute,
+			Download:        true,
+			Sink:            sink,
+			Client:          srv.Client(),
+			Logger:          discardLogger(),
+		},
+		Workers: 3,
+		Source:  fakeJobs(srv, 6),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sink.Len() != 6 {
+		t.Errorf("sink holds %d images, want 6", sink.Len())
+	}
+	for i := range 6 {
+		id := strconv.Itoa(i)
+		data, ok := sink.Get(id)
+		if !ok || !bytes.Equal(data, append(slices.Clip(fakeJPEG), "/"+id...)) {
+			t.Errorf("image %s: stored %d bytes (found %t), want its own content", id, len(data), ok)
+		}
+	}
+	if _, ok := sink.Get("missing"); ok {
+		t.Error("Get of an unknown ID found content")
+	}
+}
+
+func TestRenderFileName(t *testing.T) {
+	tmpl, err := parseNameTemplate("{{.Author}}-{{.ID}}-{{.Width}}.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := ImageMeta{ID: "7", Author: "AC/DC \\ Fans: a|b?", Width: 640}
+	name, err := renderFileName(tmpl, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "AC_DC _ Fans_ a_b_-7-640.jpg"; name != want {
+		t.Errorf("rendered %q, want %q", name, want)
+	}
+
+	sink := &FileSink{Dir: t.TempDir(), Name: tmpl}
+	if err := sink.Write(context.Background(), meta, strings.NewReader("image data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(sink.Dir, name)); err != nil {
+		t.Errorf("author with slashes escaped the output directory: %v", err)
+	}
+
+	if _, err := parseNameTemplate("{{.Missing}}"); err == nil {
+		t.Error("template with an unknown field accepted")
+	}
+	dots, err := parseNameTemplate("{{.Author}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renderFileName(dots, ImageMeta{ID: "8", Author: ".."}); err == nil {
+		t.Error(`name ".." accepted`)
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	for in, want := range map[string]string{
+		"plain.jpg":      "plain.jpg",
+		"a/b/c.jpg":      "a_b_c.jpg",
+		`..\..\evil.jpg`: "_.._evil.jpg",
+		" .hidden. ":     "hidden",
+		"tab\there":      "tab_here",
+		"..":             "",
+	} {
+		if got := sanitizeFileName(in); got != want {
+			t.Errorf("sanitizeFileName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDownloadReaderTruncation(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		expected  int64
+		truncated bool
+	}{
+		{"longer Content-Length", 20, true},
+		{"exact Content-Length", 10, false},
+		{"unknown length", -1, false},
+	} {
+		r := &downloadReader{r: strings.NewReader("0123456789"), limit: -1, expected: tt.expected}
+		n, err := io.Copy(io.Discard, r)
+		if n != 10 {
+			t.Errorf("%s: read %d bytes, want 10", tt.name, n)
+		}
+		if !tt.truncated {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !isRetryable(err) || !strings.Contains(err.Error(), "truncated after 10 of 20 bytes") {
+			t.Errorf("%s: error %v, want a retryable truncation", tt.name, err)
+		}
+	}
+}
+
+func TestDownloadShortBodyNotSaved(t *testing.T) {
+	// The server promises more than it sends, then hangs up.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(2*len(fakeJPEG)))
+		w.Write(fakeJPEG)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	result := processJob(context.Background(), 1, ImageMeta{ID: "1", DownloadURL: srv.URL}, WorkerOptions{
+		DownloadTimeout: time.Minute,
+		Download:        true,
+		SkipValidate:    true,
+		Sink:            &FileSink{Dir: dir},
+		Client:          srv.Client(),
+		Logger:          discardLogger(),
+	})
+	if result.Error == nil || !isRetryable(result.Error) {
+		t.Errorf("short body: error %v, want a retryable failure", result.Error)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("short body left %d files behind", len(entries))
+	}
+}
+
+func TestFsyncToggle(t *testing.T) {
+	var synced []string
+	defer func(orig func(*os.File) error) { syncFile = orig }(syncFile)
+	syncFile = func(f *os.File) error {
+		synced = append(synced, f.Name())
+		return nil
+	}
+
+	srv := newFakeImageServer(t, 0)
+	for _, fsync := range []bool{false, true} {
+		synced = nil
+		dir := t.TempDir()
+		_, err := Run(Config{
+			WorkerOptions: WorkerOptions{
+				DownloadTimeout: time.Minute,
+				Download:        true,
+				SkipValidate:    true,
+				OutputDir:       dir,
+				Fsync:           fsync,
+				Client:          srv.Client(),
+				Logger:          discardLogger(),
+			},
+			Workers: 1,
+			Source:  SliceSource{{ID: "1", DownloadURL: srv.URL}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var want []string
+		if fsync {
+			want = []string{filepath.Join(dir, "1.jpg.tmp"), dir}
+		}
+		if !slices.Equal(synced, want) {
+			t.Errorf("fsync=%t: synced %v, want %v", fsync, synced, want)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImageSource provides the image metadata a run processes.
+type ImageSource interface {
+	// Images starts listing and returns a channel that yields each image and
+	// is closed when listing ends or ctx is done. The error reports a failure
+	// to start listing at all.
+	Images(ctx context.Context) (<-chan ImageMeta, error)
+
+	// Err returns the error, if any, that ended listing early. It is only
+	// meaningful after the channel returned by Images has been closed.
+	Err() error
+}
+
+// picsumListURL is the Picsum Photos endpoint that lists image metadata.
+var picsumListURL = "https://picsum.photos/v2/list"
+
+// maxPageSize is the largest page the Picsum list endpoint will return.
+const maxPageSize = 100
+
+// listPageTimeout bounds a single request for a page of the listing,
+// including reading its body.
+const listPageTimeout = 30 * time.Second
+
+// Lister fetches image metadata one page at a time, as PicsumSource
+// consumes it.
+type Lister interface {
+	// ListPage returns the images on the 1-based page of limit images each.
+	// An empty page marks the end of the listing. Errors marked retryable
+	// make PicsumSource try the page again.
+	ListPage(ctx context.Context, page, limit int) ([]ImageMeta, error)
+}
+
+// HTTPLister lists pages from the Picsum list endpoint, or a compatible one.
+type HTTPLister struct {
+	Client *http.Client // A default client is used when nil
+	URL    string       // The endpoint; picsumListURL when empty
+}
+
+// ListPage implements Lister.
+func (l HTTPLister) ListPage(ctx context.Context, page, limit int) ([]ImageMeta, error) {
+	client := l.Client
+	if client == nil {
+		client = NewHTTPClient(ClientOptions{})
+	}
+	listURL := l.URL
+	if listURL == "" {
+		listURL = picsumListURL
+	}
+	return fetchImagePage(ctx, client, listURL, page, limit)
+}
+
+// StaticLister pages through a fixed, in-memory listing, for example to run
+// PicsumSource without the network.
+type StaticLister []ImageMeta
+
+// ListPage implements Lister.
+func (l StaticLister) ListPage(ctx context.Context, page, limit int) ([]ImageMeta, error) {
+	start := min((page-1)*limit, len(l))
+	return l[start:min(start+limit, len(l))], nil
+}
+
+// PicsumSource lists up to Count images from Lister, the Picsum Photos API
+// by default. Up to Concurrency pages are fetched at once, but images are
+// always sent in page order, each page as soon as it and every page before
+// it have arrived, so processing still overlaps with fetching. It stops
+// early when Lister returns an empty page.
+//
+// A page that still fails after Retries retries is skipped: the images of
+// every other page are sent, and Err reports the failed pages.
+type PicsumSource struct {
+	Lister      Lister       // Pages to list; an HTTPLister using Client when nil
+	Client      *http.Client // Client of the default Lister
+	Count       int
+	Concurrency int // Maximum in-flight page requests; 1 when not positive
+	Retries     int // Maximum retries per page on transient failures
+
+	err error
+}
+
+// maxBlur is the strongest blur Picsum supports.
+const maxBlur = 10
+
+// validateBlur checks that blur is 0 (off) or within Picsum's 1..maxBlur.
+func validateBlur(blur int) error {
+	if blur < 0 || blur > maxBlur {
+		return fmt.Errorf("blur must be between 1 and %d, or 0 to disable it, got %d", maxBlur, blur)
+	}
+	return nil
+}
+
+// withPicsumEffects adds Picsum's grayscale and blur modifiers to a download
+// URL, keeping any query it already has. A URL that does not parse is
+// returned unchanged, to fail when requested.
+func withPicsumEffects(rawURL string, grayscale bool, blur int) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	// Picsum expects a bare "grayscale" flag, which url.Values would encode
+	// as "grayscale=", so the query is assembled by hand.
+	var params []string
+	if u.RawQuery != "" {
+		params = append(params, u.RawQuery)
+	}
+	if grayscale {
+		params = append(params, "grayscale")
+	}
+	if blur > 0 {
+		params = append(params, "blur="+strconv.Itoa(blur))
+	}
+	u.RawQuery = strings.Join(params, "&")
+	return u.String()
+}
+
+// pageResult is the outcome of fetching one page.
+type pageResult struct {
+	images []ImageMeta
+	err    error
+}
+
+// Images implements ImageSource.
+func (s *PicsumSource) Images(ctx context.Context) (<-chan ImageMeta, error) {
+	lister := s.Lister
+	if lister == nil {
+		lister = HTTPLister{Client: s.Client}
+	}
+
+	pageSize := min(s.Count, maxPageSize)
+	var pages []chan pageResult
+	if pageSize > 0 {
+		pages = make([]chan pageResult, (s.Count+pageSize-1)/pageSize)
+	}
+
+	out := make(chan ImageMeta)
+	go func() {
+		// s.err is written before out is closed, so it is visible to any
+		// caller that has seen the close.
+		defer close(out)
+
+		// Cancelling stops fetching pages that are no longer needed once
+		// listing ends early.
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		s.fetchPages(ctx, lister, pages, pageSize)
+
+		var errs []error
+		defer func() { s.err = errors.Join(errs...) }()
+
+		sent := 0
+		for _, page := range pages {
+			var res pageResult
+			select {
+			case res = <-page:
+			case <-ctx.Done():
+				errs = append(errs, ctx.Err())
+				return
+			}
+			if res.err != nil {
+				errs = append(errs, res.err)
+				continue
+			}
+			if len(res.images) == 0 {
+				return
+			}
+			for _, img := range res.images[:min(len(res.images), s.Count-sent)] {
+				select {
+				case out <- img:
+					sent++
+				case <-ctx.Done():
+					errs = append(errs, ctx.Err())
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// fetchPages starts fetching every page in the background, with at most
+// s.Concurrency requests in flight. The result for page i+1 is delivered on
+// pages[i], which fetchPages creates with room for it so that fetchers never
+// block on a reader that has stopped listening.
+func (s *PicsumSource) fetchPages(ctx context.Context, lister Lister, pages []chan pageResult, pageSize int) {
+	for i := range pages {
+		pages[i] = make(chan pageResult, 1)
+	}
+
+	slots := NewSemaphore(max(s.Concurrency, 1))
+	go func() {
+		for i, page := range pages {
+			if slots.Acquire(ctx) != nil {
+				return
+			}
+			go func() {
+				defer slots.Release()
+				var res pageResult
+				_, res.err = withRetry(ctx, retryPolicy{maxRetries: s.Retries}, func() error {
+					var err error
+					res.images, err = lister.ListPage(ctx, i+1, pageSize)
+					return err
+				})
+				page <- res
+			}()
+		}
+	}()
+}
+
+// Err implements ImageSource.
+func (s *PicsumSource) Err() error {
+	return s.err
+}
+
+// fetchImagePage retrieves a single page of image metadata from listURL,
+// giving up after listPageTimeout. Network errors, 429 and 5xx responses are
+// marked retryable.
+func fetchImagePage(ctx context.Context, client *http.Client, listURL string, page, limit int) ([]ImageMeta, error) {
+	ctx, cancel := context.WithTimeout(ctx, listPageTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s?page=%d&limit=%d", listURL, page, limit)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for image list page %d: %w", page, err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, classifyRequestError(fmt.Errorf("failed to fetch image list page %d: %w", page, err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, classifyStatus(resp, fmt.Errorf("image list page %d returned status %d", page, resp.StatusCode))
+	}
+
+	var images []ImageMeta
+	if err := json.NewDecoder(resp.Body).Decode(&images); err != nil {
+		return nil, fmt.Errorf("invalid JSON on page %d: %w", page, err)
+	}
+
+	return images, nil
+}
+
+// ManifestSource lists images from a local JSON manifest; see loadManifest.
+type ManifestSource struct {
+	Path string
+}
+
+// Images implements ImageSource. The whole manifest is loaded and validated
+// before the first image is sent.
+func (s *ManifestSource) Images(ctx context.Context) (<-chan ImageMeta, error) {
+	images, err := loadManifest(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	return SliceSource(images).Images(ctx)
+}
+
+// Err implements ImageSource.
+func (s *ManifestSource) Err() error {
+	return nil
+}
+
+// URLListSource lists images from newline-delimited download URLs read from
+// R, such as os.Stdin, sending each as soon as its line is read. Surrounding
+// whitespace is trimmed and blank lines are skipped. Each image only has an
+// ID, taken from the URL's last path element without its extension, and a
+// DownloadURL; the first line that is not an absolute http(s) URL ends
+// listing with an error.
+type URLListSource struct {
+	R io.Reader
+
+	err error
+}
+
+// Images implements ImageSource.
+func (s *URLListSource) Images(ctx context.Context) (<-chan ImageMeta, error) {
+	out := make(chan ImageMeta)
+	go func() {
+		// s.err is written before out is closed, so it is visible to any
+		// caller that has seen the close.
+		defer close(out)
+
+		scanner := bufio.NewScanner(s.R)
+		for line := 1; scanner.Scan(); line++ {
+			rawURL := strings.TrimSpace(scanner.Text())
+			if rawURL == "" {
+				continue
+			}
+			img, err := imageFromURL(rawURL)
+			if err != nil {
+				s.err = fmt.Errorf("URL list line %d: %w", line, err)
+				return
+			}
+			select {
+			case out <- img:
+			case <-ctx.Done():
+				s.err = ctx.Err()
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			s.err = fmt.Errorf("failed to read URL list: %w", err)
+		}
+	}()
+	return out, nil
+}
+
+// Err implements ImageSource.
+func (s *URLListSource) Err() error {
+	return s.err
+}
+
+// imageFromURL builds the minimal ImageMeta for rawURL; see URLListSource.
+func imageFromURL(rawURL string) (ImageMeta, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ImageMeta{}, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ImageMeta{}, fmt.Errorf("%q is not an absolute http(s) URL", rawURL)
+	}
+
+	base := path.Base(u.Path)
+	id := strings.TrimSuffix(base, path.Ext(base))
+	if id == "" || id == "." || id == "/" {
+		return ImageMeta{}, fmt.Errorf("cannot derive an image ID from %q", rawURL)
+	}
+	return ImageMeta{ID: id, DownloadURL: rawURL}, nil
+}
+
+// SliceSource lists a fixed, in-memory set of images.
+type SliceSource []ImageMeta
+
+// Images implements ImageSource.
+func (s SliceSource) Images(ctx context.Context) (<-chan ImageMeta, error) {
+	out := make(chan ImageMeta)
+	go func() {
+		defer close(out)
+		for _, img := range s {
+			select {
+			case out <- img:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Err implements ImageSource.
+func (s SliceSource) Err() error {
+	return nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newFakeListServer serves a Picsum-style listing of total images with IDs
+// 0 to total-1. Each page is answered after a random delay of up to jitter,
+// so pages fetched concurrently arrive out of order.
+func newFakeListServer(tb testing.TB, total int, jitter time.Duration) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if jitter > 0 {
+			time.Sleep(rand.N(jitter))
+		}
+		images := []ImageMeta{}
+		for id := (page - 1) * limit; id < min(page*limit, total); id++ {
+			images = append(images, ImageMeta{ID: strconv.Itoa(id), DownloadURL: "http://images.invalid/" + strconv.Itoa(id)})
+		}
+		json.NewEncoder(w).Encode(images)
+	}))
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+// collectImages lists every image of source.
+func collectImages(tb testing.TB, ctx context.Context, source ImageSource) []ImageMeta {
+	tb.Helper()
+	images, err := source.Images(ctx)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var all []ImageMeta
+	for img := range images {
+		all = append(all, img)
+	}
+	return all
+}
+
+func TestPicsumSourceMultiplePages(t *testing.T) {
+	srv := newFakeListServer(t, 1000, 20*time.Millisecond)
+	source := &PicsumSource{
+		Lister:      HTTPLister{Client: srv.Client(), URL: srv.URL},
+		Count:       250,
+		Concurrency: 4,
+	}
+
+	images := collectImages(t, context.Background(), source)
+	if err := source.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 250 {
+		t.Fatalf("listed %d images, want 250", len(images))
+	}
+	for i, img := range images {
+		if img.ID != strconv.Itoa(i) {
+			t.Fatalf("image %d has ID %s, want pages in order", i, img.ID)
+		}
+	}
+}
+
+func TestPicsumSourceCancelledMidRequest(t *testing.T) {
+	inFlight := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "1" {
+			json.NewEncoder(w).Encode([]ImageMeta{{ID: "0"}})
+			return
+		}
+		close(inFlight)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	source := &PicsumSource{
+		Lister: HTTPLister{Client: srv.Client(), URL: srv.URL},
+		Count:  2 * maxPageSize,
+	}
+	images, err := source.Images(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img := <-images; img.ID != "0" {
+		t.Fatalf("first image %q, want 0", img.ID)
+	}
+	<-inFlight
+	cancel()
+
+	select {
+	case _, ok := <-images:
+		if ok {
+			t.Error("listing sent an image after being cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listing did not end after being cancelled")
+	}
+	if err := source.Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Err() = %v, want context.Canceled", err)
+	}
+}
+
+// gatedLister serves one page of images, then holds the second page until
+// gate is closed, failing it after a few seconds.
+type gatedLister struct {
+	first []ImageMeta
+	gate  <-chan struct{}
+}
+
+func (l gatedLister) ListPage(ctx context.Context, page, limit int) ([]ImageMeta, error) {
+	if page == 1 {
+		return l.first, nil
+	}
+	select {
+	case <-l.gate:
+		return nil, nil
+	case <-time.After(5 * time.Second):
+		return nil, errors.New("page 2 was still waiting for the first image to be processed")
+	}
+}
+
+func TestProcessingOverlapsListing(t *testing.T) {
+	processed := make(chan struct{})
+	var once sync.Once
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { close(processed) })
+	}))
+	defer srv.Close()
+
+	cfg := validateConfig(srv, 2, nil)
+	cfg.Lister = gatedLister{first: []ImageMeta{{ID: "1", DownloadURL: srv.URL}}, gate: processed}
+	cfg.Limit = 2 * maxPageSize
+	results, err := Run(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Error != nil {
+		t.Errorf("results = %+v, want the first page's image processed", results)
+	}
+}
+
+// failingSource lists images and then reports err, or fails to start at all
+// when images is nil.
+type failingSource struct {
+	images SliceSource
+	err    error
+}
+
+func (s failingSource) Images(ctx context.Context) (<-chan ImageMeta, error) {
+	if s.images == nil {
+		return nil, s.err
+	}
+	return s.images.Images(ctx)
+}
+
+func (s failingSource) Err() error { return s.err }
+
+func TestSliceSource(t *testing.T) {
+	want := SliceSource{{ID: "b"}, {ID: "a"}, {ID: "c"}}
+	got := collectImages(t, context.Background(), want)
+	if !slices.Equal(got, want) {
+		t.Errorf("listed %v, want %v in order", got, want)
+	}
+}
+
+func TestRunWithFailingSource(t *testing.T) {
+	srv := newStatusServer(t)
+	failure := errors.New("listing broke")
+
+	_, err := Run(validateConfig(srv, 1, failingSource{err: failure}))
+	if !errors.Is(err, ErrListingFailed) || !errors.Is(err, failure) {
+		t.Errorf("source failing to start: Run() = %v, want ErrListingFailed wrapping the failure", err)
+	}
+
+	partial := failingSource{images: SliceSource{{ID: "1", DownloadURL: srv.URL + "/ok"}}, err: failure}
+	results, err := Run(validateConfig(srv, 1, partial))
+	if !errors.Is(err, ErrListingFailed) || !errors.Is(err, failure) {
+		t.Errorf("source failing part way: Run() = %v, want ErrListingFailed wrapping the failure", err)
+	}
+	if len(results) != 1 || results[0].Error != nil {
+		t.Errorf("source failing part way: results %+v, want the listed image processed", results)
+	}
+}
+
+func TestPicsumSourceIntermittentPageFailures(t *testing.T) {
+	const pages = 5
+	list := newFakeListServer(t, pages*maxPageSize, 10*time.Millisecond)
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := r.URL.Query().Get("page")
+		mu.Lock()
+		attempts[page]++
+		attempt := attempts[page]
+		mu.Unlock()
+		// Even pages fail once, and page 4 never recovers.
+		number, _ := strconv.Atoi(page)
+		if page == "4" || (number%2 == 0 && attempt == 1) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		list.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	source := &PicsumSource{
+		Lister:      HTTPLister{Client: srv.Client(), URL: srv.URL},
+		Count:       pages * maxPageSize,
+		Concurrency: 3,
+		Retries:     2,
+	}
+	images := collectImages(t, context.Background(), source)
+
+	var want []string
+	for id := range pages * maxPageSize {
+		if id/maxPageSize+1 != 4 {
+			want = append(want, strconv.Itoa(id))
+		}
+	}
+	if got := imageIDs(images); !slices.Equal(got, want) {
+		t.Errorf("listed %d images, want the %d of every page but 4, in page order", len(got), len(want))
+	}
+	err := source.Err()
+	if err == nil || !strings.Contains(err.Error(), "page 4") {
+		t.Errorf("Err() = %v, want page 4 reported", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "page 2") {
+		t.Errorf("Err() = %v, want page 2 recovered by a retry", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts["4"] != 3 {
+		t.Errorf("page 4 requested %d times, want 1 attempt and 2 retries", attempts["4"])
+	}
+}
+
+func TestURLListSource(t *testing.T) {
+	input := strings.NewReader(`https://picsum.photos/id/1/200/300
+  http://example.com/images/cat.jpg  
+
+	https://example.com/a/b/photo.large.png?size=2
+`)
+	source := &URLListSource{R: input}
+	got := collectImages(t, context.Background(), source)
+	want := []ImageMeta{
+		{ID: "300", DownloadURL: "https://picsum.photos/id/1/200/300"},
+		{ID: "cat", DownloadURL: "http://example.com/images/cat.jpg"},
+		{ID: "photo.large", DownloadURL: "https://example.com/a/b/photo.large.png?size=2"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("listed %+v, want %+v", got, want)
+	}
+	if err := source.Err(); err != nil {
+		t.Errorf("Err() = %v", err)
+	}
+
+	for _, bad := range []string{"ftp://example.com/1.jpg", "/relative/1.jpg", "https://example.com/"} {
+		source := &URLListSource{R: strings.NewReader("https://example.com/ok.jpg\n" + bad + "\n")}
+		got := collectImages(t, context.Background(), source)
+		if len(got) != 1 {
+			t.Errorf("%q: listed %d images before failing, want 1", bad, len(got))
+		}
+		if err := source.Err(); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("%q: Err() = %v, want the error on line 2", bad, err)
+		}
+	}
+}
+
+func TestPicsumEffectsAreRequested(t *testing.T) {
+	var mu sync.Mutex
+	var requested []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.RequestURI())
+		mu.Unlock()
+		w.Write(fakeJPEG)
+	}))
+	defer srv.Close()
+
+	cfg := validateConfig(srv, 1, SliceSource{
+		{ID: "1", DownloadURL: srv.URL + "/id/1/200/300"},
+		{ID: "2", DownloadURL: srv.URL + "/id/2/200/300?jpg=1"},
+	})
+	cfg.Download = true
+	cfg.DownloadTimeout = time.Minute
+	cfg.Sink = discardSink{}
+	cfg.Grayscale = true
+	cfg.Blur = 3
+	if _, err := Run(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"/id/1/200/300?grayscale&blur=3", "/id/1/200/300?grayscale&blur=3",
+		"/id/2/200/300?jpg=1&grayscale&blur=3", "/id/2/200/300?jpg=1&grayscale&blur=3",
+	}
+	if !slices.Equal(requested, want) {
+		t.Errorf("requested %v, want the validation and download of each variant: %v", requested, want)
+	}
+}
+
+func TestValidateBlur(t *testing.T) {
+	for blur, ok := range map[int]bool{-1: false, 0: true, 1: true, maxBlur: true, maxBlur + 1: false} {
+		if err := validateBlur(blur); (err == nil) != ok {
+			t.Errorf("validateBlur(%d) = %v", blur, err)
+		}
+	}
+}
+
+func TestRunStaticLister(t *testing.T) {
+	srv := newFakeImageServer(t, 0)
+	listing := StaticLister(fakeJobs(srv, 250))
+
+	tests := []struct {
+		name  string
+		limit int
+		want  int
+	}{
+		{"limit within the listing", 230, 230},
+		{"listing shorter than the limit", 400, 250},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := NewMemorySink()
+			results, err := Run(Config{
+				WorkerOptions: WorkerOptions{
+					ValidateTimeout: time.Minute,
+					DownloadTimeout: time.Minute,
+					Download:        true,
+					Sink:            sink,
+					Client:          srv.Client(),
+					Logger:          discardLogger(),
+				},
+				Workers:         8,
+				Limit:           tt.limit,
+				PageConcurrency: 2,
+				Lister:          listing,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != tt.want || sink.Len() != tt.want {
+				t.Fatalf("got %d results and %d stored images, want %d", len(results), sink.Len(), tt.want)
+			}
+			seen := make(map[string]bool)
+			for _, r := range results {
+				seen[r.ID] = true
+				if data, _ := sink.Get(r.ID); !bytes.Equal(data, fakeJPEG) {
+					t.Errorf("image %s stored %d bytes, want the served image", r.ID, len(data))
+				}
+			}
+			for _, img := range listing[:tt.want] {
+				if !seen[img.ID] {
+					t.Errorf("image %s of the listing was not processed", img.ID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+// ResultStage is one step of a result pipeline. It reads results from in
+// and returns the channel it forwards them on, possibly transformed or
+// dropped. A stage must keep reading in until it is closed, so the pool's
+// workers can always finish, and must close its output afterwards.
+type ResultStage func(in <-chan Result) <-chan Result
+
+// MapResults returns a ResultStage that passes every result through fn in
+// its own goroutine, so fn overlaps with the work of the stages before it.
+func MapResults(fn func(Result) Result) ResultStage {
+	return func(in <-chan Result) <-chan Result {
+		out := make(chan Result)
+		go func() {
+			defer close(out)
+			for r := range in {
+				out <- fn(r)
+			}
+		}()
+		return out
+	}
+}
+
+// chainStages connects stages in order, feeding in to the first, and
+// returns the output of the last one. With no stages it returns in.
+func chainStages(in <-chan Result, stages ...ResultStage) <-chan Result {
+	for _, stage := range stages {
+		in = stage(in)
+	}
+	return in
+}
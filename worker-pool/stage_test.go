@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// tagStage appends tag to the Author of every result.
+func tagStage(tag string) ResultStage {
+	return MapResults(func(r Result) Result {
+		r.Author += tag
+		return r
+	})
+}
+
+func TestChainStagesTagsInOrder(t *testing.T) {
+	in := make(chan Result)
+	go func() {
+		defer close(in)
+		for i := range 10 {
+			in <- Result{ID: strconv.Itoa(i)}
+		}
+	}()
+
+	got := 0
+	for r := range chainStages(in, tagStage("a"), tagStage("b")) {
+		if r.Author != "ab" {
+			t.Errorf("result %s tagged %q, want stages applied in order as \"ab\"", r.ID, r.Author)
+		}
+		got++
+	}
+	if got != 10 {
+		t.Errorf("got %d results, want 10", got)
+	}
+
+	in = make(chan Result)
+	if out := chainStages(in); out != (<-chan Result)(in) {
+		t.Error("chainStages without stages did not return its input")
+	}
+}
+
+func TestRunStages(t *testing.T) {
+	srv := newStatusServer(t)
+	jobs := make(SliceSource, 20)
+	for i := range jobs {
+		jobs[i] = ImageMeta{ID: strconv.Itoa(i), DownloadURL: srv.URL + "/ok"}
+	}
+	cfg := validateConfig(srv, 4, jobs)
+	cfg.Stages = []ResultStage{tagStage("-tagged")}
+	var seen int
+	cfg.OnResult = func(r Result) {
+		seen++
+		if r.Author != "-tagged" {
+			t.Errorf("OnResult saw result %s before the stage tagged it", r.ID)
+		}
+	}
+
+	results, err := Run(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(jobs) || seen != len(jobs) {
+		t.Fatalf("got %d results and %d callbacks, want %d", len(results), seen, len(jobs))
+	}
+	for _, r := range results {
+		if r.Author != "-tagged" {
+			t.Errorf("result %s returned untagged", r.ID)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// activity describes the job a worker is currently processing.
+type activity struct {
+	imageID string
+	since   time.Time
+}
+
+// heartbeats tracks what each worker is doing so that workers stuck on a job
+// can be reported. Workers publish their state atomically, and a nil
+// *heartbeats ignores every call, which disables stall detection.
+type heartbeats struct {
+	workers []atomic.Pointer[activity] // Indexed by worker ID - 1; nil while idle
+	clock   Clock
+}
+
+// newHeartbeats tracks numWorkers workers, timing them by clock, or real
+// time when nil.
+func newHeartbeats(numWorkers int, clock Clock) *heartbeats {
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &heartbeats{workers: make([]atomic.Pointer[activity], numWorkers), clock: clock}
+}
+
+// start records that worker id began processing imageID.
+func (h *heartbeats) start(id int, imageID string) {
+	if h == nil {
+		return
+	}
+	h.workers[id-1].Store(&activity{imageID: imageID, since: h.clock.Now()})
+}
+
+// done records that worker id produced a result and is idle again.
+func (h *heartbeats) done(id int) {
+	if h == nil {
+		return
+	}
+	h.workers[id-1].Store(nil)
+}
+
+// watchStalls checks h every threshold/2, by the clock of h, and logs a
+// warning, once per job, for each worker that has spent longer than
+// threshold on its current job. It returns when done is closed.
+func watchStalls(logger *slog.Logger, h *heartbeats, threshold time.Duration, done <-chan struct{}) {
+	interval := max(threshold/2, time.Millisecond)
+	warned := make([]*activity, len(h.workers))
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-h.clock.After(interval):
+			for i := range h.workers {
+				act := h.workers[i].Load()
+				if act == nil || act == warned[i] || now.Sub(act.since) < threshold {
+					continue
+				}
+				warned[i] = act
+				logger.Warn("Worker stalled",
+					"worker_id", i+1,
+					"image_id", act.imageID,
+					"busy_for", now.Sub(act.since).Round(time.Millisecond),
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchStallsWarnsOncePerStalledJob(t *testing.T) {
+	const threshold = 10 * time.Second
+	clock := newFakeClock()
+	beats := newHeartbeats(2, clock)
+	logger, logs := bufferLogger()
+	done := make(chan struct{})
+	defer close(done)
+
+	beats.start(1, "slow")
+	beats.start(2, "quick")
+	go watchStalls(logger, beats, threshold, done)
+
+	// tick advances the clock by one check interval and waits until the
+	// check has run.
+	tick := func() {
+		clock.waitForWaiters(t, 1)
+		clock.Advance(threshold / 2)
+		clock.waitForWaiters(t, 1)
+	}
+	tick()
+	beats.done(2)
+	if out := logs.String(); out != "" {
+		t.Fatalf("warned before the threshold:\n%s", out)
+	}
+	tick()
+	tick()
+
+	out := logs.String()
+	if n := strings.Count(out, "Worker stalled"); n != 1 {
+		t.Fatalf("logged %d stall warnings, want 1:\n%s", n, out)
+	}
+	if !strings.Contains(out, "worker_id=1") || !strings.Contains(out, "image_id=slow") {
+		t.Errorf("warning does not name worker 1 and image slow:\n%s", out)
+	}
+	if !strings.Contains(out, "busy_for=10s") {
+		t.Errorf("warning does not report 10s busy:\n%s", out)
+	}
+
+	// A new job on the same worker is watched afresh.
+	beats.start(1, "next")
+	tick()
+	tick()
+	if n := strings.Count(logs.String(), "image_id=next"); n != 1 {
+		t.Errorf("logged %d warnings for the next job, want 1", n)
+	}
+}
+
+func TestNilHeartbeatsIgnoreCalls(t *testing.T) {
+	var beats *heartbeats
+	beats.start(1, "1")
+	beats.done(1)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Status is the outcome of a Result. Error holds the detail of a failed or
+// cancelled one.
+type Status int
+
+const (
+	// StatusSuccess means the image was validated, and downloaded if
+	// requested.
+	StatusSuccess Status = iota
+	// StatusCached means the image was validated but its download skipped,
+	// as it was already stored.
+	StatusCached
+	// StatusSkipped means the image was not processed at all, as in a dry
+	// run.
+	StatusSkipped
+	// StatusFailed means processing the image failed.
+	StatusFailed
+	// StatusCancelled means the run was cancelled before or while the image
+	// was processed.
+	StatusCancelled
+)
+
+// statusNames maps each Status to its name in logs and output.
+var statusNames = map[Status]string{
+	StatusSuccess:   "success",
+	StatusCached:    "cached",
+	StatusSkipped:   "skipped",
+	StatusFailed:    "failed",
+	StatusCancelled: "cancelled",
+}
+
+// String returns the name of s.
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// OK reports whether s is an outcome without an error.
+func (s Status) OK() bool {
+	return s == StatusSuccess || s == StatusCached || s == StatusSkipped
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Status) MarshalText() ([]byte, error) {
+	name, ok := statusNames[s]
+	if !ok {
+		return nil, fmt.Errorf("unknown status %d", int(s))
+	}
+	return []byte(name), nil
+}
+
+// finalStatus returns the status of r once the worker is done with it, given
+// the cause its job's context was cancelled with, nil while it was not. A
+// failure is reported as cancelled only when it came from that cancellation,
+// as a context error or cause itself; any other error, such as a 404 that
+// arrived after the run was cancelled, is still a failure. Otherwise r keeps
+// the status processJob gave it.
+func finalStatus(r Result, cause error) Status {
+	switch {
+	case r.Error == nil:
+		return r.Status
+	case cause != nil && (errors.Is(r.Error, context.Canceled) ||
+		errors.Is(r.Error, context.DeadlineExceeded) ||
+		errors.Is(r.Error, cause)):
+		return StatusCancelled
+	}
+	return StatusFailed
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResultStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(fakeJPEG)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "stored.jpg"), fakeJPEG, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		job  ImageMeta
+		opts func(*WorkerOptions)
+		want Status
+	}{
+		{"success", context.Background(), ImageMeta{ID: "new"}, nil, StatusSuccess},
+		{"cached", context.Background(), ImageMeta{ID: "stored"}, nil, StatusCached},
+		{"skipped", context.Background(), ImageMeta{ID: "new"}, func(o *WorkerOptions) { o.DryRun = true }, StatusSkipped},
+		{"failed", context.Background(), ImageMeta{ID: "missing"}, nil, StatusFailed},
+		{"cancelled", cancelled, ImageMeta{ID: "new"}, nil, StatusCancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := WorkerOptions{
+				ValidateTimeout: time.Minute,
+				DownloadTimeout: time.Minute,
+				Download:        true,
+				OutputDir:       dir,
+				Client:          srv.Client(),
+				Logger:          discardLogger(),
+			}
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+			tt.job.DownloadURL = srv.URL + "/" + tt.job.ID
+
+			pool := NewWorkerPool(tt.ctx, 1, opts)
+			pool.Submit(tt.job)
+			pool.Close()
+			result := <-pool.Results()
+			pool.Drain()
+
+			if result.Status != tt.want {
+				t.Errorf("Status = %v (error %v), want %v", result.Status, result.Error, tt.want)
+			}
+			if result.Status.OK() != (result.Error == nil) {
+				t.Errorf("Status %v does not match error %v", result.Status, result.Error)
+			}
+		})
+	}
+}
+
+func TestProgressCountsOnlyFailures(t *testing.T) {
+	var p progress
+	for _, status := range []Status{StatusSuccess, StatusCached, StatusSkipped, StatusFailed, StatusCancelled} {
+		p.record(Result{Status: status})
+	}
+	if got := p.processed.Load(); got != 5 {
+		t.Errorf("processed = %d, want 5", got)
+	}
+	if got := p.failed.Load(); got != 1 {
+		t.Errorf("failed = %d, want 1", got)
+	}
+}
+
+func TestOutputsReportStatus(t *testing.T) {
+	results := []Result{
+		{ID: "1", Status: StatusCached},
+		{ID: "2", Status: StatusCancelled, Error: context.Canceled},
+	}
+
+	var buf bytes.Buffer
+	if err := writeCSV(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"cached", "cancelled"} {
+		if got := rows[i+1][5]; got != want {
+			t.Errorf("CSV status of %s = %q, want %q", results[i].ID, got, want)
+		}
+	}
+
+	data, err := json.Marshal(results[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["status"] != "cancelled" {
+		t.Errorf("JSON status = %v, want cancelled", fields["status"])
+	}
+	if _, ok := fields["cancelled"]; ok {
+		t.Error("JSON still has the cancelled field")
+	}
+}
+
+func TestFinalStatus(t *testing.T) {
+	cause := errors.New("run aborted")
+	notFound := errors.New("image 1 returned status 404")
+	tests := []struct {
+		name  string
+		r     Result
+		cause error
+		want  Status
+	}{
+		{"success", Result{Status: StatusSuccess}, nil, StatusSuccess},
+		{"cached after cancel", Result{Status: StatusCached}, cause, StatusCached},
+		{"failure", Result{Error: notFound}, nil, StatusFailed},
+		{"failure after cancel", Result{Error: notFound}, cause, StatusFailed},
+		{"context error", Result{Error: fmt.Errorf("request: %w", context.Canceled)}, cause, StatusCancelled},
+		{"deadline", Result{Error: fmt.Errorf("request: %w", context.DeadlineExceeded)}, cause, StatusCancelled},
+		{"cause", Result{Error: fmt.Errorf("request: %w", cause)}, cause, StatusCancelled},
+		{"context error without cancel", Result{Error: context.DeadlineExceeded}, nil, StatusFailed},
+	}
+	for _, tt := range tests {
+		if got := finalStatus(tt.r, tt.cause); got != tt.want {
+			t.Errorf("%s: finalStatus = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// cancellingSink cancels the run while an image is being saved, then fails
+// the write with err, or with the context's error when err is nil.
+type cancellingSink struct {
+	cancel context.CancelCauseFunc
+	cause  error
+	err    error
+}
+
+func (s cancellingSink) Write(ctx context.Context, meta ImageMeta, r io.Reader) error {
+	s.cancel(s.cause)
+	if s.err != nil {
+		return s.err
+	}
+	return ctx.Err()
+}
+
+func TestFailureAfterCancel(t *testing.T) {
+	srv := newFakeImageServer(t, 0)
+	cause := errors.New("run aborted")
+	diskFull := errors.New("disk full")
+
+	for _, tt := range []struct {
+		name string
+		err  error
+		want Status
+	}{
+		{"unrelated failure", diskFull, StatusFailed},
+		{"context error", nil, StatusCancelled},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancelCause(context.Background())
+			defer cancel(nil)
+			opts := WorkerOptions{
+				ValidateTimeout: time.Minute,
+				DownloadTimeout: time.Minute,
+				Download:        true,
+				Sink:            cancellingSink{cancel: cancel, cause: cause, err: tt.err},
+				Client:          srv.Client(),
+				Logger:          discardLogger(),
+			}
+			results := make(chan Result, 1)
+			handleJob(ctx, ctx, 1, ImageMeta{ID: "1", DownloadURL: srv.URL}, results, nil, opts)
+			r := <-results
+
+			if r.Status != tt.want {
+				t.Fatalf("Status = %v (error %v), want %v", r.Status, r.Error, tt.want)
+			}
+			if tt.want == StatusFailed && !errors.Is(r.Error, diskFull) {
+				t.Errorf("error = %v, want the write's own error", r.Error)
+			}
+			if tt.want == StatusCancelled && !errors.Is(r.Error, cause) {
+				t.Errorf("error = %v, want it to carry the cancel cause", r.Error)
+			}
+		})
+	}
+}
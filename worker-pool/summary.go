@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Summary aggregates the outcome of a run.
+type Summary struct {
+	Total     int           // Number of results processed
+	Succeeded int           // Results with StatusSuccess
+	Cached    int           // Results with StatusCached
+	Skipped   int           // Results with StatusSkipped
+	Failed    int           // Results with StatusFailed
+	Cancelled int           // Results with StatusCancelled
+	Slowest   Result        // Result with the longest TimeSpent
+	Fastest   Result        // Result with the shortest TimeSpent
+	Mean      time.Duration // Mean TimeSpent across all results
+	Bytes     int64         // Total bytes downloaded, after decoding
+	WireBytes int64         // Total bytes received over the network
+}
+
+// summarize computes aggregate statistics over results.
+func summarize(results []Result) Summary {
+	var s Summary
+	var total time.Duration
+
+	for i, r := range results {
+		s.Total++
+		switch r.Status {
+		case StatusSuccess:
+			s.Succeeded++
+		case StatusCached:
+			s.Cached++
+		case StatusSkipped:
+			s.Skipped++
+		case StatusFailed:
+			s.Failed++
+		case StatusCancelled:
+			s.Cancelled++
+		}
+
+		s.Bytes += r.Bytes
+		s.WireBytes += r.WireBytes
+		total += r.TimeSpent
+		if i == 0 || r.TimeSpent > s.Slowest.TimeSpent {
+			s.Slowest = r
+		}
+		if i == 0 || r.TimeSpent < s.Fastest.TimeSpent {
+			s.Fastest = r
+		}
+	}
+
+	if s.Total > 0 {
+		s.Mean = total / time.Duration(s.Total)
+	}
+	return s
+}
+
+// logSummary writes s to logger as a single "Run summary" entry.
+func logSummary(logger *slog.Logger, s Summary) {
+	logger.Info("Run summary",
+		"total", s.Total,
+		"succeeded", s.Succeeded,
+		"cached", s.Cached,
+		"skipped", s.Skipped,
+		"failed", s.Failed,
+		"cancelled", s.Cancelled,
+		"slowest_id", s.Slowest.ID,
+		"slowest_time", s.Slowest.TimeSpent,
+		"fastest_id", s.Fastest.ID,
+		"fastest_time", s.Fastest.TimeSpent,
+		"mean_time", s.Mean,
+		"bytes", s.Bytes,
+		"wire_bytes", s.WireBytes,
+	)
+}
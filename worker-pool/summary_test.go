@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummarize(t *testing.T) {
+	results := []Result{
+		{ID: "a", Status: StatusSuccess, TimeSpent: 30 * time.Millisecond, Bytes: 100, WireBytes: 80},
+		{ID: "b", Status: StatusFailed, TimeSpent: 90 * time.Millisecond},
+		{ID: "c", Status: StatusCached, TimeSpent: 10 * time.Millisecond},
+		{ID: "d", Status: StatusCancelled, TimeSpent: 20 * time.Millisecond},
+		{ID: "e", Status: StatusSuccess, TimeSpent: 50 * time.Millisecond, Bytes: 200, WireBytes: 200},
+		{ID: "f", Status: StatusSkipped, TimeSpent: 40 * time.Millisecond},
+	}
+
+	s := summarize(results)
+	want := Summary{Total: 6, Succeeded: 2, Cached: 1, Skipped: 1, Failed: 1, Cancelled: 1, Bytes: 300, WireBytes: 280}
+	got := s
+	got.Slowest, got.Fastest, got.Mean = Result{}, Result{}, 0
+	if got != want {
+		t.Errorf("counts = %+v, want %+v", got, want)
+	}
+	if s.Slowest.ID != "b" || s.Fastest.ID != "c" {
+		t.Errorf("slowest %s and fastest %s, want b and c", s.Slowest.ID, s.Fastest.ID)
+	}
+	if s.Mean != 40*time.Millisecond {
+		t.Errorf("Mean = %v, want 40ms", s.Mean)
+	}
+
+	if empty := summarize(nil); empty.Total != 0 || empty.Mean != 0 {
+		t.Errorf("summarize(nil) = %+v, want zero", empty)
+	}
+}
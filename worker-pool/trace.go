@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// traceKey is the type of the context keys holding trace IDs.
+type traceKey int
+
+const (
+	runIDKey traceKey = iota
+	jobIDKey
+)
+
+// newTraceID returns a random 16-character hex ID.
+func newTraceID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// withRunID returns a copy of ctx carrying the run-scoped trace ID id.
+func withRunID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, runIDKey, id)
+}
+
+// withJobID returns a copy of ctx carrying the trace ID id of a single job.
+func withJobID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, jobIDKey, id)
+}
+
+// RunID returns the trace ID of the run ctx belongs to, or "" outside a run.
+// Sinks and processors can use it to correlate their own logs with the run.
+func RunID(ctx context.Context) string {
+	id, _ := ctx.Value(runIDKey).(string)
+	return id
+}
+
+// JobID returns the trace ID of the job ctx belongs to, or "" outside a job.
+func JobID(ctx context.Context) string {
+	id, _ := ctx.Value(jobIDKey).(string)
+	return id
+}
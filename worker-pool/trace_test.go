@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTraceIDsInLogs(t *testing.T) {
+	srv := newFakeImageServer(t, 0)
+	logger, logs := bufferLogger()
+
+	var mu sync.Mutex
+	jobIDs := make(map[string]string) // By image ID
+	record := func(ctx context.Context, meta ImageMeta, body io.Reader) error {
+		if got := RunID(ctx); got != "run-42" {
+			t.Errorf("image %s: RunID = %q, want run-42", meta.ID, got)
+		}
+		mu.Lock()
+		jobIDs[meta.ID] = JobID(ctx)
+		mu.Unlock()
+		_, err := io.Copy(io.Discard, body)
+		return err
+	}
+	_, err := Run(Config{
+		WorkerOptions: WorkerOptions{
+			ValidateTimeout: time.Minute,
+			DownloadTimeout: time.Minute,
+			Download:        true,
+			Processor:       record,
+			Client:          srv.Client(),
+			Logger:          logger,
+		},
+		Workers: 2,
+		Source:  fakeJobs(srv, 4),
+		TraceID: "run-42",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	for _, line := range lines {
+		if !strings.Contains(line, "trace_id=run-42") {
+			t.Errorf("log line without the run's trace ID: %s", line)
+		}
+	}
+	if len(jobIDs) != 4 {
+		t.Fatalf("processor saw %d jobs, want 4", len(jobIDs))
+	}
+	seen := make(map[string]bool)
+	for imageID, jobID := range jobIDs {
+		if jobID == "" || seen[jobID] {
+			t.Errorf("image %s has job ID %q, want a fresh one", imageID, jobID)
+		}
+		seen[jobID] = true
+		if !strings.Contains(logs.String(), "job_id="+jobID) {
+			t.Errorf("image %s: no log line carries its job ID %s", imageID, jobID)
+		}
+	}
+}
+
+func TestNewTraceID(t *testing.T) {
+	id := newTraceID()
+	if !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(id) {
+		t.Errorf("newTraceID() = %q, want 16 hex characters", id)
+	}
+	if newTraceID() == id {
+		t.Error("newTraceID returned the same ID twice")
+	}
+	if RunID(context.Background()) != "" || JobID(context.Background()) != "" {
+		t.Error("context outside a run carries trace IDs")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// ErrFileMissing and ErrFileCorrupt are wrapped by the error of a result
+// whose stored file failed verification with WorkerOptions.VerifyFiles.
+var (
+	ErrFileMissing = errors.New("stored file is missing")
+	ErrFileCorrupt = errors.New("stored file is corrupt")
+)
+
+// verifyStoredFile checks that the file opts.Sink would store meta as exists
+// and holds a decodable image, and fills in the Path, FileBytes, SHA256 and
+// dimensions of result from it. The same content checks as for a download
+// apply, so a file is only accepted if it would have been saved in the first
+// place. Images in a format without a registered decoder are accepted once
+// their type is recognized, as they cannot be decoded here.
+func verifyStoredFile(meta ImageMeta, opts WorkerOptions, result *Result) error {
+	ps, ok := opts.Sink.(pathSink)
+	if !ok {
+		return fmt.Errorf("image %s: sink %T does not store files", meta.ID, opts.Sink)
+	}
+	path, err := ps.Path(meta)
+	if err != nil {
+		return err
+	}
+	result.Path = path
+
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: image %s: %s", ErrFileMissing, meta.ID, path)
+	}
+	if err != nil {
+		return fmt.Errorf("image %s: %w", meta.ID, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	counted := &downloadReader{r: io.TeeReader(file, hash), limit: -1, expected: -1}
+	body := bufio.NewReaderSize(counted, sniffLen)
+	corrupt := func(err error) error {
+		return fmt.Errorf("%w: image %s: %s: %w", ErrFileCorrupt, meta.ID, path, err)
+	}
+
+	if result.ImageType, err = detectImageType("", body); err != nil {
+		return corrupt(err)
+	}
+	img, _, err := image.Decode(body)
+	switch {
+	case errors.Is(err, image.ErrFormat):
+		opts.Logger.Debug("No decoder for stored image, only its type was checked",
+			"image_id", meta.ID,
+			"image_type", result.ImageType,
+		)
+	case err != nil:
+		return corrupt(err)
+	default:
+		bounds := img.Bounds()
+		result.ActualWidth, result.ActualHeight = bounds.Dx(), bounds.Dy()
+		result.DimensionMismatch = dimensionsDiffer(meta, result.ActualWidth, result.ActualHeight)
+	}
+
+	// Hash whatever the decoder left unread, such as trailing metadata.
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return fmt.Errorf("image %s: %w", meta.ID, err)
+	}
+	result.FileBytes = counted.n
+	result.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyStoredFiles(t *testing.T) {
+	dir := t.TempDir()
+	good := jpegFixture(t, 20, 10)
+	// A real JPEG with its image data cut off.
+	truncated := good[:len(good)/2]
+	for name, data := range map[string][]byte{
+		"good.jpg":      good,
+		"truncated.jpg": truncated,
+		"text.jpg":      []byte("<html>not an image</html>"),
+		"empty.jpg":     nil,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := Config{
+		WorkerOptions: WorkerOptions{
+			VerifyFiles: true,
+			OutputDir:   dir,
+			Logger:      discardLogger(),
+		},
+		Workers: 2,
+		Source: SliceSource{
+			{ID: "good", Width: 20, Height: 10},
+			{ID: "truncated"},
+			{ID: "text"},
+			{ID: "empty"},
+			{ID: "missing"},
+		},
+	}
+	results, err := Run(cfg)
+	if !errors.Is(err, ErrImageFailed) {
+		t.Fatalf("Run() = %v, want the bad files reported", err)
+	}
+
+	byID := make(map[string]Result)
+	for _, r := range results {
+		byID[r.ID] = r
+	}
+	if len(byID) != 5 {
+		t.Fatalf("got %d results, want 5", len(byID))
+	}
+
+	ok := byID["good"]
+	sum := sha256.Sum256(good)
+	if ok.Error != nil || ok.Status != StatusSuccess {
+		t.Errorf("good file: %v, %v", ok.Status, ok.Error)
+	}
+	if ok.SHA256 != hex.EncodeToString(sum[:]) || ok.FileBytes != int64(len(good)) {
+		t.Errorf("good file: %d bytes with checksum %s, want %d bytes with %x", ok.FileBytes, ok.SHA256, len(good), sum)
+	}
+	if ok.ActualWidth != 20 || ok.ActualHeight != 10 || ok.DimensionMismatch {
+		t.Errorf("good file: decoded %dx%d, mismatch %t", ok.ActualWidth, ok.ActualHeight, ok.DimensionMismatch)
+	}
+
+	for _, id := range []string{"truncated", "text", "empty"} {
+		if r := byID[id]; !errors.Is(r.Error, ErrFileCorrupt) {
+			t.Errorf("%s file: error %v, want ErrFileCorrupt", id, r.Error)
+		}
+	}
+	if r := byID["missing"]; !errors.Is(r.Error, ErrFileMissing) {
+		t.Errorf("missing file: error %v, want ErrFileMissing", r.Error)
+	}
+}
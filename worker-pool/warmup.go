@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// warmUp sends a HEAD request for rawURL, following redirects, so that DNS
+// lookups and the connections and TLS handshakes to the hosts involved are
+// done once before the workers start, instead of by the first batch of
+// workers all at once. It gives up after timeout. The outcome only affects
+// the log: the run goes ahead even if the warm-up fails.
+func warmUp(ctx context.Context, client *http.Client, rawURL string, timeout time.Duration, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, rawURL, nil)
+	if err != nil {
+		logger.Warn("Connection warm-up failed", "url", rawURL, "error", err)
+		return
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	latency := time.Since(start)
+	if err != nil {
+		logger.Warn("Connection warm-up failed", "url", rawURL, "latency", latency, "error", err)
+		return
+	}
+	resp.Body.Close()
+	logger.Info("Connection warm-up complete",
+		"url", rawURL,
+		"final_url", resp.Request.URL.String(),
+		"status", resp.StatusCode,
+		"latency", latency,
+	)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunWarmupComesFirst(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	const jobs = 8
+	for _, warmup := range []bool{false, true} {
+		mu.Lock()
+		requests = nil
+		mu.Unlock()
+
+		cfg := validateConfig(srv, 4, fakeJobs(srv, jobs))
+		cfg.Warmup = warmup
+		if _, err := Run(cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		got := requests
+		mu.Unlock()
+		want := jobs
+		if warmup {
+			want++
+		}
+		if len(got) != want {
+			t.Errorf("warmup %t: server got %d requests, want %d", warmup, len(got), want)
+			continue
+		}
+		if !warmup {
+			continue
+		}
+		if got[0] != "HEAD /0" {
+			t.Errorf("first request = %q, want the warm-up HEAD /0 before any worker request", got[0])
+		}
+		if !slices.ContainsFunc(got[1:], func(r string) bool { return strings.HasSuffix(r, " /0") }) {
+			t.Errorf("image 0 was not requested by a worker after the warm-up: %q", got)
+		}
+	}
+}
+
+func TestWarmUpFailureIsOnlyLogged(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := srv.URL + "/0"
+	srv.Close()
+
+	logger, buf := bufferLogger()
+	warmUp(context.Background(), srv.Client(), url, time.Second, logger)
+	if out := buf.String(); !strings.Contains(out, "Connection warm-up failed") {
+		t.Errorf("warm-up against a closed server logged %q, want a warning", out)
+	}
+}